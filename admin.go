@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Wraps an admin handler so it only runs for requests carrying
+// "Authorization: Bearer <AdminToken>"
+func (cfg *apiConfig) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.AdminToken == "" {
+			respondWithError(w, r, http.StatusForbidden, "The admin API is disabled.", nil)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			respondWithError(w, r, http.StatusUnauthorized, "Unauthorized.", errors.New("invalid admin token"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Reports receipt counts, plus eviction counters for bounded stores
+func (cfg *apiConfig) handlerStoreStats(w http.ResponseWriter, r *http.Request) {
+	if reporter, ok := cfg.DB.(statsReporter); ok {
+		respond(w, r, http.StatusOK, reporter.Stats())
+		return
+	}
+
+	receipts, err := cfg.DB.List(r.Context())
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to list receipts.", err)
+		return
+	}
+
+	respond(w, r, http.StatusOK, storeStats{
+		Receipts: len(receipts),
+	})
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Returned by a ReceiptStore for receipts that existed but were evicted or expired
+var ErrReceiptGone = errors.New("receipt evicted or expired")
+
+// How many evicted or expired IDs are remembered so lookups can answer 410 rather than 404
+const goneIDsRemembered = 100_000
+
+// Bounds enforced by a boundedStore, zero values disable a bound
+type storeLimits struct {
+	MaxReceipts int
+	MaxBytes    int64
+	TTL         time.Duration
+}
+
+func (l storeLimits) enabled() bool {
+	return l.MaxReceipts > 0 || l.MaxBytes > 0 || l.TTL > 0
+}
+
+// Counters reported by GET /admin/stats
+type storeStats struct {
+	Receipts int    `json:"receipts"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Evicted  uint64 `json:"evicted"`
+	Expired  uint64 `json:"expired"`
+}
+
+// Implemented by stores that can report storeStats
+type statsReporter interface {
+	Stats() storeStats
+}
+
+// Per-receipt bookkeeping, stored as the value of an LRU list element
+type boundedEntry struct {
+	id        string
+	size      int64
+	expiresAt time.Time
+
+	// Element in the expiry queue, nil without a TTL
+	expiry *list.Element
+}
+
+// ReceiptStore wrapper that bounds the number of receipts, or their
+// approximate size in bytes, by evicting the least recently used ones, and
+// expires receipts TTL after they were stored.
+//
+// Evicted and expired receipts are deleted from the wrapped store. Their IDs
+// are remembered (up to goneIDsRemembered) so lookups return ErrReceiptGone
+// instead of ErrReceiptNotFound.
+type boundedStore struct {
+	ReceiptStore
+	limits storeLimits
+	now    func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List // Front is most recently used
+	entries map[string]*list.Element
+	bytes   int64
+
+	// LRU elements in the order they expire, front first. Every receipt gets
+	// the same TTL when stored, so this is the order they were stored in
+	expiries *list.List
+
+	gone      map[string]struct{}
+	goneOrder []string
+
+	evicted uint64
+	expired uint64
+
+	// Called with the ID of each receipt evicted or expired
+	onDrop func(id string)
+}
+
+func newBoundedStore(store ReceiptStore, limits storeLimits) *boundedStore {
+	return &boundedStore{
+		ReceiptStore: store,
+		limits:       limits,
+		now:          time.Now,
+		lru:          list.New(),
+		entries:      make(map[string]*list.Element),
+		expiries:     list.New(),
+		gone:         make(map[string]struct{}),
+	}
+}
+
+// Approximate in-memory footprint of a receipt
+func receiptSize(receipt Receipt) int64 {
+	size := len(receipt.ID) + len(receipt.Retailer) + len(receipt.PurchaseDate) + len(receipt.PurchaseTime) + len(receipt.Total)
+	for _, item := range receipt.Items {
+		size += len(item.ShortDescription) + len(item.Price)
+	}
+	return int64(size)
+}
+
+// Approximate in-memory footprint of a receipt and all its revisions
+func recordSize(record ReceiptRecord) int64 {
+	var size int64
+	for _, revision := range record.Revisions {
+		size += receiptSize(revision.Receipt)
+	}
+	return size
+}
+
+func (s *boundedStore) Put(ctx context.Context, receipt Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.ReceiptStore.Put(ctx, receipt)
+	if err != nil {
+		return err
+	}
+
+	s.track(newReceiptRecord(receipt, time.Time{}))
+	s.enforce(ctx, receipt.ID)
+	return nil
+}
+
+func (s *boundedStore) Get(ctx context.Context, id string) (Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.touch(ctx, id)
+	if err != nil {
+		return Receipt{}, err
+	}
+	return s.ReceiptStore.Get(ctx, id)
+}
+
+func (s *boundedStore) GetRecord(ctx context.Context, id string) (ReceiptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.touch(ctx, id)
+	if err != nil {
+		return ReceiptRecord{}, err
+	}
+	return s.ReceiptStore.GetRecord(ctx, id)
+}
+
+func (s *boundedStore) List(ctx context.Context) ([]Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.expire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReceiptStore.List(ctx)
+}
+
+func (s *boundedStore) Find(ctx context.Context, query ReceiptQuery) ([]Receipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.expire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReceiptStore.Find(ctx, query)
+}
+
+func (s *boundedStore) Page(ctx context.Context, request ReceiptPageRequest) (ReceiptPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.expire(ctx)
+	if err != nil {
+		return ReceiptPage{}, err
+	}
+	return s.ReceiptStore.Page(ctx, request)
+}
+
+func (s *boundedStore) ListRecords(ctx context.Context) ([]ReceiptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.expire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.ReceiptStore.ListRecords(ctx)
+}
+
+// Amending keeps the receipt's original expiry but counts as a use
+func (s *boundedStore) Amend(ctx context.Context, receipt Receipt) (ReceiptRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.touch(ctx, receipt.ID)
+	if err != nil {
+		return ReceiptRevision{}, err
+	}
+
+	revision, err := s.ReceiptStore.Amend(ctx, receipt)
+	if err != nil {
+		return ReceiptRevision{}, err
+	}
+
+	record, err := s.ReceiptStore.GetRecord(ctx, receipt.ID)
+	if err != nil {
+		return ReceiptRevision{}, err
+	}
+
+	entry := s.entries[receipt.ID].Value.(*boundedEntry)
+	s.bytes += recordSize(record) - entry.size
+	entry.size = recordSize(record)
+
+	s.enforce(ctx, receipt.ID)
+	return revision, nil
+}
+
+// Soft-deleted receipts keep their memory, and their place in the LRU
+// order, until they are purged or evicted
+func (s *boundedStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.touch(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.ReceiptStore.Delete(ctx, id)
+}
+
+func (s *boundedStore) Undelete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.touch(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.ReceiptStore.Undelete(ctx, id)
+}
+
+func (s *boundedStore) Remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[id]
+	if !ok {
+		if _, ok := s.gone[id]; ok {
+			return ErrReceiptGone
+		}
+		return ErrReceiptNotFound
+	}
+
+	err := s.ReceiptStore.Remove(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.untrack(elem)
+	return nil
+}
+
+func (s *boundedStore) Purge(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged, err := s.ReceiptStore.Purge(ctx, deletedBefore)
+	for _, id := range purged {
+		if elem, ok := s.entries[id]; ok {
+			s.untrack(elem)
+		}
+	}
+	return purged, err
+}
+
+func (s *boundedStore) Replace(ctx context.Context, records []ReceiptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.ReceiptStore.Replace(ctx, records)
+	if err != nil {
+		return err
+	}
+
+	s.lru.Init()
+	s.entries = make(map[string]*list.Element)
+	s.expiries.Init()
+	s.bytes = 0
+	for _, record := range records {
+		s.track(record)
+	}
+	s.enforce(ctx, "")
+	return nil
+}
+
+func (s *boundedStore) changeLog() *changeLog {
+	return s.ReceiptStore.(replicationSource).changeLog()
+}
+
+func (s *boundedStore) replicationSnapshot() ([]ReceiptRecord, uint64) {
+	return s.ReceiptStore.(replicationSource).replicationSnapshot()
+}
+
+func (s *boundedStore) replicationChanges(after uint64) ([]change, uint64, bool) {
+	return s.ReceiptStore.(replicationSource).replicationChanges(after)
+}
+
+func (s *boundedStore) Stats() storeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return storeStats{
+		Receipts: s.lru.Len(),
+		Bytes:    s.bytes,
+		Evicted:  s.evicted,
+		Expired:  s.expired,
+	}
+}
+
+// Removes expired receipts every interval until ctx is done, so receipts
+// that are never read again still release their memory
+func (s *boundedStore) runExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.expire(ctx)
+			s.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Records a freshly stored receipt as most recently used, called with the lock held
+func (s *boundedStore) track(record ReceiptRecord) {
+	if elem, ok := s.entries[record.ID]; ok {
+		s.untrack(elem)
+	}
+	delete(s.gone, record.ID)
+
+	entry := &boundedEntry{
+		id:   record.ID,
+		size: recordSize(record),
+	}
+	elem := s.lru.PushFront(entry)
+	if s.limits.TTL > 0 {
+		entry.expiresAt = s.now().Add(s.limits.TTL)
+		entry.expiry = s.expiries.PushBack(elem)
+	}
+
+	s.entries[record.ID] = elem
+	s.bytes += entry.size
+}
+
+// Marks id as most recently used, or returns why it cannot be read.
+// Called with the lock held
+func (s *boundedStore) touch(ctx context.Context, id string) error {
+	elem, ok := s.entries[id]
+	if !ok {
+		if _, ok := s.gone[id]; ok {
+			return ErrReceiptGone
+		}
+		return ErrReceiptNotFound
+	}
+
+	if s.isExpired(elem) {
+		err := s.drop(ctx, elem)
+		if err != nil {
+			return err
+		}
+		s.expired++
+		return ErrReceiptGone
+	}
+
+	s.lru.MoveToFront(elem)
+	return nil
+}
+
+func (s *boundedStore) untrack(elem *list.Element) {
+	entry := elem.Value.(*boundedEntry)
+	s.lru.Remove(elem)
+	if entry.expiry != nil {
+		s.expiries.Remove(entry.expiry)
+	}
+	delete(s.entries, entry.id)
+	s.bytes -= entry.size
+}
+
+func (s *boundedStore) isExpired(elem *list.Element) bool {
+	entry := elem.Value.(*boundedEntry)
+	return !entry.expiresAt.IsZero() && !s.now().Before(entry.expiresAt)
+}
+
+// Sets the func called with the ID of each receipt evicted or expired
+func (s *boundedStore) onDropped(fn func(id string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDrop = fn
+}
+
+// Deletes a tracked receipt from the wrapped store and remembers its ID as gone
+func (s *boundedStore) drop(ctx context.Context, elem *list.Element) error {
+	entry := elem.Value.(*boundedEntry)
+
+	err := s.ReceiptStore.Remove(ctx, entry.id)
+	if err != nil && !errors.Is(err, ErrReceiptNotFound) {
+		return err
+	}
+	s.untrack(elem)
+
+	s.gone[entry.id] = struct{}{}
+	s.goneOrder = append(s.goneOrder, entry.id)
+	if len(s.goneOrder) > goneIDsRemembered {
+		delete(s.gone, s.goneOrder[0])
+		s.goneOrder = s.goneOrder[1:]
+	}
+	if s.onDrop != nil {
+		s.onDrop(entry.id)
+	}
+	return nil
+}
+
+// Drops every expired receipt, stopping at the first one that has not
+// expired so the cost follows the number expired. Called with the lock held
+func (s *boundedStore) expire(ctx context.Context) error {
+	for front := s.expiries.Front(); front != nil; front = s.expiries.Front() {
+		elem := front.Value.(*list.Element)
+		if !s.isExpired(elem) {
+			return nil
+		}
+
+		err := s.drop(ctx, elem)
+		if err != nil {
+			return err
+		}
+		s.expired++
+	}
+	return nil
+}
+
+// Evicts least recently used receipts until the store is within its limits.
+// The receipt stored under keep is never evicted, so one oversized receipt
+// can still be stored. Called with the lock held
+func (s *boundedStore) enforce(ctx context.Context, keep string) {
+	for s.overLimit() {
+		elem := s.lru.Back()
+		if elem == nil || elem.Value.(*boundedEntry).id == keep {
+			return
+		}
+
+		err := s.drop(ctx, elem)
+		if err != nil {
+			// The receipt is still stored, so stop rather than spin on it
+			log.Printf("Error evicting receipt: %s", err)
+			return
+		}
+		s.evicted++
+	}
+}
+
+func (s *boundedStore) overLimit() bool {
+	if s.limits.MaxReceipts > 0 && s.lru.Len() > s.limits.MaxReceipts {
+		return true
+	}
+	return s.limits.MaxBytes > 0 && s.bytes > s.limits.MaxBytes
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func init() {
+	receiptStoreFactories["bounded"] = func(t *testing.T) ReceiptStore {
+		return newBoundedStore(newMemoryStore(), storeLimits{
+			MaxReceipts: 100,
+			MaxBytes:    1 << 20,
+			TTL:         time.Hour,
+		})
+	}
+}
+
+// Expecting the least recently used receipt to be evicted once MaxReceipts is exceeded
+func TestBoundedStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	store := newBoundedStore(newMemoryStore(), storeLimits{MaxReceipts: 2})
+
+	first := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	second := newTestReceipt("10000000-0000-0000-0000-000000000000")
+	third := newTestReceipt("20000000-0000-0000-0000-000000000000")
+
+	for _, receipt := range []Receipt{first, second} {
+		err := store.Put(ctx, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reading first makes second the least recently used
+	_, err := store.Get(ctx, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Put(ctx, third)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.Get(ctx, second.ID)
+	if !errors.Is(err, ErrReceiptGone) {
+		t.Errorf("store returned wrong error for evicted receipt\nexpected: %v\nactual: %v", ErrReceiptGone, err)
+	}
+	for _, id := range []string{first.ID, third.ID} {
+		_, err = store.Get(ctx, id)
+		if err != nil {
+			t.Errorf("store evicted wrong receipt %v: %v", id, err)
+		}
+	}
+
+	stats := store.Stats()
+	if stats.Receipts != 2 || stats.Evicted != 1 {
+		t.Errorf("store reported wrong stats: %+v", stats)
+	}
+}
+
+// Expecting receipts to be evicted once MaxBytes is exceeded
+func TestBoundedStore_EvictsOverByteBudget(t *testing.T) {
+	ctx := context.Background()
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	size := receiptSize(testReceipt)
+
+	store := newBoundedStore(newMemoryStore(), storeLimits{MaxBytes: size*2 + size/2})
+
+	ids := []string{
+		"00000000-0000-0000-0000-000000000000",
+		"10000000-0000-0000-0000-000000000000",
+		"20000000-0000-0000-0000-000000000000",
+	}
+	for _, id := range ids {
+		err := store.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := store.Stats()
+	if stats.Receipts != 2 || stats.Bytes != size*2 || stats.Evicted != 1 {
+		t.Errorf("store reported wrong stats: %+v", stats)
+	}
+
+	_, err := store.Get(ctx, ids[0])
+	if !errors.Is(err, ErrReceiptGone) {
+		t.Errorf("store returned wrong error for evicted receipt\nexpected: %v\nactual: %v", ErrReceiptGone, err)
+	}
+}
+
+// Expecting receipts to expire TTL after they were stored
+func TestBoundedStore_Expires(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+
+	store := newBoundedStore(newMemoryStore(), storeLimits{TTL: time.Hour})
+	store.now = func() time.Time { return now }
+
+	read := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	listed := newTestReceipt("10000000-0000-0000-0000-000000000000")
+	for _, receipt := range []Receipt{read, listed} {
+		err := store.Put(ctx, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(59 * time.Minute)
+	_, err := store.Get(ctx, read.ID)
+	if err != nil {
+		t.Errorf("store expired receipt early: %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	_, err = store.Get(ctx, read.ID)
+	if !errors.Is(err, ErrReceiptGone) {
+		t.Errorf("store returned wrong error for expired receipt\nexpected: %v\nactual: %v", ErrReceiptGone, err)
+	}
+
+	receipts, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 0 {
+		t.Errorf("store listed expired receipts: %+v", receipts)
+	}
+
+	err = store.Delete(ctx, listed.ID)
+	if !errors.Is(err, ErrReceiptGone) {
+		t.Errorf("store returned wrong error deleting expired receipt\nexpected: %v\nactual: %v", ErrReceiptGone, err)
+	}
+
+	stats := store.Stats()
+	if stats.Receipts != 0 || stats.Expired != 2 {
+		t.Errorf("store reported wrong stats: %+v", stats)
+	}
+
+	// Expecting a re-submitted receipt to be served again
+	err = store.Put(ctx, read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get(ctx, read.ID)
+	if err != nil {
+		t.Errorf("store did not serve re-submitted receipt: %v", err)
+	}
+}
+
+// Expecting receipts to expire in the order they were stored, however recently they were used
+func TestBoundedStore_ExpiresInStoredOrder(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+
+	store := newBoundedStore(newMemoryStore(), storeLimits{TTL: time.Hour})
+	store.now = func() time.Time { return now }
+
+	ids := []string{
+		"00000000-0000-0000-0000-000000000000",
+		"10000000-0000-0000-0000-000000000000",
+		"20000000-0000-0000-0000-000000000000",
+	}
+	for _, id := range ids {
+		err := store.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(10 * time.Minute)
+	}
+
+	// Reading the oldest makes it most recently used, but not younger
+	_, err := store.Get(ctx, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Re-storing the second restarts its TTL
+	err = store.Put(ctx, newTestReceipt(ids[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(40 * time.Minute)
+	receipts, err := store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 2 || store.Stats().Expired != 1 {
+		t.Errorf("store kept %v receipts after the first expired, stats: %+v", len(receipts), store.Stats())
+	}
+
+	now = now.Add(10 * time.Minute)
+	receipts, err = store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].ID != ids[1] {
+		t.Errorf("store kept the wrong receipts: %+v", receipts)
+	}
+}
+
+// Expecting 410 Gone from the points handler for evicted receipts
+func TestHandlerGetPoints_Gone(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newBoundedStore(newMemoryStore(), storeLimits{MaxReceipts: 1}),
+	}
+
+	evicted := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	for _, receipt := range []Receipt{evicted, newTestReceipt("10000000-2000-3000-4000-500000000000")} {
+		err := apiCfg.DB.Put(ctx, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+evicted.ID+"/points", nil))
+
+	if w.Code != http.StatusGone {
+		t.Errorf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusGone, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/20000000-0000-0000-0000-000000000000/points", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusNotFound, w.Code)
+	}
+}
+
+// Expecting eviction counters from the stats handler
+func TestHandlerStoreStats(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB:         newBoundedStore(newMemoryStore(), storeLimits{MaxReceipts: 1}),
+		AdminToken: "secret",
+	}
+
+	for _, id := range []string{"00000000-0000-0000-0000-000000000000", "10000000-2000-3000-4000-500000000000"} {
+		err := apiCfg.DB.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/stats", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerStoreStats)(w, req)
+
+	var stats storeStats
+	err := json.NewDecoder(w.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Receipts != 1 || stats.Evicted != 1 {
+		t.Errorf("handler reported wrong stats: %+v", stats)
+	}
+}
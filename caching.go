@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Validators clients can revalidate a read endpoint's response with, sent as
+// the ETag and Last-Modified headers
+type cacheValidators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// Validators for a response built from one revision of a receipt
+func revisionValidators(revision ReceiptRevision) cacheValidators {
+	return cacheValidators{
+		ETag:         receiptETag(revision.Revision, len(revision.Rescores), revision.Receipt),
+		LastModified: lastModified(revision),
+	}
+}
+
+// Validators for a response built from every revision of a receipt
+func recordValidators(record ReceiptRecord) cacheValidators {
+	var validators cacheValidators
+	rescores := 0
+	for _, revision := range record.Revisions {
+		rescores += len(revision.Rescores)
+		validators.LastModified = maxTime(validators.LastModified, lastModified(revision))
+	}
+
+	latest := record.Latest()
+	validators.ETag = receiptETag(latest.Revision, rescores, latest.Receipt)
+	return validators
+}
+
+// Strong ETag that changes when a receipt is amended or rescored, or the
+// scoring rules change, since any of them can change a response. Revisions
+// are otherwise immutable; the content hash tells apart receipts restored
+// under a reused ID
+func receiptETag(revision int, rescores int, receipt Receipt) string {
+	return fmt.Sprintf(`"r%v.%v-s%v-%.16s"`, revision, rescores, scoringRulesVersion, receiptContentHash(receipt))
+}
+
+// When the revision was stored or last rescored
+func lastModified(revision ReceiptRevision) time.Time {
+	modified := revision.CreatedAt
+	for _, rescore := range revision.Rescores {
+		modified = maxTime(modified, rescore.RescoredAt)
+	}
+	return modified
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// Sets validators for the negotiated format on the response, and answers
+// 304 Not Modified if the request's If-None-Match, or failing that
+// If-Modified-Since, shows the client's copy is current. Returns true if it
+// answered
+func notModified(w http.ResponseWriter, r *http.Request, validators cacheValidators) bool {
+	// Each format is a separate representation, needing its own ETag. Responses
+	// with validators are never lists, so are not offered as CSV
+	if format, ok := negotiateFormat(r, responseFormats(nil)); ok && format != jsonFormat {
+		validators.ETag = strings.TrimSuffix(validators.ETag, `"`) + "-" + format.Name + `"`
+	}
+
+	header := w.Header()
+	header.Set("Vary", "Accept")
+	header.Set("ETag", validators.ETag)
+	if !validators.LastModified.IsZero() {
+		header.Set("Last-Modified", validators.LastModified.UTC().Format(http.TimeFormat))
+	}
+	// Cached copies may be reused, but only after revalidating
+	header.Set("Cache-Control", "no-cache")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	current := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		current = etagMatches(ifNoneMatch, validators.ETag)
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !validators.LastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		current = err == nil && !validators.LastModified.Truncate(time.Second).After(since)
+	}
+	if !current {
+		return false
+	}
+
+	header.Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Whether an If-None-Match list names etag. Weak comparison is used, as
+// RFC 9110 specifies for If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
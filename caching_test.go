@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Expecting read endpoints to send validators and answer matching conditional requests with 304
+func TestConditionalGet(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}", apiCfg.handlerGetReceipt)
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	mux.HandleFunc("GET /receipts/{id}/points/breakdown", apiCfg.handlerGetPointsBreakdown)
+	mux.HandleFunc("GET /receipts/{id}/revisions", apiCfg.handlerGetRevisions)
+
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err := apiCfg.DB.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, path := range []string{
+		"/receipts/" + testReceipt.ID,
+		"/receipts/" + testReceipt.ID + "/points",
+		"/receipts/" + testReceipt.ID + "/points/breakdown",
+		"/receipts/" + testReceipt.ID + "/revisions",
+	} {
+		t.Run(path, func(t *testing.T) {
+			w := get(path, nil)
+			etag := w.Header().Get("ETag")
+			lastModified := w.Header().Get("Last-Modified")
+			if w.Code != http.StatusOK || etag == "" || lastModified == "" || w.Header().Get("Cache-Control") != "no-cache" {
+				t.Fatalf("handler returned %v without validators: %v", w.Code, w.Header())
+			}
+
+			notModified := []http.Header{
+				{"If-None-Match": {etag}},
+				{"If-None-Match": {`"other", W/` + etag}},
+				{"If-None-Match": {"*"}},
+				{"If-Modified-Since": {lastModified}},
+			}
+			for _, header := range notModified {
+				w := get(path, header)
+				if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+					t.Errorf("%v: handler returned %v, expected %v", header, w.Code, http.StatusNotModified)
+				}
+			}
+
+			modified := []http.Header{
+				{"If-None-Match": {`"other"`}},
+				{"If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+
+				// If-None-Match takes precedence
+				{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}},
+			}
+			for _, header := range modified {
+				if w := get(path, header); w.Code != http.StatusOK {
+					t.Errorf("%v: handler returned %v, expected %v", header, w.Code, http.StatusOK)
+				}
+			}
+		})
+	}
+
+	// Expecting an amend to change the ETag
+	before := get("/receipts/"+testReceipt.ID+"/points", nil).Header().Get("ETag")
+	amended := testReceipt
+	amended.Total = "10.01"
+	_, err = apiCfg.DB.Amend(ctx, amended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := get("/receipts/"+testReceipt.ID+"/points", http.Header{"If-None-Match": {before}})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == before {
+		t.Errorf("handler answered with the ETag of an amended receipt: %v %v", w.Code, w.Header().Get("ETag"))
+	}
+
+	// Expecting errors to carry no validators
+	w = get("/receipts/10000000-2000-3000-4000-500000000000/points", nil)
+	if w.Code != http.StatusNotFound || w.Header().Get("ETag") != "" {
+		t.Errorf("handler returned %v with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	w = get("/receipts/"+testReceipt.ID+"/points?revision=3", nil)
+	if w.Code != http.StatusNotFound || w.Header().Get("ETag") != "" {
+		t.Errorf("handler returned %v with ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+// Expecting a rescore to change the validators of the revision and its record
+func TestRevisionValidators_Rescore(t *testing.T) {
+	record := newTestRecord("00000000-0000-0000-0000-000000000000")
+	record.Revisions[0] = scoredRevision(record.Revisions[0])
+	before := revisionValidators(record.Latest())
+	beforeRecord := recordValidators(record)
+
+	rescoredAt := record.Latest().CreatedAt.Add(time.Hour)
+	record.Revisions[0].Rescores = append(record.Revisions[0].Rescores, PointsRescore{RescoredAt: rescoredAt})
+	after := revisionValidators(record.Latest())
+	afterRecord := recordValidators(record)
+
+	if after.ETag == before.ETag || !after.LastModified.Equal(rescoredAt) {
+		t.Errorf("revision validators did not follow the rescore\nbefore: %+v\nafter: %+v", before, after)
+	}
+	if afterRecord.ETag == beforeRecord.ETag || !afterRecord.LastModified.Equal(rescoredAt) {
+		t.Errorf("record validators did not follow the rescore\nbefore: %+v\nafter: %+v", beforeRecord, afterRecord)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable holding encryption keys when no key file is given
+const encryptionKeysEnv = "RECEIPT_ENCRYPTION_KEYS"
+
+// Returned when sealed data cannot be decrypted with the configured keys. Unlike
+// corruption this is a configuration problem, so stores refuse to open rather
+// than discard the data
+var errUndecryptable = errors.New("unable to decrypt")
+
+// AES-256-GCM keys by ID. The primary key encrypts everything written;
+// every key can decrypt, so old keys stay listed until data is re-encrypted
+type keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// Encrypted form of a persisted blob, tagged with the ID of the key that sealed it
+type sealedEnvelope struct {
+	KeyID      string `json:"kid"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Parses keys written as "<id>:<base64 32 byte key>", separated by commas
+// or whitespace. The first key is the primary
+func parseKeyring(spec string) (*keyring, error) {
+	fields := strings.FieldsFunc(spec, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, errors.New("no encryption keys given")
+	}
+
+	keys := &keyring{
+		aeads: make(map[string]cipher.AEAD),
+	}
+	for i, field := range fields {
+		// Reported by position, since a malformed entry may be the key itself
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("encryption key %v is not of the form <id>:<base64 key>", i+1)
+		}
+		if _, ok := keys.aeads[id]; ok {
+			return nil, fmt.Errorf("duplicate encryption key ID %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes of base64", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keys.aeads[id] = aead
+		if keys.primary == "" {
+			keys.primary = id
+		}
+	}
+
+	return keys, nil
+}
+
+// Loads keys from path, or from RECEIPT_ENCRYPTION_KEYS when path is empty.
+// Returns nil, disabling encryption, when neither is set
+func loadKeyring(path string) (*keyring, error) {
+	spec := os.Getenv(encryptionKeysEnv)
+	if path != "" {
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading encryption keys: %w", err)
+		}
+		spec = string(dat)
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	return parseKeyring(spec)
+}
+
+// Encrypts plaintext under the primary key. A nil keyring leaves it as is
+func (k *keyring) seal(plaintext []byte) ([]byte, error) {
+	if k == nil {
+		return plaintext, nil
+	}
+
+	aead := k.aeads[k.primary]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(sealedEnvelope{
+		KeyID:      k.primary,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+// Decrypts data written by seal, returning the ID of the key that sealed it.
+// Data that was never sealed, e.g. written before encryption was enabled, is
+// returned as is with an empty key ID
+func (k *keyring) open(dat []byte) ([]byte, string, error) {
+	var envelope sealedEnvelope
+	if json.Unmarshal(dat, &envelope) != nil || envelope.KeyID == "" {
+		return dat, "", nil
+	}
+
+	if k == nil {
+		return nil, envelope.KeyID, fmt.Errorf("%w: data is encrypted but no encryption keys are configured", errUndecryptable)
+	}
+	aead, ok := k.aeads[envelope.KeyID]
+	if !ok {
+		return nil, envelope.KeyID, fmt.Errorf("%w: data is encrypted with unknown key %q", errUndecryptable, envelope.KeyID)
+	}
+
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		return nil, envelope.KeyID, fmt.Errorf("%w with key %q: %w", errUndecryptable, envelope.KeyID, err)
+	}
+	return plaintext, envelope.KeyID, nil
+}
+
+// Whether data sealed under keyID (empty if plaintext) should be rewritten
+// under the current primary key
+func (k *keyring) stale(keyID string) bool {
+	if k == nil {
+		return keyID != ""
+	}
+	return keyID != k.primary
+}
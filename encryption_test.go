@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a keyring spec entry for id with a key derived from id
+func testKeySpec(id string) string {
+	key := bytes.Repeat([]byte(id[len(id)-1:]), 32)
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestKeyring(t *testing.T, ids ...string) *keyring {
+	var specs []string
+	for _, id := range ids {
+		specs = append(specs, testKeySpec(id))
+	}
+
+	keys, err := parseKeyring(strings.Join(specs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Expecting malformed key specs to be rejected and the first key to be primary
+func TestParseKeyring(t *testing.T) {
+	keys, err := parseKeyring(testKeySpec("k2") + "\n" + testKeySpec("k1") + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.primary != "k2" || len(keys.aeads) != 2 {
+		t.Errorf("parsed wrong keyring, primary: %q, keys: %v", keys.primary, len(keys.aeads))
+	}
+
+	specs := map[string]string{
+		"Empty":     " \n",
+		"NoID":      ":" + base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"NoKey":     "k1",
+		"NotBase64": "k1:not base64!",
+		"ShortKey":  "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"Duplicate": testKeySpec("k1") + "," + testKeySpec("k1"),
+	}
+	for name, spec := range specs {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseKeyring(spec)
+			if err == nil {
+				t.Errorf("expected key spec %q to be rejected", spec)
+			}
+		})
+	}
+
+	// Expecting an entry missing its ID to be reported without echoing the key
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("s"), 32))
+	_, err = parseKeyring(testKeySpec("k1") + "," + secret)
+	if err == nil || strings.Contains(err.Error(), secret) || !strings.Contains(err.Error(), "key 2") {
+		t.Errorf("malformed key reported as: %v", err)
+	}
+}
+
+// Expecting sealed data to open with any listed key and plaintext to pass through
+func TestKeyring_SealOpen(t *testing.T) {
+	plaintext := []byte(`{"retailer":"Test Retailer"}`)
+
+	old := newTestKeyring(t, "k1")
+	sealed, err := old.seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("Test Retailer")) {
+		t.Errorf("sealed data holds plaintext: %s", sealed)
+	}
+
+	rotated := newTestKeyring(t, "k2", "k1")
+	opened, keyID, err := rotated.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) || keyID != "k1" || !rotated.stale(keyID) {
+		t.Errorf("opened wrong data under key %q: %s", keyID, opened)
+	}
+
+	opened, keyID, err = rotated.open(plaintext)
+	if err != nil || !bytes.Equal(opened, plaintext) || keyID != "" {
+		t.Errorf("plaintext did not pass through, key %q, error: %v", keyID, err)
+	}
+
+	// Expecting missing and wrong keys to fail loudly rather than read as plaintext
+	for name, keys := range map[string]*keyring{
+		"NoKeys":     nil,
+		"UnknownKey": newTestKeyring(t, "k2"),
+	} {
+		_, _, err := keys.open(sealed)
+		if !errors.Is(err, errUndecryptable) {
+			t.Errorf("%v: expected errUndecryptable, got: %v", name, err)
+		}
+	}
+}
+
+// Expecting receipt files to be sealed, and rewritten under a new primary key
+func TestFileStore_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	receipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+	store, err := openFileStore(dataDir, newTestKeyring(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(ctx, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := store.path(receipt.ID)
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(dat, []byte(receipt.Retailer)) {
+		t.Errorf("receipt file holds plaintext: %s", dat)
+	}
+
+	_, err = openFileStore(dataDir, nil)
+	if !errors.Is(err, errUndecryptable) {
+		t.Errorf("expected opening without keys to fail, got: %v", err)
+	}
+
+	rotated, err := openFileStore(dataDir, newTestKeyring(t, "k2", "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := rotated.reencrypt()
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 receipt re-encrypted, got %v, error: %v", n, err)
+	}
+
+	// Expecting the retired key to be no longer needed
+	reopened, err := openFileStore(dataDir, newTestKeyring(t, "k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := reopened.Get(ctx, receipt.ID)
+	if err != nil || actual.Retailer != receipt.Retailer {
+		t.Errorf("re-encrypted store returned wrong receipt %+v, error: %v", actual, err)
+	}
+}
+
+// Expecting journal records to be sealed, rewritten under a new primary key,
+// and never truncated for want of a key
+func TestJournalStore_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "receipts.journal")
+	receipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+	store, err := openJournalStore(path, 0, newTestKeyring(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(ctx, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(dat, []byte(receipt.Retailer)) {
+		t.Errorf("journal holds plaintext: %s", dat)
+	}
+
+	_, err = openJournalStore(path, 0, nil)
+	if !errors.Is(err, errUndecryptable) {
+		t.Errorf("expected opening without keys to fail, got: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != int64(len(dat)) {
+		t.Fatalf("journal was modified by a failed open, error: %v", err)
+	}
+
+	rotated, err := openJournalStore(path, 0, newTestKeyring(t, "k2", "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Assert the rotation compaction runs even with size-based compaction disabled
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rotated.mu.RLock()
+		stale := rotated.staleRecords
+		rotated.mu.RUnlock()
+		if stale == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("journal was not re-encrypted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rotated.Close()
+
+	reopened, err := openJournalStore(path, 0, newTestKeyring(t, "k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	actual, err := reopened.Get(ctx, receipt.ID)
+	if err != nil || actual.Retailer != receipt.Retailer {
+		t.Errorf("re-encrypted journal returned wrong receipt %+v, error: %v", actual, err)
+	}
+}
+
+// Expecting sealed snapshots to verify without the key but only read with it
+func TestSnapshot_Encrypted(t *testing.T) {
+	records := []ReceiptRecord{newTestRecord("00000000-0000-0000-0000-000000000000")}
+
+	var b bytes.Buffer
+	err := writeSnapshot(&b, records, newTestKeyring(t, "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := b.String()
+	if strings.Contains(snapshot, "Test Retailer") || !strings.Contains(snapshot, `"keyId":"k1"`) {
+		t.Errorf("snapshot is not sealed under k1: %s", snapshot)
+	}
+
+	_, err = readSnapshot(strings.NewReader(snapshot), nil)
+	if !errors.Is(err, errUndecryptable) {
+		t.Errorf("expected reading without keys to fail, got: %v", err)
+	}
+
+	actual, err := readSnapshot(strings.NewReader(snapshot), newTestKeyring(t, "k2", "k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 1 || actual[0].ID != records[0].ID {
+		t.Errorf("snapshot read back wrong receipts: %+v", actual)
+	}
+}
+
+// Expecting exported lines to be sealed and to import back with the same keys
+func TestHandlerExportReceipts_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	keys := newTestKeyring(t, "k1")
+	source := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+		Keys:       keys,
+	}
+	receipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err := source.DB.Put(ctx, receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/receipts/export", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	source.requireAdmin(source.handlerExportReceipts)(w, req)
+
+	export := w.Body.String()
+	if strings.Contains(export, receipt.Retailer) || strings.Count(export, "\n") != 1 {
+		t.Fatalf("export is not one sealed line: %s", export)
+	}
+
+	target := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+		Keys:       keys,
+	}
+	req = httptest.NewRequest(http.MethodPost, "/admin/receipts/import", strings.NewReader(export))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	target.requireAdmin(target.handlerImportReceipts)(w, req)
+
+	var report struct {
+		Imported int `json:"imported"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&report)
+	if err != nil || report.Imported != 1 {
+		t.Fatalf("expected 1 receipt imported, got %+v, error: %v", report, err)
+	}
+
+	actual, err := target.DB.Get(ctx, receipt.ID)
+	if err != nil || actual.Retailer != receipt.Retailer {
+		t.Errorf("imported wrong receipt %+v, error: %v", actual, err)
+	}
+}
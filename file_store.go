@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Receipt IDs double as file names, so they are restricted to a safe alphabet
+var receiptIDPattern = regexp.MustCompile(`^[\w-]+$`)
+
+// Durable ReceiptStore that keeps one JSON file per receipt, holding its
+// full revision history, in a data directory.
+//
+// Every receipt is loaded into memory when the store is opened and reads are
+// served from memory. Writes go to disk before they become visible:
+//   - Put and Amend write the receipt to a temporary file, fsync it, rename it over
+//     "<id>.json" and fsync the directory, so an acknowledged receipt survives
+//     a crash or power loss and a torn write never replaces a good file.
+//   - Delete and Undelete rewrite the file the same way, with the receipt's
+//     tombstone set or cleared.
+//   - Remove, and Purge for each purged receipt, removes the file and fsyncs
+//     the directory.
+//   - Replace writes every receipt into a staging directory, fsyncs it and
+//     swaps it in for the current one with two renames. A crash between the
+//     renames is finished on the next open.
+//
+// With a keyring every file is sealed under its primary key. Files sealed
+// under older keys, or written before encryption was enabled, are still read
+// and are rewritten under the primary key by reencrypt.
+type fileStore struct {
+	*memoryStore
+	dir  string
+	keys *keyring
+
+	// ID of the key each receipt's file is sealed under, empty if plaintext
+	keyIDs map[string]string
+}
+
+// Opens (creating if needed) the store rooted at dataDir and loads every
+// receipt in it. A nil keyring stores receipts unencrypted
+func openFileStore(dataDir string, keys *keyring) (*fileStore, error) {
+	dir := filepath.Join(dataDir, "receipts")
+
+	err := recoverReplace(dir)
+	if err != nil {
+		return nil, fmt.Errorf("recovering interrupted restore: %w", err)
+	}
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	store := &fileStore{
+		memoryStore: newMemoryStore(),
+		dir:         dir,
+		keys:        keys,
+		keyIDs:      make(map[string]string),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading data directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		// Leftovers of writes interrupted before their rename
+		if strings.HasPrefix(name, ".tmp-") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if entry.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		dat, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("reading receipt %v: %w", name, err)
+		}
+
+		dat, keyID, err := keys.open(dat)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting receipt %v: %w", name, err)
+		}
+
+		record, err := decodeReceiptRecord(dat)
+		if err != nil {
+			return nil, fmt.Errorf("decoding receipt %v: %w", name, err)
+		}
+		store.records[record.ID] = record
+		store.keyIDs[record.ID] = keyID
+	}
+
+	store.reindex()
+	store.persist = store.writeRecord
+	store.persistAll = store.writeAll
+	return store, nil
+}
+
+func (s *fileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// Durably writes or removes the file backing id
+func (s *fileStore) writeRecord(id string, record *ReceiptRecord) error {
+	if !receiptIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid receipt ID: %q", id)
+	}
+
+	if record == nil {
+		err := os.Remove(s.path(id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.keyIDs, id)
+		return syncDir(s.dir)
+	}
+
+	dat, err := s.encode(*record)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(s.path(id), dat)
+	if err != nil {
+		return err
+	}
+	s.keyIDs[id] = s.primaryKeyID()
+	return nil
+}
+
+// Marshals record and seals it under the primary key, if any
+func (s *fileStore) encode(record ReceiptRecord) ([]byte, error) {
+	dat, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return s.keys.seal(dat)
+}
+
+func (s *fileStore) primaryKeyID() string {
+	if s.keys == nil {
+		return ""
+	}
+	return s.keys.primary
+}
+
+// Rewrites every file sealed under a key other than the primary one,
+// returning how many were rewritten. The write lock is taken one receipt at
+// a time so requests keep being served while it runs
+func (s *fileStore) reencrypt() (int, error) {
+	s.mu.RLock()
+	var stale []string
+	for id, keyID := range s.keyIDs {
+		if s.keys.stale(keyID) {
+			stale = append(stale, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	rewritten := 0
+	for _, id := range stale {
+		s.mu.Lock()
+		record, ok := s.records[id]
+		if !ok || !s.keys.stale(s.keyIDs[id]) {
+			// Removed or rewritten since the scan
+			s.mu.Unlock()
+			continue
+		}
+		err := s.writeRecord(id, &record)
+		s.mu.Unlock()
+
+		if err != nil {
+			return rewritten, fmt.Errorf("re-encrypting receipt %v: %w", id, err)
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
+
+// Writes records into a staging directory and swaps it in for the current one
+func (s *fileStore) writeAll(records map[string]ReceiptRecord) error {
+	staging := s.dir + ".new"
+	retired := s.dir + ".old"
+
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(staging, 0o755)
+	if err != nil {
+		return err
+	}
+
+	for id, record := range records {
+		if !receiptIDPattern.MatchString(id) {
+			os.RemoveAll(staging)
+			return fmt.Errorf("invalid receipt ID: %q", id)
+		}
+
+		dat, err := s.encode(record)
+		if err == nil {
+			err = writeFileSynced(filepath.Join(staging, id+".json"), dat)
+		}
+		if err != nil {
+			os.RemoveAll(staging)
+			return err
+		}
+	}
+
+	err = syncDir(staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	err = os.RemoveAll(retired)
+	if err == nil {
+		err = os.Rename(s.dir, retired)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	err = os.Rename(staging, s.dir)
+	if err != nil {
+		// Put the previous contents back so memory and disk still agree
+		os.Rename(retired, s.dir)
+		return err
+	}
+
+	s.keyIDs = make(map[string]string, len(records))
+	for id := range records {
+		s.keyIDs[id] = s.primaryKeyID()
+	}
+
+	err = syncDir(filepath.Dir(s.dir))
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(retired)
+}
+
+// Finishes or discards a Replace interrupted by a crash. The staging directory
+// is only complete once the current directory has been retired
+func recoverReplace(dir string) error {
+	staging := dir + ".new"
+	retired := dir + ".old"
+
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(staging); err == nil {
+			err = os.Rename(staging, dir)
+			if err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(staging)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(retired)
+}
+
+// Writes dat to path and fsyncs it
+func writeFileSynced(path string, dat []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(dat)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Writes dat to a temporary file next to path, fsyncs it and renames it into place
+func writeFileAtomic(path string, dat []byte) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(dat)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// Fsyncs a directory so renames and removals inside it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
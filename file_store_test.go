@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	receiptStoreFactories["file"] = func(t *testing.T) ReceiptStore {
+		store, err := openFileStore(t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+}
+
+// Expecting receipts to survive reopening the data directory
+func TestFileStore_Reopen(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+
+	store, err := openFileStore(dataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	deleted := newTestReceipt("10000000-2000-3000-4000-500000000000")
+	removed := newTestReceipt("20000000-0000-0000-0000-000000000000")
+	for _, receipt := range []Receipt{kept, deleted, removed} {
+		err = store.Put(ctx, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Delete(ctx, deleted.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Remove(ctx, removed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a write interrupted before its rename
+	err = os.WriteFile(filepath.Join(dataDir, "receipts", ".tmp-123"), []byte("{"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(dataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipts, err := reopened.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].ID != kept.ID {
+		t.Errorf("reopened store returned wrong receipts\nexpected: [%v]\nactual: %+v", kept.ID, receipts)
+	}
+
+	// Expecting the secondary indexes to be rebuilt
+	found, err := reopened.Find(ctx, ReceiptQuery{Retailer: kept.Retailer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != kept.ID {
+		t.Errorf("reopened store found wrong receipts\nexpected: [%v]\nactual: %+v", kept.ID, found)
+	}
+
+	// Expecting the tombstone to survive, and the removal to stick
+	_, err = reopened.Get(ctx, deleted.ID)
+	if !errors.Is(err, ErrReceiptDeleted) {
+		t.Errorf("reopened store lost tombstone, error: %v", err)
+	}
+	_, err = reopened.Get(ctx, removed.ID)
+	if !errors.Is(err, ErrReceiptNotFound) {
+		t.Errorf("reopened store returned removed receipt, error: %v", err)
+	}
+}
+
+// Expecting IDs that are unsafe as file names to be rejected
+func TestFileStore_InvalidID(t *testing.T) {
+	store, err := openFileStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Put(context.Background(), newTestReceipt("../escape"))
+	if err == nil {
+		t.Errorf("store accepted unsafe receipt ID")
+	}
+}
+
+// Expecting Replace to survive reopening, including after a crash between its renames
+func TestFileStore_Replace(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+
+	store, err := openFileStore(dataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put(ctx, newTestReceipt("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := newTestRecord("10000000-2000-3000-4000-500000000000")
+	err = store.Replace(ctx, []ReceiptRecord{replacement})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after the current directory was retired but before
+	// the staging directory was renamed into place
+	dir := filepath.Join(dataDir, "receipts")
+	err = os.Rename(dir, dir+".new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(dir+".old", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(dataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipts, err := reopened.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].ID != replacement.ID {
+		t.Errorf("reopened store returned wrong receipts\nexpected: [%v]\nactual: %+v", replacement.ID, receipts)
+	}
+
+	for _, leftover := range []string{dir + ".new", dir + ".old"} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("reopened store left %v behind", leftover)
+		}
+	}
+}
+
+// Expecting receipts written before revisions existed to load as revision 1
+func TestFileStore_LegacyReceipt(t *testing.T) {
+	dataDir := t.TempDir()
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+	dat, err := json.Marshal(testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dataDir, "receipts"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dataDir, "receipts", testReceipt.ID+".json"), dat, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := openFileStore(dataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.GetRecord(context.Background(), testReceipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Revisions) != 1 || record.Latest().Receipt.Total != testReceipt.Total {
+		t.Errorf("store loaded wrong record: %+v", record)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a follower's request for changes waits for one on the primary
+const followerPollWait = 30 * time.Second
+
+// Pause before retrying after the primary could not be reached
+const followerRetryDelay = time.Second
+
+// Returned when the primary no longer retains the changes a follower needs,
+// or has restarted, so the follower must start over from a snapshot
+var errFollowerResync = errors.New("follower must resync from a snapshot")
+
+// Returned when the primary does not serve a route, e.g. because it predates API versioning
+var errPrimaryRouteNotFound = errors.New("primary does not serve route")
+
+// Keeps a local in-memory store in step with a primary instance by loading
+// its snapshot and then tailing its change log over HTTP. Read endpoints are
+// served from the local store; writes are forwarded to the primary.
+type follower struct {
+	primary *url.URL
+	token   string
+	store   *memoryStore
+	client  *http.Client
+	now     func() time.Time
+
+	mu          sync.Mutex
+	prefix      string
+	epoch       string
+	applied     uint64
+	primaryHead uint64
+	caughtUpAt  time.Time
+	lastContact time.Time
+	lastError   string
+}
+
+// Replication state reported by GET /replication/status on a follower
+type followerStatus struct {
+	Role    string `json:"role"`
+	Primary string `json:"primary"`
+	Epoch   string `json:"epoch,omitempty"`
+
+	// Whether a snapshot of the primary has been loaded yet
+	Loaded bool `json:"loaded"`
+
+	// Last change applied, and the primary's head at last contact
+	Applied     uint64 `json:"applied"`
+	PrimaryHead uint64 `json:"primaryHead"`
+
+	// Changes the primary had at last contact that are not applied yet, and
+	// seconds since the follower last held everything the primary had (or
+	// since it started, before its first snapshot)
+	LagChanges uint64  `json:"lagChanges"`
+	LagSeconds float64 `json:"lagSeconds"`
+
+	LastContact *time.Time `json:"lastContact,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// Creates a follower of the primary at primaryURL, authenticating with the
+// primary's admin token
+func newFollower(primaryURL string, token string, store *memoryStore) (*follower, error) {
+	primary, err := url.Parse(primaryURL)
+	if err != nil || (primary.Scheme != "http" && primary.Scheme != "https") || primary.Host == "" {
+		return nil, fmt.Errorf("invalid primary URL %q", primaryURL)
+	}
+
+	f := &follower{
+		primary: primary,
+		token:   token,
+		store:   store,
+		client: &http.Client{
+			Timeout: followerPollWait + 30*time.Second,
+		},
+		now:    time.Now,
+		prefix: apiVersionPrefix,
+	}
+	// Until the first snapshot loads, lag is measured from when the follower started
+	f.caughtUpAt = f.now()
+	return f, nil
+}
+
+// Follows the primary until ctx is done, retrying whenever it cannot be reached
+func (f *follower) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := f.sync(ctx)
+		if errors.Is(err, errFollowerResync) {
+			log.Printf("Resyncing from primary %v: %s", f.primary, err)
+			f.mu.Lock()
+			f.epoch = ""
+			f.mu.Unlock()
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			f.mu.Lock()
+			f.lastError = err.Error()
+			f.mu.Unlock()
+			log.Printf("Error following primary %v: %s", f.primary, err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(followerRetryDelay):
+			}
+		}
+	}
+}
+
+// Loads a snapshot if the follower has none yet, otherwise applies the next batch of changes
+func (f *follower) sync(ctx context.Context) error {
+	f.mu.Lock()
+	epoch, applied := f.epoch, f.applied
+	f.mu.Unlock()
+
+	if epoch == "" {
+		return f.bootstrap(ctx)
+	}
+
+	var body struct {
+		Epoch   string `json:"epoch"`
+		Head    uint64 `json:"head"`
+		Changes []struct {
+			Seq    uint64          `json:"seq"`
+			ID     string          `json:"id"`
+			Record json.RawMessage `json:"record"`
+		} `json:"changes"`
+	}
+	path := "/replication/changes?after=" + strconv.FormatUint(applied, 10) + "&wait=" + followerPollWait.String()
+	err := f.get(ctx, path, &body)
+	if err != nil {
+		return err
+	}
+	if body.Epoch != epoch {
+		return fmt.Errorf("%w: primary restarted", errFollowerResync)
+	}
+
+	for _, change := range body.Changes {
+		var record *ReceiptRecord
+		if len(change.Record) > 0 && string(change.Record) != "null" {
+			decoded, err := decodeReceiptRecord(change.Record)
+			if err != nil {
+				return err
+			}
+			record = &decoded
+		}
+
+		err := f.store.applyChange(change.ID, record)
+		if err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		f.applied = change.Seq
+		f.mu.Unlock()
+	}
+
+	f.contacted(body.Head)
+	return nil
+}
+
+// Replaces the local store with the primary's snapshot
+func (f *follower) bootstrap(ctx context.Context) error {
+	var body struct {
+		Epoch   string            `json:"epoch"`
+		Seq     uint64            `json:"seq"`
+		Records []json.RawMessage `json:"records"`
+	}
+	err := f.get(ctx, "/replication/snapshot", &body)
+	if err != nil {
+		return err
+	}
+
+	records := make([]ReceiptRecord, 0, len(body.Records))
+	for _, dat := range body.Records {
+		record, err := decodeReceiptRecord(dat)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+
+	err = f.store.Replace(ctx, records)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.epoch = body.Epoch
+	f.applied = body.Seq
+	f.mu.Unlock()
+	f.contacted(body.Seq)
+
+	log.Printf("Loaded %v receipts from primary %v", len(records), f.primary)
+	return nil
+}
+
+// Records a successful exchange with the primary, whose log is at head
+func (f *follower) contacted(head uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	f.lastContact = now
+	f.lastError = ""
+	f.primaryHead = max(f.primaryHead, head)
+	if f.applied >= f.primaryHead {
+		f.caughtUpAt = now
+	}
+}
+
+// GETs path from the primary, under the API version it serves, and decodes
+// its JSON response into v. A primary from before versioning only serves the
+// unversioned routes, so on 404 the other one is tried, and remembered if it
+// answers, letting followers be upgraded first
+func (f *follower) get(ctx context.Context, path string, v any) error {
+	f.mu.Lock()
+	prefix := f.prefix
+	f.mu.Unlock()
+
+	err := f.getPrefixed(ctx, prefix+path, v)
+	if !errors.Is(err, errPrimaryRouteNotFound) {
+		return err
+	}
+
+	other := apiVersionPrefix
+	if prefix == apiVersionPrefix {
+		other = ""
+	}
+	err = f.getPrefixed(ctx, other+path, v)
+	if err == nil {
+		log.Printf("Primary %v serves %q routes, following them", f.primary, other)
+		f.mu.Lock()
+		f.prefix = other
+		f.mu.Unlock()
+	}
+	return err
+}
+
+func (f *follower) getPrefixed(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(f.primary.String(), "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+f.token)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return fmt.Errorf("%w: changes no longer retained", errFollowerResync)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %v", errPrimaryRouteNotFound, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary answered %v", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Reports how far behind the primary the follower is
+func (f *follower) status() followerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := followerStatus{
+		Role:        "follower",
+		Primary:     f.primary.String(),
+		Epoch:       f.epoch,
+		Loaded:      f.epoch != "",
+		Applied:     f.applied,
+		PrimaryHead: f.primaryHead,
+		LastError:   f.lastError,
+	}
+	if f.primaryHead > f.applied {
+		status.LagChanges = f.primaryHead - f.applied
+	}
+
+	if status.LagChanges > 0 || !status.Loaded {
+		status.LagSeconds = f.now().Sub(f.caughtUpAt).Seconds()
+	}
+	if !f.lastContact.IsZero() {
+		lastContact := f.lastContact
+		status.LastContact = &lastContact
+	}
+	return status
+}
+
+// Serves reads with next and forwards every other request to the primary.
+// Receipt events, webhooks and jobs only exist where receipts are processed,
+// so reads of them are forwarded too
+func (f *follower) forwardWrites(next http.Handler) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(f.primary)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isRead := r.Method == http.MethodGet || r.Method == http.MethodHead
+		primaryOnly := strings.HasSuffix(r.URL.Path, "/receipts/events") || strings.Contains(r.URL.Path, "/admin/webhooks") || strings.Contains(r.URL.Path, "/jobs/")
+		if isRead && !primaryOnly {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Forwarded-To-Primary", "true")
+		proxy.ServeHTTP(w, r)
+	})
+}
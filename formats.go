@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A format request and response bodies can be written in. JSON is canonical:
+// XML and YAML are converted from and to it, so they carry the same field
+// names as the json tags
+type bodyFormat struct {
+	// Short name, qualifying the ETags of representations in the format
+	Name string
+
+	// Media types the format is known by, the first sent as Content-Type
+	MediaTypes []string
+
+	Encode func(payload any) ([]byte, error)
+
+	// Converts a request body in the format to JSON, nil if it is only sent
+	ToJSON func(body io.Reader) (io.Reader, error)
+}
+
+var (
+	jsonFormat = &bodyFormat{
+		Name:       "json",
+		MediaTypes: []string{"application/json"},
+		Encode:     func(payload any) ([]byte, error) { return json.Marshal(payload) },
+		ToJSON:     func(body io.Reader) (io.Reader, error) { return body, nil },
+	}
+	xmlFormat = &bodyFormat{
+		Name:       "xml",
+		MediaTypes: []string{"application/xml", "text/xml"},
+		Encode:     encodeXML,
+		ToJSON:     xmlToJSON,
+	}
+	yamlFormat = &bodyFormat{
+		Name:       "yaml",
+		MediaTypes: []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		Encode:     encodeYAML,
+		ToJSON:     yamlToJSON,
+	}
+	csvFormat = &bodyFormat{
+		Name:       "csv",
+		MediaTypes: []string{"text/csv"},
+		Encode:     encodeCSV,
+	}
+)
+
+// Formats request bodies are read in
+var requestFormats = []*bodyFormat{jsonFormat, xmlFormat, yamlFormat}
+
+// Returned by requestBodyJSON for a Content-Type no format reads
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// Implemented by list payloads that can also be sent as CSV, a row per element
+type csvTable interface {
+	csvHeader() []string
+	csvRows() [][]string
+}
+
+// Formats payload can be sent in, the first used when the client has no
+// preference. Only lists are offered as CSV
+func responseFormats(payload any) []*bodyFormat {
+	if _, ok := payload.(csvTable); ok {
+		return []*bodyFormat{jsonFormat, xmlFormat, yamlFormat, csvFormat}
+	}
+	return []*bodyFormat{jsonFormat, xmlFormat, yamlFormat}
+}
+
+// Primary media type of each format
+func mediaTypes(formats []*bodyFormat) []string {
+	types := make([]string, 0, len(formats))
+	for _, format := range formats {
+		types = append(types, format.MediaTypes[0])
+	}
+	return types
+}
+
+// Picks the offered format the request's Accept header ranks highest, the
+// first offer if it states no preference. Returns false if it accepts none
+func negotiateFormat(r *http.Request, offers []*bodyFormat) (*bodyFormat, bool) {
+	ranges := parseAccept(strings.Join(r.Header.Values("Accept"), ","))
+	if len(ranges) == 0 {
+		return offers[0], true
+	}
+
+	var best *bodyFormat
+	bestQuality := 0.0
+	for _, format := range offers {
+		for _, mediaType := range format.MediaTypes {
+			if quality := acceptQuality(ranges, mediaType); quality > bestQuality {
+				best, bestQuality = format, quality
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// A media range of an Accept header, such as "text/*;q=0.5"
+type mediaRange struct {
+	Type    string
+	Subtype string
+	Quality float64
+}
+
+// Reads the media ranges of an Accept header, skipping any it cannot parse
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		typ, subtype, ok := strings.Cut(mediaType, "/")
+		if !ok {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil || quality < 0 || quality > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{Type: typ, Subtype: subtype, Quality: quality})
+	}
+	return ranges
+}
+
+// Quality given to mediaType by the most specific range matching it, 0 if none does
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	quality, specificity := 0.0, -1
+	for _, rng := range ranges {
+		s := -1
+		switch {
+		case rng.Type == typ && rng.Subtype == subtype:
+			s = 2
+		case rng.Type == typ && rng.Subtype == "*":
+			s = 1
+		case rng.Type == "*" && rng.Subtype == "*":
+			s = 0
+		}
+		if s > specificity {
+			quality, specificity = rng.Quality, s
+		}
+	}
+	return quality
+}
+
+// Reads a request body in the format its Content-Type names, as JSON. Bodies
+// without a Content-Type are taken to be JSON, as are bodies of any other
+// type sent to the unversioned aliases, which read every body as JSON before
+// formats were negotiated
+func requestBodyJSON(r *http.Request) (io.Reader, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return r.Body, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		for _, format := range requestFormats {
+			if slices.Contains(format.MediaTypes, mediaType) {
+				return format.ToJSON(r.Body)
+			}
+		}
+	}
+	if apiPrefix(r) == "" {
+		return r.Body, nil
+	}
+	return nil, fmt.Errorf("%w: %v", errUnsupportedMediaType, contentType)
+}
+
+// Converts payload to a tree, keeping the order of its JSON fields
+func payloadTree(payload any) (*yaml.Node, error) {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(dat))
+	decoder.UseNumber()
+	return readJSONTree(decoder)
+}
+
+// Reads the next JSON value from decoder as a tree
+func readJSONTree(decoder *json.Decoder) (*yaml.Node, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok := tok.(type) {
+	case json.Delim:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if tok == '{' {
+			node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for decoder.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			value, err := readJSONTree(decoder)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, value)
+		}
+		// Closing delimiter
+		_, err := decoder.Token()
+		return node, err
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: tok}, nil
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(tok.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: tok.String()}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(tok)}, nil
+	default:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	}
+}
+
+// Writes a tree read from an XML or YAML body as JSON. Scalars other than
+// null become strings, since every field of a receipt is one; this lets YAML
+// clients leave totals and dates unquoted
+func treeJSON(node *yaml.Node) (io.Reader, error) {
+	var buf bytes.Buffer
+	err := writeTreeJSON(&buf, node)
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func writeTreeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(node.Content[i].Value)
+			buf.Write(key)
+			buf.WriteByte(':')
+			err := writeTreeJSON(buf, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeTreeJSON(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		if node.ShortTag() == "!!null" {
+			buf.WriteString("null")
+			return nil
+		}
+		value, _ := json.Marshal(node.Value)
+		buf.Write(value)
+	default:
+		// Aliases could expand a small body into a huge one
+		return errors.New("YAML aliases are not supported")
+	}
+	return nil
+}
+
+// Writes payload as XML under a <response> root. Object fields become
+// elements named after their keys, array elements <item> elements, and
+// null fields are left out
+func encodeXML(payload any) ([]byte, error) {
+	node, err := payloadTree(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	err = writeXMLElement(encoder, "response", node)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Flush()
+	return buf.Bytes(), err
+}
+
+func writeXMLElement(encoder *xml.Encoder, name string, node *yaml.Node) error {
+	// Keys that are not XML names, such as retailer names, become <entry key="...">
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !isXMLName(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+	err := encoder.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Tag == "!!null" {
+				continue
+			}
+			err = writeXMLElement(encoder, node.Content[i].Value, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			err = writeXMLElement(encoder, "item", item)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		if node.Tag != "!!null" {
+			err = encoder.EncodeToken(xml.CharData(node.Value))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// Whether name can be used as an XML element name as is
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, c := range name {
+		if c == '_' || unicode.IsLetter(c) || i > 0 && (unicode.IsDigit(c) || c == '-' || c == '.') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// How deeply XML request bodies may nest; a receipt needs three levels
+const maxXMLDepth = 32
+
+// Reads an XML body shaped like encodeXML's output, whatever its root is
+// named. Elements holding only <item> elements are arrays, other elements
+// with children objects, empty elements null, and the rest strings
+func xmlToJSON(body io.Reader) (io.Reader, error) {
+	decoder := xml.NewDecoder(body)
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			node, err := readXMLElement(decoder, 1)
+			if err != nil {
+				return nil, err
+			}
+			return treeJSON(node)
+		}
+	}
+}
+
+// Reads the element whose start element was just read
+func readXMLElement(decoder *xml.Decoder, depth int) (*yaml.Node, error) {
+	if depth > maxXMLDepth {
+		return nil, errors.New("XML is nested too deeply")
+	}
+
+	var text strings.Builder
+	var names []string
+	var children []*yaml.Node
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			child, err := readXMLElement(decoder, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			name := tok.Name.Local
+			for _, attr := range tok.Attr {
+				if name == "entry" && attr.Name.Local == "key" {
+					name = attr.Value
+				}
+			}
+			names = append(names, name)
+			children = append(children, child)
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			return xmlElementNode(names, children, text.String()), nil
+		}
+	}
+}
+
+func xmlElementNode(names []string, children []*yaml.Node, text string) *yaml.Node {
+	if len(children) == 0 {
+		if text == "" {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: text}
+	}
+
+	isArray := true
+	for _, name := range names {
+		isArray = isArray && name == "item"
+	}
+	if isArray {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: children}
+	}
+
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for i, child := range children {
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: names[i]}, child)
+	}
+	return node
+}
+
+// Writes payload as a YAML document
+func encodeYAML(payload any) ([]byte, error) {
+	node, err := payloadTree(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(node)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	return buf.Bytes(), err
+}
+
+// Reads the first document of a YAML body
+func yamlToJSON(body io.Reader) (io.Reader, error) {
+	var document yaml.Node
+	err := yaml.NewDecoder(body).Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	return treeJSON(document.Content[0])
+}
+
+// Writes a csvTable with a header row. Cells a spreadsheet would evaluate as
+// a formula are prefixed with a quote, so they stay text
+func encodeCSV(payload any) ([]byte, error) {
+	table, ok := payload.(csvTable)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot be written as CSV", payload)
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(table.csvHeader())
+	for _, row := range table.csvRows() {
+		for i, cell := range row {
+			if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+				row[i] = "'" + cell
+			}
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
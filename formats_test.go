@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Expecting the Accept header's most preferred offered format to be chosen
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		tabular  bool
+		expected *bodyFormat
+	}{
+		{accept: "", expected: jsonFormat},
+		{accept: "*/*", expected: jsonFormat},
+		{accept: "not a media type", expected: jsonFormat},
+		{accept: "application/xml", expected: xmlFormat},
+		{accept: "text/xml", expected: xmlFormat},
+		{accept: "application/x-yaml", expected: yamlFormat},
+		{accept: "application/json;q=0.5, application/yaml", expected: yamlFormat},
+		{accept: "application/xml;q=0.2, */*;q=0.5", expected: jsonFormat},
+		{accept: "text/csv, application/json;q=0.9", expected: jsonFormat},
+		{accept: "text/csv, application/json;q=0.9", tabular: true, expected: csvFormat},
+		{accept: "text/html, text/csv", tabular: true, expected: csvFormat},
+		{accept: "text/csv", expected: nil},
+		{accept: "application/json;q=0", expected: nil},
+		{accept: "text/html", expected: nil},
+	}
+
+	for _, tc := range tests {
+		var payload any
+		if tc.tabular {
+			payload = receiptList{}
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", tc.accept)
+
+		actual, ok := negotiateFormat(req, responseFormats(payload))
+		if actual != tc.expected || ok != (tc.expected != nil) {
+			t.Errorf("Accept %q (tabular %v)\nexpected: %v\nactual: %v", tc.accept, tc.tabular, tc.expected, actual)
+		}
+	}
+}
+
+// Expecting receipts to be readable as XML and YAML, with the field names of the JSON
+func TestRespond_Formats(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err := apiCfg.DB.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}", apiCfg.handlerGetReceipt)
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/receipts/"+testReceipt.ID+"/points", http.Header{"Accept": {"application/xml"}})
+	expected := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<response><points>89</points></response>`
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/xml" || w.Body.String() != expected {
+		t.Errorf("handler returned %v %v\nexpected: %v\nactual: %v", w.Code, w.Header().Get("Content-Type"), expected, w.Body.String())
+	}
+
+	w = get("/receipts/"+testReceipt.ID, http.Header{"Accept": {"application/yaml"}})
+	for _, line := range []string{
+		"  id: 00000000-0000-0000-0000-000000000000\n",
+		"  purchaseDate: \"2024-12-18\"\n",
+		"  items:\n    - shortDescription: Test Item\n      price: \"10.00\"\n",
+		"revision: 1\n",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("YAML response is missing %q:\n%v", line, w.Body.String())
+		}
+	}
+
+	// Expecting each format to get its own ETag, and to be revalidated against it
+	jsonETag := get("/receipts/"+testReceipt.ID, nil).Header().Get("ETag")
+	yamlETag := w.Header().Get("ETag")
+	if yamlETag == jsonETag || w.Header().Get("Vary") != "Accept" {
+		t.Errorf("YAML and JSON representations share ETag %v", yamlETag)
+	}
+	w = get("/receipts/"+testReceipt.ID, http.Header{"Accept": {"application/yaml"}, "If-None-Match": {jsonETag}})
+	if w.Code != http.StatusOK {
+		t.Errorf("handler returned %v for the ETag of another format, expected %v", w.Code, http.StatusOK)
+	}
+	w = get("/receipts/"+testReceipt.ID, http.Header{"Accept": {"application/yaml"}, "If-None-Match": {yamlETag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("handler returned %v, expected %v", w.Code, http.StatusNotModified)
+	}
+
+	// Expecting formats a response cannot be sent in to be refused, and errors to fall back to JSON
+	w = get("/receipts/"+testReceipt.ID+"/points", http.Header{"Accept": {"text/csv"}})
+	if w.Code != http.StatusNotAcceptable || w.Header().Get("ETag") != "" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("handler returned %v %v, expected %v", w.Code, w.Header(), http.StatusNotAcceptable)
+	}
+	w = get("/receipts/10000000-2000-3000-4000-500000000000/points", http.Header{"Accept": {"text/csv"}})
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"description"`) {
+		t.Errorf("handler returned %v %v, expected a JSON 404", w.Code, w.Body.String())
+	}
+}
+
+// Expecting receipt listings to be sent as CSV, a row per receipt
+func TestListReceipts_CSV(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	for _, id := range []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"} {
+		err := apiCfg.DB.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts?limit=1", nil)
+	req.Header.Set("Accept", "text/csv")
+	w := httptest.NewRecorder()
+	apiCfg.handlerListReceipts(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("handler returned %v %v", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.HasPrefix(w.Header().Get("Link"), "</receipts?") {
+		t.Errorf("handler did not link the next page: %q", w.Header().Get("Link"))
+	}
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"id", "retailer", "purchaseDate", "purchaseTime", "total", "items", "points", "revision", "submittedAt", "updatedAt"},
+		{"00000000-0000-0000-0000-000000000001", "Test Retailer", "2024-12-18", "12:00", "10.00", "1", "89", "1"},
+	}
+	if len(rows) != 2 || !reflect.DeepEqual(rows[0], expected[0]) || !reflect.DeepEqual(rows[1][:8], expected[1]) {
+		t.Errorf("handler returned wrong rows\nexpected: %v\nactual: %v", expected, rows)
+	}
+}
+
+// Expecting cells a spreadsheet would evaluate to be kept as text
+func TestEncodeCSV_Formulas(t *testing.T) {
+	list := receiptList{
+		Receipts: []receiptResponse{{Receipt: Receipt{Retailer: "-1+1"}}},
+	}
+	dat, err := encodeCSV(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dat), ",'-1+1,") {
+		t.Errorf("formula was not escaped: %s", dat)
+	}
+}
+
+// Expecting receipts to be accepted as XML and YAML, and unsupported types refused
+func TestProcessReceipts_Formats(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	handler := newVersionedTestServer(&apiCfg, apiDeprecation{})
+
+	bodies := map[string]string{
+		"application/xml": `<receipt>
+			<retailer>Test Retailer</retailer>
+			<purchaseDate>2024-12-18</purchaseDate>
+			<purchaseTime>12:00</purchaseTime>
+			<items>
+				<item><shortDescription>Test Item</shortDescription><price>10.00</price></item>
+			</items>
+			<total>10.00</total>
+		</receipt>`,
+		"application/yaml; charset=utf-8": `
+retailer: Test Retailer
+purchaseDate: 2024-12-18
+purchaseTime: "12:00"
+items:
+  - shortDescription: Test Item
+    price: 10.00
+total: 10.00
+`,
+	}
+	for contentType, body := range bodies {
+		// Expecting estimates to read the same bodies as submissions
+		req := httptest.NewRequest(http.MethodPost, "/v1/receipts/score", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: score handler returned %v %v", contentType, w.Code, w.Body.String())
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/v1/receipts/process", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", contentType)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Errorf("%v: handler returned %v %v", contentType, w.Code, w.Body.String())
+			continue
+		}
+
+		id := strings.TrimPrefix(w.Header().Get("Location"), "/v1/receipts/")
+		receipt, err := apiCfg.DB.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := newTestReceipt(id)
+		if !reflect.DeepEqual(receipt, expected) {
+			t.Errorf("%v: stored receipt differs\nexpected: %+v\nactual: %+v", contentType, expected, receipt)
+		}
+
+		// Expecting amendments to read the same bodies too
+		req = httptest.NewRequest(http.MethodPut, "/v1/receipts/"+id, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: amend handler returned %v %v", contentType, w.Code, w.Body.String())
+		}
+	}
+
+	invalid := []string{
+		`<receipt><items><item>` + strings.Repeat("<a>", maxXMLDepth) + `</receipt>`,
+		"retailer: &r Test Retailer\nitems: *r\n",
+	}
+	for i, contentType := range []string{"application/xml", "application/yaml"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/receipts/process", strings.NewReader(invalid[i]))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: handler returned %v, expected %v", contentType, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Expecting the unversioned alias to keep reading any body as JSON
+	dat := `{"retailer":"Test Retailer","purchaseDate":"2024-12-18","purchaseTime":"12:00","items":[{"shortDescription":"Test Item","price":"10.00"}],"total":"10.00"}`
+	for path, code := range map[string]int{"/v1/receipts/process": http.StatusUnsupportedMediaType, "/v1/receipts/score": http.StatusUnsupportedMediaType, "/receipts/process": http.StatusOK, "/receipts/score": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(dat))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != code {
+			t.Errorf("%v: handler returned %v, expected %v", path, w.Code, code)
+		}
+		if code == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Post") == "" {
+			t.Errorf("%v: handler did not list the accepted types", path)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/v1/receipts/00000000-0000-0000-0000-000000000000", strings.NewReader(dat))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("amend handler returned %v, expected %v", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"math"
 	"net/http"
 	"strconv"
@@ -13,10 +12,15 @@ import (
 func (cfg *apiConfig) handlerGetPointsByID(w http.ResponseWriter, r *http.Request) {
 	receiptID := r.PathValue("id")
 
-	value, ok := cfg.DB.Load(receiptID)
-	err := errors.New("receipt not found for id")
+	record, err := cfg.DB.GetRecord(r.Context(), receiptID)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	// Scores the latest revision unless "?revision=" asks for an older one
+	revision, ok := requestedRevision(w, r, record)
 	if !ok {
-		respondWithError(w, http.StatusNotFound, "No receipt found for that ID.", err)
 		return
 	}
 
@@ -24,24 +28,54 @@ func (cfg *apiConfig) handlerGetPointsByID(w http.ResponseWriter, r *http.Reques
 		Points int64 `json:"points"`
 	}
 
-	receipt := value.(Receipt)
+	if notModified(w, r, revisionValidators(revision)) {
+		return
+	}
 
-	// Obtaining points awarded by field
-	retailerPoints := retailerPoints(receipt.Retailer)
-	totalPoints := totalPoints(receipt.Total)
-	itemPoints := itemPoints(receipt.Items)
-	shortDescriptionPoints := shortDescriptionPoints(receipt.Items)
-	purchaseDatePoints := purchaseDatePoints(receipt.PurchaseDate)
-	purchaseTimePoints := purchaseTimePoints(receipt.PurchaseTime)
+	// Points were stored when the revision was, so later rule changes do not
+	// alter them until an admin rescores
+	respond(w, r, http.StatusOK, ResponseBody{
+		Points: revision.Score().Points,
+	})
+}
 
-	// Summation of points awarded to Receipt
-	receiptPoints := retailerPoints + totalPoints + itemPoints + shortDescriptionPoints + purchaseDatePoints + purchaseTimePoints
-	int64Points := int64(receiptPoints)
+// Points awarded to a receipt, with the share awarded by each rule
+type ReceiptPoints struct {
+	Points    int64           `json:"points"`
+	Breakdown PointsBreakdown `json:"breakdown"`
+}
 
-	respondWithJSON(w, http.StatusOK, ResponseBody{
-		Points: int64Points,
-	})
+// Points awarded by each rule
+type PointsBreakdown struct {
+	Retailer         int64 `json:"retailer"`
+	Total            int64 `json:"total"`
+	Items            int64 `json:"items"`
+	ShortDescription int64 `json:"shortDescription"`
+	PurchaseDate     int64 `json:"purchaseDate"`
+	PurchaseTime     int64 `json:"purchaseTime"`
+}
 
+// Version of the rules scoreReceipt applies, part of the ETags of responses
+// carrying points. Bump it whenever a rule changes
+const scoringRulesVersion = 1
+
+// Calculates and returns the points awarded to a receipt by each rule
+func scoreReceipt(receipt Receipt) ReceiptPoints {
+	// Obtaining points awarded by field
+	breakdown := PointsBreakdown{
+		Retailer:         int64(retailerPoints(receipt.Retailer)),
+		Total:            int64(totalPoints(receipt.Total)),
+		Items:            int64(itemPoints(receipt.Items)),
+		ShortDescription: int64(shortDescriptionPoints(receipt.Items)),
+		PurchaseDate:     int64(purchaseDatePoints(receipt.PurchaseDate)),
+		PurchaseTime:     int64(purchaseTimePoints(receipt.PurchaseTime)),
+	}
+
+	// Summation of points awarded to Receipt
+	return ReceiptPoints{
+		Points:    breakdown.Retailer + breakdown.Total + breakdown.Items + breakdown.ShortDescription + breakdown.PurchaseDate + breakdown.PurchaseTime,
+		Breakdown: breakdown,
+	}
 }
 
 // Calculates and returns points awarded based off "Retailer" field
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Returns a stored receipt as it was recorded, with when it was submitted and the points it was awarded
+func (cfg *apiConfig) handlerGetReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID := r.PathValue("id")
+
+	record, err := cfg.DB.GetRecord(r.Context(), receiptID)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	// Returns the latest revision unless "?revision=" asks for an older one
+	revision, ok := requestedRevision(w, r, record)
+	if !ok {
+		return
+	}
+
+	if notModified(w, r, revisionValidators(revision)) {
+		return
+	}
+
+	respond(w, r, http.StatusOK, newReceiptResponse(record, revision))
+}
+
+// A stored receipt as returned by the API, with its metadata
+type receiptResponse struct {
+	Receipt     Receipt   `json:"receipt"`
+	Revision    int       `json:"revision"`
+	SubmittedAt time.Time `json:"submittedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	Points      int64     `json:"points"`
+}
+
+func newReceiptResponse(record ReceiptRecord, revision ReceiptRevision) receiptResponse {
+	return receiptResponse{
+		Receipt:     revision.Receipt,
+		Revision:    revision.Revision,
+		SubmittedAt: record.Revisions[0].CreatedAt,
+		UpdatedAt:   revision.CreatedAt,
+		Points:      revision.Score().Points,
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// Expecting the stored receipt to be returned with its metadata, and the
+// same 404 and 410 responses as the points endpoint
+func TestHandlerGetReceipt(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}", apiCfg.handlerGetReceipt)
+
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err := apiCfg.DB.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amended := testReceipt
+	amended.Total = "10.01"
+	_, err = apiCfg.DB.Amend(ctx, amended)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getReceipt := func(path string) (int, receiptResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var body receiptResponse
+		if w.Code == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, body
+	}
+
+	code, body := getReceipt("/receipts/" + testReceipt.ID)
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, code)
+	}
+	if !reflect.DeepEqual(body.Receipt, amended) {
+		t.Errorf("handler returned wrong receipt\nexpected: %+v\nactual: %+v", amended, body.Receipt)
+	}
+	if body.Revision != 2 || body.Points != scoreReceipt(amended).Points {
+		t.Errorf("handler returned wrong metadata: %+v", body)
+	}
+	if body.SubmittedAt.IsZero() || body.UpdatedAt.Before(body.SubmittedAt) {
+		t.Errorf("handler returned wrong timestamps: %+v", body)
+	}
+
+	// Expecting an older revision on request
+	code, body = getReceipt("/receipts/" + testReceipt.ID + "?revision=1")
+	if code != http.StatusOK || !reflect.DeepEqual(body.Receipt, testReceipt) || body.Points != 89 {
+		t.Errorf("handler returned wrong revision: %v %+v", code, body)
+	}
+
+	if code, _ := getReceipt("/receipts/" + testReceipt.ID + "?revision=3"); code != http.StatusNotFound {
+		t.Errorf("handler returned %v for a missing revision, expected %v", code, http.StatusNotFound)
+	}
+	if code, _ := getReceipt("/receipts/10000000-2000-3000-4000-500000000000"); code != http.StatusNotFound {
+		t.Errorf("handler returned %v for a missing receipt, expected %v", code, http.StatusNotFound)
+	}
+
+	err = apiCfg.DB.Delete(ctx, testReceipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := getReceipt("/receipts/" + testReceipt.ID); code != http.StatusGone {
+		t.Errorf("handler returned %v for a deleted receipt, expected %v", code, http.StatusGone)
+	}
+}
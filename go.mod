@@ -2,4 +2,7 @@ module github.com/thecommercialguy/FetchExcercise.git
 
 go 1.23.1
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/google/uuid v1.6.0
+	gopkg.in/yaml.v3 v3.0.1
+)
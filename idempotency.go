@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Longest Idempotency-Key header accepted
+const idempotencyKeyMaxLength = 255
+
+// Returned when an Idempotency-Key is reused with a different receipt
+var errIdempotencyConflict = errors.New("idempotency key reused with a different receipt")
+
+// Remembers which receipt ID each Idempotency-Key, and optionally each
+// receipt's content hash, produced, so retried submissions within the window
+// return the original ID instead of storing the receipt again
+type idempotencyCache struct {
+	window        time.Duration
+	dedupeContent bool
+	now           func() time.Time
+
+	mu       sync.Mutex
+	keys     map[string]*idempotencyEntry
+	contents map[string]*idempotencyEntry
+	receipts map[string]*idempotencyEntry
+
+	// Committed entries in expiry order, so expired ones can be pruned from the front
+	order []*idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	key       string
+	hash      string
+	receiptID string
+	expiresAt time.Time
+
+	// Closed once the submission that reserved this entry has finished
+	done chan struct{}
+}
+
+func newIdempotencyCache(window time.Duration, dedupeContent bool) *idempotencyCache {
+	return &idempotencyCache{
+		window:        window,
+		dedupeContent: dedupeContent,
+		now:           time.Now,
+		keys:          make(map[string]*idempotencyEntry),
+		contents:      make(map[string]*idempotencyEntry),
+		receipts:      make(map[string]*idempotencyEntry),
+	}
+}
+
+// Canonical hash of a receipt's submitted fields, ignoring its ID
+func receiptContentHash(receipt Receipt) string {
+	receipt.ID = ""
+	dat, _ := json.Marshal(receipt)
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:])
+}
+
+// Looks up a previous submission by idempotency key (may be empty) and content hash.
+//
+// Returns the original receipt ID for a repeat, or errIdempotencyConflict if
+// key was used for different content. Otherwise reserves key and hash and
+// returns a commit func that must be called with the newly stored receipt's
+// ID, or "" if storing it failed. Concurrent submissions of the same key or
+// content wait for the reserving one to finish
+func (c *idempotencyCache) begin(ctx context.Context, key string, hash string) (string, func(receiptID string), error) {
+	noop := func(string) {}
+	if c == nil || (key == "" && !c.dedupeContent) {
+		return "", noop, nil
+	}
+
+	for {
+		c.mu.Lock()
+		c.prune()
+
+		var existing *idempotencyEntry
+		if key != "" {
+			existing = c.keys[key]
+			if existing != nil && existing.hash != hash {
+				c.mu.Unlock()
+				return "", nil, errIdempotencyConflict
+			}
+		}
+		if existing == nil && c.dedupeContent {
+			existing = c.contents[hash]
+		}
+
+		if existing == nil {
+			entry := &idempotencyEntry{
+				key:  key,
+				hash: hash,
+				done: make(chan struct{}),
+			}
+			c.reserve(entry)
+			c.mu.Unlock()
+
+			return "", func(receiptID string) {
+				c.commit(entry, receiptID)
+			}, nil
+		}
+
+		if existing.receiptID != "" {
+			c.mu.Unlock()
+			return existing.receiptID, nil, nil
+		}
+
+		// Another submission holds the reservation, wait for it and look again
+		c.mu.Unlock()
+		select {
+		case <-existing.done:
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+// Called with the lock held
+func (c *idempotencyCache) reserve(entry *idempotencyEntry) {
+	if entry.key != "" {
+		c.keys[entry.key] = entry
+	}
+	if c.dedupeContent {
+		c.contents[entry.hash] = entry
+	}
+}
+
+// Called with the lock held
+func (c *idempotencyCache) release(entry *idempotencyEntry) {
+	if entry.key != "" && c.keys[entry.key] == entry {
+		delete(c.keys, entry.key)
+	}
+	if c.contents[entry.hash] == entry {
+		delete(c.contents, entry.hash)
+	}
+	if c.receipts[entry.receiptID] == entry {
+		delete(c.receipts, entry.receiptID)
+	}
+}
+
+func (c *idempotencyCache) commit(entry *idempotencyEntry, receiptID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if receiptID == "" {
+		c.release(entry)
+	} else {
+		entry.receiptID = receiptID
+		entry.expiresAt = c.now().Add(c.window)
+		c.receipts[receiptID] = entry
+		c.order = append(c.order, entry)
+	}
+	close(entry.done)
+}
+
+// Stops content matching hash from mapping to receiptID, for a receipt
+// amended since. Its Idempotency-Key, if any, still maps to it
+func (c *idempotencyCache) forget(hash string, receiptID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry := c.contents[hash]; entry != nil && entry.receiptID == receiptID {
+		delete(c.contents, hash)
+	}
+}
+
+// Drops every mapping to receiptID, for a receipt that was deleted or
+// evicted, so resubmissions are stored again rather than answered with an
+// ID that no longer resolves. Does nothing on a nil idempotencyCache
+func (c *idempotencyCache) forgetReceipt(receiptID string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry := c.receipts[receiptID]; entry != nil {
+		c.release(entry)
+	}
+}
+
+// Whether key was the Idempotency-Key that stored receiptID
+func (c *idempotencyCache) storedWithKey(key string, receiptID string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.keys[key]
+	return entry != nil && entry.receiptID == receiptID
+}
+
+// Drops entries whose window has passed, called with the lock held
+func (c *idempotencyCache) prune() {
+	now := c.now()
+	for len(c.order) > 0 && !now.Before(c.order[0].expiresAt) {
+		c.release(c.order[0])
+		c.order[0] = nil
+		c.order = c.order[1:]
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Posts receipt to the process handler, returning the recorder
+func postTestReceipt(t *testing.T, apiCfg *apiConfig, receipt Receipt, idempotencyKey string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b bytes.Buffer
+	err := json.NewEncoder(&b).Encode(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/receipts/process", &b)
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	w := httptest.NewRecorder()
+	apiCfg.handlerProcessReceipts(w, req)
+	return w
+}
+
+func processedID(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+	}
+
+	var responseBody map[string]string
+	err := json.NewDecoder(w.Body).Decode(&responseBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return responseBody["id"]
+}
+
+func countReceipts(t *testing.T, store ReceiptStore) int {
+	t.Helper()
+
+	receipts, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(receipts)
+}
+
+// Expecting a retried submission with the same Idempotency-Key to return the original ID
+func TestHandlerProcessReceipts_IdempotencyKeyReplay(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:          newMemoryStore(),
+		Idempotency: newIdempotencyCache(time.Hour, false),
+	}
+	testReceipt := newTestReceipt("")
+
+	first := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "key-1"))
+
+	w := postTestReceipt(t, &apiCfg, testReceipt, "key-1")
+	if w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("handler did not mark replayed response")
+	}
+	if second := processedID(t, w); second != first {
+		t.Errorf("handler returned new ID for retried submission\nexpected: %v\nactual: %v", first, second)
+	}
+
+	// Expecting a different key to store the receipt again
+	if third := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "key-2")); third == first {
+		t.Errorf("handler reused ID across idempotency keys: %v", third)
+	}
+
+	if count := countReceipts(t, apiCfg.DB); count != 2 {
+		t.Errorf("store holds wrong number of receipts\nexpected: %v\nactual: %v", 2, count)
+	}
+}
+
+// Expecting 409 Conflict when an Idempotency-Key is reused with a different receipt
+func TestHandlerProcessReceipts_IdempotencyKeyConflict(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:          newMemoryStore(),
+		Idempotency: newIdempotencyCache(time.Hour, false),
+	}
+	testReceipt := newTestReceipt("")
+	processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "key-1"))
+
+	testReceipt.Total = "20.00"
+	w := postTestReceipt(t, &apiCfg, testReceipt, "key-1")
+	if w.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusConflict, w.Code)
+	}
+
+	var responseBody map[string]string
+	err := json.NewDecoder(w.Body).Decode(&responseBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseBody["description"] == "" {
+		t.Errorf("handler did not explain the conflict")
+	}
+}
+
+// Expecting identical content to map to the existing ID only when content deduplication is enabled
+func TestHandlerProcessReceipts_ContentDedupe(t *testing.T) {
+	for _, dedupeContent := range []bool{true, false} {
+		apiCfg := apiConfig{
+			DB:          newMemoryStore(),
+			Idempotency: newIdempotencyCache(time.Hour, dedupeContent),
+		}
+		testReceipt := newTestReceipt("")
+
+		first := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, ""))
+		second := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, ""))
+
+		if (first == second) != dedupeContent {
+			t.Errorf("dedupeContent %v: handler returned IDs %v and %v", dedupeContent, first, second)
+		}
+	}
+}
+
+// Expecting an Idempotency-Key to be forgotten once its window has passed
+func TestIdempotencyCache_Window(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+	cache := newIdempotencyCache(time.Hour, false)
+	cache.now = func() time.Time { return now }
+
+	_, commit, err := cache.begin(ctx, "key-1", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit("00000000-0000-0000-0000-000000000000")
+
+	now = now.Add(59 * time.Minute)
+	existingID, _, err := cache.begin(ctx, "key-1", "hash")
+	if err != nil || existingID != "00000000-0000-0000-0000-000000000000" {
+		t.Errorf("cache forgot key within window: %q, %v", existingID, err)
+	}
+
+	now = now.Add(time.Minute)
+	existingID, _, err = cache.begin(ctx, "key-1", "other hash")
+	if err != nil || existingID != "" {
+		t.Errorf("cache remembered key after window: %q, %v", existingID, err)
+	}
+}
+
+// Expecting concurrent submissions with the same Idempotency-Key to store one receipt
+func TestHandlerProcessReceipts_IdempotencyKeyConcurrent(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:          newMemoryStore(),
+		Idempotency: newIdempotencyCache(time.Hour, false),
+	}
+	testReceipt := newTestReceipt("")
+
+	ids := make([]string, 10)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := postTestReceipt(t, &apiCfg, testReceipt, "key-1")
+			var responseBody map[string]string
+			json.NewDecoder(w.Body).Decode(&responseBody)
+			ids[i] = responseBody["id"]
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if id == "" || id != ids[0] {
+			t.Errorf("concurrent submissions returned different IDs: %v", ids)
+			break
+		}
+	}
+	if count := countReceipts(t, apiCfg.DB); count != 1 {
+		t.Errorf("store holds wrong number of receipts\nexpected: %v\nactual: %v", 1, count)
+	}
+}
+
+// Expecting a repeat of a receipt deleted or amended since it was stored to be stored again
+func TestHandlerProcessReceipts_ContentDedupeStale(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB:          newMemoryStore(),
+		Idempotency: newIdempotencyCache(time.Hour, true),
+	}
+	testReceipt := newTestReceipt("")
+
+	deleted := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "key-1"))
+	err := apiCfg.DB.Delete(ctx, deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "key-1"} {
+		if id := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, key)); id == deleted {
+			t.Errorf("key %q: handler returned the deleted receipt's ID %v", key, id)
+		}
+	}
+
+	// Expecting the same of a receipt amended since, unless its Idempotency-Key is retried
+	apiCfg.DB = newMemoryStore()
+	amended := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "key-2"))
+	changed := newTestReceipt(amended)
+	changed.Total = "20.00"
+	_, err = apiCfg.DB.Amend(ctx, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "key-2")); id != amended {
+		t.Errorf("handler returned new ID %v for retried key, expected %v", id, amended)
+	}
+	if id := processedID(t, postTestReceipt(t, &apiCfg, testReceipt, "")); id == amended {
+		t.Errorf("handler returned the amended receipt's ID %v", id)
+	}
+}
+
+// Expecting receipts evicted from a bounded store to be forgotten
+func TestHandlerProcessReceipts_ContentDedupeEvicted(t *testing.T) {
+	store := newBoundedStore(newMemoryStore(), storeLimits{MaxReceipts: 1})
+	apiCfg := apiConfig{
+		DB:          store,
+		Idempotency: newIdempotencyCache(time.Hour, true),
+	}
+	store.onDropped(apiCfg.Idempotency.forgetReceipt)
+
+	evicted := processedID(t, postTestReceipt(t, &apiCfg, newTestReceipt(""), ""))
+	other := newTestReceipt("")
+	other.Retailer = "Walgreens"
+	processedID(t, postTestReceipt(t, &apiCfg, other, ""))
+
+	if _, ok := apiCfg.Idempotency.receipts[evicted]; ok {
+		t.Errorf("cache remembered evicted receipt %v", evicted)
+	}
+	if id := processedID(t, postTestReceipt(t, &apiCfg, newTestReceipt(""), "")); id == evicted {
+		t.Errorf("handler returned the evicted receipt's ID %v", id)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Defaults for -async-workers and -async-queue
+const (
+	defaultJobWorkers    = 4
+	defaultJobQueueDepth = 1000
+)
+
+// Seconds a client turned away by a full queue is asked to wait
+const jobRetryAfter = 5
+
+// Largest receipt accepted for asynchronous processing, since queued
+// receipts are held in memory until a worker takes them
+const maxJobBodyBytes = 1 << 20
+
+// How long finished jobs can be looked up, and how many are kept at most
+const (
+	jobRetention = 24 * time.Hour
+	jobsKept     = 100_000
+)
+
+// States of a receipt job
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// Returned by jobQueue.submit when no more jobs can be queued
+var errJobQueueFull = errors.New("job queue is full")
+
+// Returned by jobQueue.submit once the workers have stopped
+var errJobQueueClosed = errors.New("job queue is closed")
+
+// Outcome of processing a queued receipt
+type jobResult struct {
+	ReceiptID string `json:"receiptId,omitempty"`
+
+	// Set when the receipt was a retried submission, and ReceiptID is the original's
+	Replayed bool `json:"replayed,omitempty"`
+
+	// Why the receipt was not stored, and for invalid receipts what is wrong with it
+	Error            string   `json:"error,omitempty"`
+	ValidationErrors []string `json:"validationErrors,omitempty"`
+}
+
+// A receipt submitted for asynchronous processing
+type receiptJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	jobResult
+
+	// The receipt as JSON, dropped once processed
+	body           []byte
+	idempotencyKey string
+}
+
+// Bounded queue of receipt jobs, processed by a fixed pool of workers.
+// Jobs are kept in memory, finished ones for jobRetention
+type jobQueue struct {
+	queue chan *receiptJob
+	now   func() time.Time
+
+	mu       sync.Mutex
+	jobs     map[string]*receiptJob
+	finished []*receiptJob
+	closed   bool
+}
+
+func newJobQueue(depth int) *jobQueue {
+	return &jobQueue{
+		queue: make(chan *receiptJob, depth),
+		now:   time.Now,
+		jobs:  map[string]*receiptJob{},
+	}
+}
+
+// Processes queued jobs with the given number of workers until ctx is done.
+// Jobs already running are finished, ctx is not passed on so their receipts
+// are not cancelled mid-write, and jobs still queued are failed
+func (q *jobQueue) run(ctx context.Context, workers int, process func(ctx context.Context, body []byte, idempotencyKey string) jobResult) {
+	processCtx := context.WithoutCancel(ctx)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				select {
+				case <-ctx.Done():
+				case job := <-q.queue:
+					q.start(job)
+					q.finish(job, process(processCtx, job.body, job.idempotencyKey))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	q.close()
+}
+
+// Fails every job still queued and refuses new ones
+func (q *jobQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	for {
+		select {
+		case job := <-q.queue:
+			q.finish(job, jobResult{
+				Error: "Not processed, the server shut down.",
+			})
+		default:
+			return
+		}
+	}
+}
+
+// Queues a receipt, returning errJobQueueFull rather than waiting for room
+func (q *jobQueue) submit(body []byte, idempotencyKey string) (receiptJob, error) {
+	job := &receiptJob{
+		ID:             uuid.New().String(),
+		Status:         jobQueued,
+		CreatedAt:      q.now(),
+		body:           body,
+		idempotencyKey: idempotencyKey,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return receiptJob{}, errJobQueueClosed
+	}
+	select {
+	case q.queue <- job:
+	default:
+		return receiptJob{}, errJobQueueFull
+	}
+	q.jobs[job.ID] = job
+	return *job, nil
+}
+
+func (q *jobQueue) start(job *receiptJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	startedAt := q.now()
+	job.Status = jobRunning
+	job.StartedAt = &startedAt
+}
+
+// Records a job's outcome, and forgets jobs that finished too long ago
+func (q *jobQueue) finish(job *receiptJob, result jobResult) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	finishedAt := q.now()
+	job.Status = jobSucceeded
+	if result.Error != "" {
+		job.Status = jobFailed
+	}
+	job.FinishedAt = &finishedAt
+	job.jobResult = result
+	job.body = nil
+
+	q.finished = append(q.finished, job)
+	expired := 0
+	for _, old := range q.finished {
+		if len(q.finished)-expired <= jobsKept && finishedAt.Sub(*old.FinishedAt) < jobRetention {
+			break
+		}
+		delete(q.jobs, old.ID)
+		expired++
+	}
+	q.finished = q.finished[expired:]
+}
+
+func (q *jobQueue) get(id string) (receiptJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return receiptJob{}, false
+	}
+	return *job, true
+}
+
+// Whether a submission asks to be processed asynchronously, with "?async=true"
+// or a "Prefer: respond-async" header
+func wantsAsync(r *http.Request) (bool, error) {
+	if asyncParam := r.URL.Query().Get("async"); asyncParam != "" {
+		return strconv.ParseBool(asyncParam)
+	}
+	return prefers(r, "respond-async"), nil
+}
+
+// Whether the Prefer headers (RFC 7240) of r include the preference named
+// token, whatever its value and parameters
+func prefers(r *http.Request, token string) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			preference, _, _ = strings.Cut(preference, ";")
+			name, _, _ := strings.Cut(preference, "=")
+			if strings.EqualFold(strings.TrimSpace(name), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Queues a receipt for processing, answering 202 Accepted with the job to
+// poll, or 503 with Retry-After when the queue is full
+func (cfg *apiConfig) submitReceiptJob(w http.ResponseWriter, r *http.Request, body io.Reader, idempotencyKey string) {
+	if cfg.Jobs == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Asynchronous processing is not enabled.", nil)
+		return
+	}
+
+	dat, err := io.ReadAll(io.LimitReader(body, maxJobBodyBytes+1))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The receipt is invalid.", err)
+		return
+	}
+	if len(dat) > maxJobBodyBytes {
+		respondWithError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("A receipt may be at most %v bytes.", maxJobBodyBytes), nil)
+		return
+	}
+
+	job, err := cfg.Jobs.submit(dat, idempotencyKey)
+	if errors.Is(err, errJobQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(jobRetryAfter))
+		respondWithError(w, r, http.StatusServiceUnavailable, "Too many receipts are waiting to be processed, try again later.", err)
+		return
+	}
+	if errors.Is(err, errJobQueueClosed) {
+		respondWithError(w, r, http.StatusServiceUnavailable, "The server is shutting down.", err)
+		return
+	}
+
+	w.Header().Set("Location", apiPrefix(r)+"/jobs/"+job.ID)
+	respond(w, r, http.StatusAccepted, job)
+}
+
+// Validates and stores a queued receipt, as handlerProcessReceipts does
+// for receipts processed synchronously
+func (cfg *apiConfig) processReceiptJob(ctx context.Context, body []byte, idempotencyKey string) jobResult {
+	receipt, err := decodeReceipt(bytes.NewReader(body))
+	if err != nil {
+		return jobResult{
+			Error:            "The receipt is invalid.",
+			ValidationErrors: validationProblems(err),
+		}
+	}
+
+	id, points, replayed, err := cfg.storeReceipt(ctx, receipt, idempotencyKey)
+	if err != nil {
+		log.Printf("Error processing queued receipt: %s", err)
+		_, msg := storeReceiptError(err)
+		return jobResult{
+			Error: msg,
+		}
+	}
+	if !replayed {
+		cfg.announceProcessed(id, receipt, points)
+	}
+
+	return jobResult{
+		ReceiptID: id,
+		Replayed:  replayed,
+	}
+}
+
+// Reports a receipt job's status and, once finished, the receipt ID or why it was not stored
+func (cfg *apiConfig) handlerGetJob(w http.ResponseWriter, r *http.Request) {
+	if cfg.Jobs == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Asynchronous processing is not enabled.", nil)
+		return
+	}
+
+	job, ok := cfg.Jobs.get(r.PathValue("id"))
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "No job found for that ID.", nil)
+		return
+	}
+	respond(w, r, http.StatusOK, job)
+}
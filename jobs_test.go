@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves receipt processing and job status, with queued receipts processed by workers
+func newJobTestServer(t *testing.T, depth int, workers int) (*apiConfig, http.Handler) {
+	apiCfg := &apiConfig{
+		DB:   newMemoryStore(),
+		Jobs: newJobQueue(depth),
+	}
+	if workers > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go apiCfg.Jobs.run(ctx, workers, apiCfg.processReceiptJob)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	mux.HandleFunc("GET /jobs/{id}", apiCfg.handlerGetJob)
+	return apiCfg, mux
+}
+
+// Polls a job until it is finished
+func waitForJob(t *testing.T, handler http.Handler, id string) receiptJob {
+	t.Helper()
+	var job receiptJob
+	waitFor(t, "job", func() bool {
+		serveJSON(t, handler, http.MethodGet, "/jobs/"+id, nil, &job)
+		return job.Status == jobSucceeded || job.Status == jobFailed
+	})
+	return job
+}
+
+// Expecting an asynchronous submission to be accepted at once, and its job to report the stored receipt
+func TestHandlerProcessReceipts_Async(t *testing.T) {
+	_, handler := newJobTestServer(t, 10, 2)
+
+	var job receiptJob
+	code := serveJSON(t, handler, http.MethodPost, "/receipts/process?async=true", newTestReceipt(""), &job)
+	if code != http.StatusAccepted || job.ID == "" || job.Status != jobQueued {
+		t.Fatalf("handler returned %v %+v", code, job)
+	}
+
+	job = waitForJob(t, handler, job.ID)
+	if job.Status != jobSucceeded || job.ReceiptID == "" || job.StartedAt == nil || job.FinishedAt == nil {
+		t.Fatalf("job finished as %+v", job)
+	}
+
+	var points struct {
+		Points int64 `json:"points"`
+	}
+	serveJSON(t, handler, http.MethodGet, "/receipts/"+job.ReceiptID+"/points", nil, &points)
+	if points.Points != 89 {
+		t.Errorf("stored receipt has %v points, expected 89", points.Points)
+	}
+
+	// Expecting "Prefer: respond-async" to ask for the same, with the job's location
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(`{}`))
+	r.Header.Set("Prefer", "respond-async")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusAccepted || !strings.HasPrefix(w.Header().Get("Location"), "/jobs/") {
+		t.Errorf("handler returned %v with Location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// Expecting a job for an invalid receipt to fail, listing what is wrong with it
+func TestHandlerProcessReceipts_AsyncInvalid(t *testing.T) {
+	_, handler := newJobTestServer(t, 10, 1)
+
+	receipt := newTestReceipt("")
+	receipt.Retailer = "Target!"
+	receipt.Total = "1"
+	var job receiptJob
+	serveJSON(t, handler, http.MethodPost, "/receipts/process?async=1", receipt, &job)
+
+	job = waitForJob(t, handler, job.ID)
+	if job.Status != jobFailed || job.ReceiptID != "" || len(job.ValidationErrors) != 2 {
+		t.Fatalf("job finished as %+v", job)
+	}
+	if !strings.HasPrefix(job.ValidationErrors[0], "retailer") || !strings.HasPrefix(job.ValidationErrors[1], "total") {
+		t.Errorf("job reported the wrong problems: %v", job.ValidationErrors)
+	}
+}
+
+// Expecting submissions beyond the queue's depth to be refused with Retry-After
+func TestHandlerProcessReceipts_AsyncQueueFull(t *testing.T) {
+	_, handler := newJobTestServer(t, 1, 0)
+
+	if code := serveJSON(t, handler, http.MethodPost, "/receipts/process?async=true", newTestReceipt(""), nil); code != http.StatusAccepted {
+		t.Fatalf("handler returned %v, expected %v", code, http.StatusAccepted)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receipts/process?async=true", strings.NewReader(`{}`)))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("handler returned %v with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+// Expecting respond-async to be found among other preferences and parameters
+func TestWantsAsync(t *testing.T) {
+	tests := []struct {
+		prefer   []string
+		expected bool
+	}{
+		{prefer: nil, expected: false},
+		{prefer: []string{"respond-async"}, expected: true},
+		{prefer: []string{"respond-async, wait=10"}, expected: true},
+		{prefer: []string{"handling=lenient, respond-async"}, expected: true},
+		{prefer: []string{"return=minimal", "Respond-Async; foo=bar"}, expected: true},
+		{prefer: []string{"handling=lenient", "wait=10"}, expected: false},
+		{prefer: []string{"respond-asynchronously"}, expected: false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/receipts/process", nil)
+		for _, prefer := range tc.prefer {
+			r.Header.Add("Prefer", prefer)
+		}
+		if actual, err := wantsAsync(r); err != nil || actual != tc.expected {
+			t.Errorf("Prefer %q\nexpected: %v\nactual: %v %v", tc.prefer, tc.expected, actual, err)
+		}
+	}
+}
+
+// Expecting unknown jobs and an invalid async parameter to be refused
+func TestHandlerGetJob_Invalid(t *testing.T) {
+	_, handler := newJobTestServer(t, 1, 0)
+
+	if code := serveJSON(t, handler, http.MethodGet, "/jobs/00000000-0000-0000-0000-000000000000", nil, nil); code != http.StatusNotFound {
+		t.Errorf("handler returned %v, expected %v", code, http.StatusNotFound)
+	}
+	if code := serveJSON(t, handler, http.MethodPost, "/receipts/process?async=maybe", newTestReceipt(""), nil); code != http.StatusBadRequest {
+		t.Errorf("handler returned %v, expected %v", code, http.StatusBadRequest)
+	}
+}
+
+// Expecting a running job to finish uncancelled on shutdown, and queued ones to fail
+func TestJobQueue_Shutdown(t *testing.T) {
+	queue := newJobQueue(10)
+	ids := make([]string, 3)
+	for i := range ids {
+		job, err := queue.submit([]byte(`{}`), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = job.ID
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		queue.run(ctx, 1, func(ctx context.Context, body []byte, idempotencyKey string) jobResult {
+			close(started)
+			<-release
+			if ctx.Err() != nil {
+				return jobResult{Error: ctx.Err().Error()}
+			}
+			return jobResult{ReceiptID: "00000000-0000-0000-0000-000000000000"}
+		})
+	}()
+
+	<-started
+	cancel()
+	close(release)
+	<-done
+
+	if job, _ := queue.get(ids[0]); job.Status != jobSucceeded {
+		t.Errorf("running job finished as %+v", job)
+	}
+	for _, id := range ids[1:] {
+		if job, _ := queue.get(id); job.Status != jobFailed || job.FinishedAt == nil {
+			t.Errorf("queued job finished as %+v", job)
+		}
+	}
+	if _, err := queue.submit([]byte(`{}`), ""); !errors.Is(err, errJobQueueClosed) {
+		t.Errorf("queue accepted a job after shutting down: %v", err)
+	}
+}
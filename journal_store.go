@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal records are framed as
+//
+//	[4 byte payload length][4 byte CRC-32C of payload][JSON journalEntry payload]
+//
+// with both integers big endian. With a keyring the payload is the
+// journalEntry sealed under the primary key, see keyring.seal
+const journalHeaderSize = 8
+
+// Upper bound on a single record, guards replay against garbage lengths
+const journalMaxRecordSize = 16 << 20
+
+var journalCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A single mutation of the receipt map. Puts carry the whole ReceiptRecord
+// after the mutation; journals written before revisions existed carry a
+// bare Receipt instead. readJournalRecord upgrades either to a current Record
+type journalEntry struct {
+	Op      string         `json:"op"`
+	ID      string         `json:"id"`
+	Record  *ReceiptRecord `json:"record,omitempty"`
+	Receipt *Receipt       `json:"receipt,omitempty"`
+
+	// ID of the key the record was sealed under, empty if plaintext. Set by
+	// readJournalRecord, the payload's envelope carries it on disk
+	keyID string
+}
+
+const (
+	journalOpPut    = "put"
+	journalOpDelete = "delete"
+)
+
+// ReceiptStore that journals every mutation to an append-only log before
+// applying it in memory, and replays the log at startup.
+//
+// Each record is appended and fsynced before the mutation is acknowledged.
+// A torn or corrupt record at the tail (e.g. from a crash mid-append) is
+// logged and truncated on open; everything before it is kept.
+//
+// Once the journal grows past compactAt bytes, and to twice its size after
+// the last compaction, a background goroutine rewrites it as a snapshot
+// holding one put per live receipt. Writes are blocked for the duration of
+// the rewrite. Replace uses the same rewrite, so it is atomic.
+//
+// With a keyring every record is sealed under its primary key. If replay
+// finds records sealed under older keys, or written before encryption was
+// enabled, a compaction is started right away to rewrite them.
+type journalStore struct {
+	*memoryStore
+	path      string
+	compactAt int64
+	keys      *keyring
+
+	// Replayed records sealed under a key other than the primary one
+	staleRecords int
+
+	file *os.File
+	size int64
+
+	// Size of the journal right after it was last rewritten
+	compactedSize int64
+
+	compactCh chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Opens (creating if needed) the journal at path and replays it into memory.
+// A compactAt of zero or less disables background compaction and a nil
+// keyring journals receipts unencrypted
+func openJournalStore(path string, compactAt int64, keys *keyring) (*journalStore, error) {
+	store := &journalStore{
+		memoryStore: newMemoryStore(),
+		path:        path,
+		compactAt:   compactAt,
+		keys:        keys,
+		compactCh:   make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+
+	size, err := store.replay(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("replaying journal: %w", err)
+	}
+
+	_, err = file.Seek(size, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store.reindex()
+	store.file = file
+	store.size = size
+	store.persist = store.appendEntry
+	store.persistAll = store.rewrite
+
+	if store.staleRecords > 0 {
+		log.Printf("Re-encrypting %v journal records under key %q", store.staleRecords, keys.primary)
+		store.compactCh <- struct{}{}
+	}
+
+	store.wg.Add(1)
+	go store.compactor()
+
+	return store, nil
+}
+
+// Applies every intact record in file to memory and returns the offset just
+// past the last one, truncating anything after it
+func (s *journalStore) replay(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+
+	for {
+		entry, n, err := readJournalRecord(reader, s.keys)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, errUndecryptable) || errors.Is(err, errUnreadableRecord) {
+			return 0, err
+		}
+		if err != nil {
+			log.Printf("Truncating journal %v at offset %v of %v: %s", s.path, offset, info.Size(), err)
+			err = file.Truncate(offset)
+			if err != nil {
+				return 0, err
+			}
+			err = file.Sync()
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		if s.keys.stale(entry.keyID) {
+			s.staleRecords++
+		}
+
+		switch entry.Op {
+		case journalOpPut:
+			if entry.Record != nil {
+				s.records[entry.ID] = *entry.Record
+			}
+		case journalOpDelete:
+			delete(s.records, entry.ID)
+		}
+		offset += n
+	}
+
+	return offset, nil
+}
+
+// Reads one record, returning io.EOF only at a clean record boundary
+func readJournalRecord(r io.Reader, keys *keyring) (journalEntry, int64, error) {
+	var entry journalEntry
+
+	header := make([]byte, journalHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return entry, 0, io.EOF
+	}
+	if err != nil {
+		return entry, 0, fmt.Errorf("torn record header (%v bytes)", n)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > journalMaxRecordSize {
+		return entry, 0, fmt.Errorf("record length %v exceeds limit", length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return entry, 0, errors.New("torn record payload")
+	}
+
+	if crc32.Checksum(payload, journalCRCTable) != checksum {
+		return entry, 0, errors.New("record checksum mismatch")
+	}
+
+	payload, keyID, err := keys.open(payload)
+	if err != nil {
+		return entry, 0, err
+	}
+
+	// Records are decoded separately so older schema versions can be upgraded
+	var raw struct {
+		Op      string          `json:"op"`
+		ID      string          `json:"id"`
+		Record  json.RawMessage `json:"record"`
+		Receipt json.RawMessage `json:"receipt"`
+	}
+	err = json.Unmarshal(payload, &raw)
+	if err != nil {
+		return entry, 0, fmt.Errorf("decoding record: %w", err)
+	}
+	entry.Op = raw.Op
+	entry.ID = raw.ID
+	entry.keyID = keyID
+
+	persisted := raw.Record
+	if len(persisted) == 0 {
+		persisted = raw.Receipt
+	}
+	if entry.Op == journalOpPut && len(persisted) > 0 {
+		record, err := decodeReceiptRecord(persisted)
+		if err != nil {
+			return entry, 0, err
+		}
+		entry.Record = &record
+	}
+
+	return entry, int64(journalHeaderSize) + int64(length), nil
+}
+
+// Frames entry as a journal record, sealed under the primary key if keys is not nil
+func encodeJournalRecord(entry journalEntry, keys *keyring) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	payload, err = keys.seal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, journalHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, journalCRCTable))
+	copy(record[journalHeaderSize:], payload)
+
+	return record, nil
+}
+
+// Durably appends the mutation to the journal, called with the write lock held
+func (s *journalStore) appendEntry(id string, record *ReceiptRecord) error {
+	entry := journalEntry{
+		Op:     journalOpPut,
+		ID:     id,
+		Record: record,
+	}
+	if record == nil {
+		entry.Op = journalOpDelete
+	}
+
+	frame, err := encodeJournalRecord(entry, s.keys)
+	if err != nil {
+		return err
+	}
+
+	n, err := s.file.Write(frame)
+	if err != nil {
+		// Drop whatever part of the record made it out so the next append
+		// does not land after a torn record
+		s.rollbackAppend()
+		return fmt.Errorf("appending to journal: %w", err)
+	}
+
+	err = s.file.Sync()
+	if err != nil {
+		// The caller is told the mutation failed, so it must not be replayed
+		// on the next start either
+		s.rollbackAppend()
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	s.size += int64(n)
+
+	if s.needsCompaction() {
+		select {
+		case s.compactCh <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Whether the journal has grown enough to be rewritten, called with the
+// write lock held. Live receipts alone may be larger than compactAt, so it
+// must also have doubled since the last rewrite or every append would
+// rewrite it again
+func (s *journalStore) needsCompaction() bool {
+	return s.compactAt > 0 && s.size > max(s.compactAt, 2*s.compactedSize)
+}
+
+// Cuts the journal back to the end of the last durable record, called with the write lock held
+func (s *journalStore) rollbackAppend() {
+	s.file.Truncate(s.size)
+	s.file.Seek(s.size, io.SeekStart)
+}
+
+func (s *journalStore) compactor() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.compactCh:
+			err := s.compact()
+			if err != nil {
+				log.Printf("Error compacting journal: %s", err)
+			}
+		}
+	}
+}
+
+// Rewrites the journal as one put record per live receipt
+func (s *journalStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rewrite(s.records)
+}
+
+// Atomically replaces the journal with one put record per receipt,
+// called with the write lock held
+func (s *journalStore) rewrite(records map[string]ReceiptRecord) error {
+	dir := filepath.Dir(s.path)
+	tmp, err := os.CreateTemp(dir, ".journal-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	var size int64
+	for id, record := range records {
+		frame, err := encodeJournalRecord(journalEntry{
+			Op:     journalOpPut,
+			ID:     id,
+			Record: &record,
+		}, s.keys)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		n, err := writer.Write(frame)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		size += int64(n)
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// The renamed temp file is now the journal, keep appending to it
+	s.file.Close()
+	s.file = tmp
+	s.size = size
+	s.compactedSize = size
+	s.staleRecords = 0
+
+	return syncDir(dir)
+}
+
+// Stops background compaction and closes the journal
+func (s *journalStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		err = s.file.Close()
+	})
+	return err
+}
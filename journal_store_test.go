@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	receiptStoreFactories["journal"] = func(t *testing.T) ReceiptStore {
+		return openTestJournalStore(t, filepath.Join(t.TempDir(), "receipts.journal"), 0)
+	}
+}
+
+func openTestJournalStore(t *testing.T, path string, compactAt int64) *journalStore {
+	store, err := openJournalStore(path, compactAt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+// Expecting mutations to be replayed when the journal is reopened
+func TestJournalStore_Replay(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "receipts.journal")
+
+	store := openTestJournalStore(t, path, 0)
+	kept := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	deleted := newTestReceipt("10000000-2000-3000-4000-500000000000")
+	removed := newTestReceipt("20000000-0000-0000-0000-000000000000")
+	for _, receipt := range []Receipt{kept, deleted, removed} {
+		err := store.Put(ctx, receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.Delete(ctx, deleted.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Remove(ctx, removed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	reopened := openTestJournalStore(t, path, 0)
+	receipts, err := reopened.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].ID != kept.ID {
+		t.Errorf("replayed store returned wrong receipts\nexpected: [%v]\nactual: %+v", kept.ID, receipts)
+	}
+
+	// Expecting the secondary indexes to be rebuilt
+	found, err := reopened.Find(ctx, ReceiptQuery{Retailer: kept.Retailer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].ID != kept.ID {
+		t.Errorf("replayed store found wrong receipts\nexpected: [%v]\nactual: %+v", kept.ID, found)
+	}
+
+	// Expecting the tombstone to survive, and the removal to stick
+	_, err = reopened.Get(ctx, deleted.ID)
+	if !errors.Is(err, ErrReceiptDeleted) {
+		t.Errorf("replayed store lost tombstone, error: %v", err)
+	}
+	_, err = reopened.Get(ctx, removed.ID)
+	if !errors.Is(err, ErrReceiptNotFound) {
+		t.Errorf("replayed store returned removed receipt, error: %v", err)
+	}
+}
+
+// Expecting torn and corrupt tail records to be truncated without losing earlier records
+func TestJournalStore_CorruptTail(t *testing.T) {
+	ctx := context.Background()
+
+	tails := map[string]func(frame []byte) []byte{
+		"TornHeader": func(frame []byte) []byte {
+			return frame[:journalHeaderSize-3]
+		},
+		"TornPayload": func(frame []byte) []byte {
+			return frame[:len(frame)-5]
+		},
+		"BadChecksum": func(frame []byte) []byte {
+			frame[len(frame)-1] ^= 0xff
+			return frame
+		},
+	}
+
+	for name, corrupt := range tails {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "receipts.journal")
+
+			store := openTestJournalStore(t, path, 0)
+			testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+			err := store.Put(ctx, testReceipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goodSize := info.Size()
+
+			record := newTestRecord("10000000-2000-3000-4000-500000000000")
+			frame, err := encodeJournalRecord(journalEntry{
+				Op:     journalOpPut,
+				ID:     record.ID,
+				Record: &record,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(corrupt(frame))
+			f.Close()
+
+			reopened := openTestJournalStore(t, path, 0)
+			receipts, err := reopened.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(receipts) != 1 || receipts[0].ID != testReceipt.ID {
+				t.Errorf("replayed store returned wrong receipts\nexpected: [%v]\nactual: %+v", testReceipt.ID, receipts)
+			}
+
+			info, err = os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != goodSize {
+				t.Errorf("journal was not truncated\nexpected size: %v\nactual size: %v", goodSize, info.Size())
+			}
+
+			// Expecting appends after recovery to replay cleanly
+			err = reopened.Put(ctx, newTestReceipt("20000000-0000-0000-0000-000000000000"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reopened.Close()
+
+			replayed := openTestJournalStore(t, path, 0)
+			receipts, err = replayed.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(receipts) != 2 {
+				t.Errorf("replayed store returned wrong number of receipts\nexpected: %v\nactual: %v", 2, len(receipts))
+			}
+		})
+	}
+}
+
+// Expecting compaction to shrink the journal to one record per live receipt
+func TestJournalStore_Compact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "receipts.journal")
+
+	store := openTestJournalStore(t, path, 0)
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	for i := 0; i < 10; i++ {
+		err := store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed := newTestReceipt("10000000-2000-3000-4000-500000000000")
+	err := store.Put(ctx, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Remove(ctx, removed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := store.size
+	err = store.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := store.GetRecord(ctx, testReceipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := encodeJournalRecord(journalEntry{
+		Op:     journalOpPut,
+		ID:     testReceipt.ID,
+		Record: &record,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(frame)) || store.size != info.Size() {
+		t.Errorf("compacted journal has wrong size\nbefore: %v\nexpected: %v\nactual: %v", before, len(frame), info.Size())
+	}
+
+	// Expecting appends after compaction to land in the new journal
+	err = store.Put(ctx, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	reopened := openTestJournalStore(t, path, 0)
+	receipts, err := reopened.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 2 {
+		t.Errorf("replayed store returned wrong number of receipts\nexpected: %v\nactual: %v", 2, len(receipts))
+	}
+}
+
+// Expecting the journal to be compacted in the background once it exceeds compactAt
+func TestJournalStore_BackgroundCompaction(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "receipts.journal")
+
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	record := newTestRecord(testReceipt.ID)
+	frame, err := encodeJournalRecord(journalEntry{
+		Op:     journalOpPut,
+		ID:     testReceipt.ID,
+		Record: &record,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compactAt := int64(len(frame) * 3)
+	store := openTestJournalStore(t, path, compactAt)
+	for i := 0; i < 10; i++ {
+		err := store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() <= compactAt {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("journal was not compacted\nexpected size at most: %v\nactual size: %v", compactAt, info.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Expecting live receipts larger than compactAt to be compacted again only
+// once the journal has doubled since, not after every append
+func TestJournalStore_CompactLargeLiveData(t *testing.T) {
+	ctx := context.Background()
+	store := openTestJournalStore(t, filepath.Join(t.TempDir(), "receipts.journal"), 0)
+
+	for i := range 10 {
+		err := store.Put(ctx, newTestReceipt(fmt.Sprintf("00000000-0000-0000-0000-00000000000%v", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only appends, made here, read compactAt
+	store.compactAt = store.size / 10
+	live := store.size
+
+	err = store.Put(ctx, newTestReceipt("10000000-2000-3000-4000-500000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.needsCompaction() {
+		t.Errorf("journal of %v bytes is due for compaction again right after compacting %v bytes", store.size, live)
+	}
+	store.size = 2*live + 1
+	if !store.needsCompaction() {
+		t.Errorf("journal of %v bytes is not due for compaction after compacting %v bytes", store.size, live)
+	}
+}
+
+// Expecting puts journaled before revisions existed to replay as revision 1
+func TestJournalStore_LegacyEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.journal")
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+	frame, err := encodeJournalRecord(journalEntry{
+		Op:      journalOpPut,
+		ID:      testReceipt.ID,
+		Receipt: &testReceipt,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, frame, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openTestJournalStore(t, path, 0)
+	record, err := store.GetRecord(context.Background(), testReceipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Revisions) != 1 || record.Latest().Receipt.Total != testReceipt.Total {
+		t.Errorf("store replayed wrong record: %+v", record)
+	}
+}
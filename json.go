@@ -1,31 +1,73 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+// Body of every error response
+type errorResponse struct {
+	Description string `json:"description"`
+}
+
+func respondWithError(w http.ResponseWriter, r *http.Request, code int, msg string, err error) {
 	if err != nil {
 		log.Println(err)
 	}
-	type errorResponse struct {
-		Description string `json:"description"`
-	}
-	respondWithJSON(w, code, errorResponse{
+	respond(w, r, code, errorResponse{
 		Description: msg,
 	})
 }
 
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	dat, err := json.Marshal(payload)
+// Responds with payload in the format the request's Accept header prefers,
+// JSON unless it asks for another. Successful responses no acceptable format
+// can render answer 406; errors fall back to JSON.
+// Validators and caching directives set by notModified only describe a
+// successful response, so they are dropped from anything else
+func respond(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	w.Header().Set("Vary", "Accept")
+	offers := responseFormats(payload)
+	format, ok := negotiateFormat(r, offers)
+	if !ok {
+		format = jsonFormat
+		if code >= 200 && code <= 299 {
+			code = http.StatusNotAcceptable
+			payload = errorResponse{
+				Description: fmt.Sprintf("The response can only be sent as %v.", strings.Join(mediaTypes(offers), ", ")),
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", format.MediaTypes[0])
+	dat, err := format.Encode(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
-		w.WriteHeader(500)
-		return
+		log.Printf("Error encoding %v: %s", format.Name, err)
+		code = 500
+		dat = nil
+	}
+	if code < 200 || code > 299 {
+		for _, key := range []string{"ETag", "Last-Modified", "Cache-Control"} {
+			w.Header().Del(key)
+		}
 	}
 	w.WriteHeader(code)
 	w.Write(dat)
 }
+
+// Responds to a failed ReceiptStore lookup: 404 for unknown IDs, 410 for
+// deleted, evicted or expired receipts, 500 otherwise
+func respondWithStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrReceiptNotFound):
+		respondWithError(w, r, http.StatusNotFound, "No receipt found for that ID.", err)
+	case errors.Is(err, ErrReceiptDeleted):
+		respondWithError(w, r, http.StatusGone, "That receipt has been deleted.", err)
+	case errors.Is(err, ErrReceiptGone):
+		respondWithError(w, r, http.StatusGone, "That receipt has expired or been evicted.", err)
+	default:
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to load receipt.", err)
+	}
+}
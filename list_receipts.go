@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Receipts per page when "?limit=" is not given, and the most a page may hold
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// What an opaque "?cursor=" decodes to. It remembers the sort it was issued
+// for, since its position means nothing in any other order
+type listCursor struct {
+	Sort string `json:"sort"`
+	ReceiptCursor
+}
+
+// Pages through stored receipts that match the filters, in a stable order
+func (cfg *apiConfig) handlerListReceipts(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	query, err := parseReceiptQuery(params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The filters are invalid.", err)
+		return
+	}
+
+	// "submitted" or "points", oldest or fewest first, or reversed with a leading "-"
+	sort := params.Get("sort")
+	if sort == "" {
+		sort = string(OrderSubmitted)
+	}
+	order := ReceiptOrder(strings.TrimPrefix(sort, "-"))
+	if order != OrderSubmitted && order != OrderPoints {
+		respondWithError(w, r, http.StatusBadRequest, "The sort is invalid.", nil)
+		return
+	}
+
+	limit := defaultPageSize
+	if limitParam := params.Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("The limit must be between 1 and %v.", maxPageSize), err)
+			return
+		}
+	}
+
+	request := ReceiptPageRequest{
+		Query:      query,
+		Order:      order,
+		Descending: strings.HasPrefix(sort, "-"),
+		Limit:      limit,
+	}
+	if cursorParam := params.Get("cursor"); cursorParam != "" {
+		cursor, err := decodeListCursor(cursorParam)
+		if err != nil || cursor.Sort != sort {
+			respondWithError(w, r, http.StatusBadRequest, "The cursor is invalid.", err)
+			return
+		}
+		request.After = &cursor.ReceiptCursor
+	}
+
+	page, err := cfg.DB.Page(r.Context(), request)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	body := receiptList{
+		Receipts: make([]receiptResponse, 0, len(page.Records)),
+	}
+	for _, record := range page.Records {
+		body.Receipts = append(body.Receipts, newReceiptResponse(record, record.Latest()))
+	}
+
+	// The next link repeats the filters, sort and limit with the new cursor
+	if page.Next != nil {
+		body.NextCursor = encodeListCursor(listCursor{Sort: sort, ReceiptCursor: *page.Next})
+		params.Set("cursor", body.NextCursor)
+		body.Next = apiPrefix(r) + r.URL.Path + "?" + params.Encode()
+
+		// Also linked from a header, as CSV pages have nowhere else to link it
+		w.Header().Set("Link", fmt.Sprintf(`<%v>; rel="next"`, body.Next))
+	}
+
+	respond(w, r, http.StatusOK, body)
+}
+
+// A page of receipts, which can also be sent as CSV for spreadsheets
+type receiptList struct {
+	Receipts   []receiptResponse `json:"receipts"`
+	NextCursor string            `json:"nextCursor,omitempty"`
+	Next       string            `json:"next,omitempty"`
+}
+
+func (l receiptList) csvHeader() []string {
+	return []string{"id", "retailer", "purchaseDate", "purchaseTime", "total", "items", "points", "revision", "submittedAt", "updatedAt"}
+}
+
+func (l receiptList) csvRows() [][]string {
+	rows := make([][]string, 0, len(l.Receipts))
+	for _, receipt := range l.Receipts {
+		rows = append(rows, []string{
+			receipt.Receipt.ID,
+			receipt.Receipt.Retailer,
+			receipt.Receipt.PurchaseDate,
+			receipt.Receipt.PurchaseTime,
+			receipt.Receipt.Total,
+			strconv.Itoa(len(receipt.Receipt.Items)),
+			strconv.FormatInt(receipt.Points, 10),
+			strconv.Itoa(receipt.Revision),
+			receipt.SubmittedAt.UTC().Format(time.RFC3339),
+			receipt.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return rows
+}
+
+// Reads the filters of a receipt listing
+func parseReceiptQuery(params url.Values) (ReceiptQuery, error) {
+	query := ReceiptQuery{
+		Retailer: params.Get("retailer"),
+	}
+
+	var err error
+	parseDate := func(name string, date *time.Time) {
+		if value := params.Get(name); value != "" && err == nil {
+			*date, err = time.Parse(time.DateOnly, value)
+			if err != nil {
+				err = fmt.Errorf("%v must be a date such as 2022-01-01", name)
+			}
+		}
+	}
+	parseTotal := func(name string, total **int64) {
+		if value := params.Get(name); value != "" && err == nil {
+			cents, ok := totalCents(value)
+			if !ok {
+				err = fmt.Errorf("%v must be an amount such as 35.35", name)
+			}
+			*total = &cents
+		}
+	}
+	parsePoints := func(name string, points **int64) {
+		if value := params.Get(name); value != "" && err == nil {
+			n, parseErr := strconv.ParseInt(value, 10, 64)
+			if parseErr != nil {
+				err = fmt.Errorf("%v must be a whole number", name)
+			}
+			*points = &n
+		}
+	}
+
+	parseDate("purchasedFrom", &query.PurchasedFrom)
+	parseDate("purchasedTo", &query.PurchasedTo)
+	parseTotal("minTotal", &query.MinTotal)
+	parseTotal("maxTotal", &query.MaxTotal)
+	parsePoints("minPoints", &query.MinPoints)
+	parsePoints("maxPoints", &query.MaxPoints)
+	return query, err
+}
+
+func encodeListCursor(cursor listCursor) string {
+	dat, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var cursor listCursor
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(dat, &cursor)
+	if err != nil {
+		return cursor, err
+	}
+	if cursor.ID == "" {
+		return cursor, errors.New("cursor has no ID")
+	}
+	return cursor, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Expecting the listing to be paged through by following next links, with
+// the filters and sort carried along
+func TestHandlerListReceipts(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts", apiCfg.handlerListReceipts)
+
+	submitted := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+	var records []ReceiptRecord
+	for i, retailer := range []string{"Target", "Walgreens", "Target", "A", "Target"} {
+		receipt := newTestReceipt("00000000-0000-0000-0000-00000000000" + string(rune('1'+i)))
+		receipt.Retailer = retailer
+		receipt.PurchaseDate = "2022-01-0" + string(rune('1'+i))
+		records = append(records, newReceiptRecord(receipt, submitted.Add(time.Duration(i)*time.Minute)))
+	}
+	err := apiCfg.DB.Replace(ctx, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type ResponseBody struct {
+		Receipts   []receiptResponse `json:"receipts"`
+		NextCursor string            `json:"nextCursor"`
+		Next       string            `json:"next"`
+	}
+
+	list := func(path string) (int, ResponseBody) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var body ResponseBody
+		if w.Code == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, body
+	}
+
+	// Follows next links from path, returning the IDs listed on each page
+	listAll := func(path string) [][]string {
+		t.Helper()
+		var pages [][]string
+		for path != "" {
+			code, body := list(path)
+			if code != http.StatusOK {
+				t.Fatalf("handler returned %v for %v", code, path)
+			}
+
+			var ids []string
+			for _, receipt := range body.Receipts {
+				ids = append(ids, receipt.Receipt.ID)
+			}
+			pages = append(pages, ids)
+			path = body.Next
+		}
+		return pages
+	}
+
+	id := func(n int) string {
+		return records[n-1].ID
+	}
+	paths := []struct {
+		path     string
+		expected [][]string
+	}{
+		{"/receipts", [][]string{{id(1), id(2), id(3), id(4), id(5)}}},
+		{"/receipts?limit=2", [][]string{{id(1), id(2)}, {id(3), id(4)}, {id(5)}}},
+		{"/receipts?limit=2&sort=-submitted&retailer=target", [][]string{{id(5), id(3)}, {id(1)}}},
+		{"/receipts?limit=3&sort=points&minPoints=80", [][]string{{id(2), id(1), id(3)}, {id(5)}}},
+		{"/receipts?purchasedFrom=2022-01-02&purchasedTo=2022-01-04&limit=1", [][]string{{id(2)}, {id(3)}, {id(4)}}},
+		{"/receipts?minTotal=10.00&maxTotal=10.00&retailer=A", [][]string{{id(4)}}},
+		{"/receipts?minTotal=10.01", [][]string{nil}},
+	}
+	for _, p := range paths {
+		actual := listAll(p.path)
+		if !slices.EqualFunc(actual, p.expected, slices.Equal) {
+			t.Errorf("%v: handler listed wrong receipts\nexpected: %v\nactual: %v", p.path, p.expected, actual)
+		}
+	}
+
+	// Expecting each listed receipt to carry its metadata
+	_, body := list("/receipts?limit=1")
+	if len(body.Receipts) != 1 || body.Receipts[0].Points != 89 || !body.Receipts[0].SubmittedAt.Equal(submitted) {
+		t.Errorf("handler listed receipt without metadata: %+v", body.Receipts)
+	}
+	if body.NextCursor == "" || !strings.Contains(body.Next, "cursor="+body.NextCursor) || !strings.Contains(body.Next, "limit=1") {
+		t.Errorf("handler returned wrong next link: %v", body.Next)
+	}
+
+	// Expecting a cursor to be rejected for another sort
+	if code, _ := list("/receipts?sort=points&cursor=" + body.NextCursor); code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for a cursor from another sort, expected %v", code, http.StatusBadRequest)
+	}
+
+	for _, path := range []string{
+		"/receipts?limit=0",
+		"/receipts?limit=501",
+		"/receipts?sort=total",
+		"/receipts?cursor=not-a-cursor",
+		"/receipts?purchasedFrom=01/01/2022",
+		"/receipts?minTotal=10",
+		"/receipts?minPoints=ten",
+	} {
+		if code, _ := list(path); code != http.StatusBadRequest {
+			t.Errorf("%v: handler returned %v, expected %v", path, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,20 +1,161 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
+// How long in-flight requests get to finish on SIGINT or SIGTERM
+const shutdownTimeout = 10 * time.Second
+
 type apiConfig struct {
-	DB sync.Map
+	DB ReceiptStore
+
+	// Bearer token required by /admin routes, which are disabled when empty
+	AdminToken string
+
+	// Maps retried submissions to their original receipt ID, disabled when nil
+	Idempotency *idempotencyCache
+
+	// How long soft-deleted receipts can be undeleted before they are purged
+	PurgeAfter time.Duration
+
+	// Seals snapshots and exports served by /admin routes, unencrypted when nil
+	Keys *keyring
+
+	// Most receipts one batch submission may hold, defaultBatchMax when 0
+	BatchMax int
+
+	// Set when running as a read replica of another instance, nil on a primary
+	Follower *follower
+
+	// Streams accepted receipts to dashboards, disabled when nil
+	Events *receiptEvents
+
+	// Notifies subscribed endpoints of receipt changes, disabled when nil
+	Webhooks *webhookDispatcher
+
+	// Processes receipts submitted with "?async=true" in the background, disabled when nil
+	Jobs *jobQueue
+
+	// Held by imports between checking a supplied ID is free and storing it
+	importMu sync.Mutex
 }
 
 func main() {
-	var database sync.Map
+	// Offline maintenance commands, e.g. "fetch-server snapshot -data-dir ./data -file out.snapshot"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "snapshot", "restore":
+			err := runSnapshotCommand(os.Args[1], os.Args[2:])
+			if err != nil {
+				log.Fatalf("Error running %v: %s", os.Args[1], err)
+			}
+			return
+		case "migrate":
+			err := runMigrateCommand(os.Args[2:])
+			if err != nil {
+				log.Fatalf("Error running migrate: %s", err)
+			}
+			return
+		}
+	}
+
+	var storeOpts storeOptions
+	storeOpts.register(flag.CommandLine)
+	idempotencyWindow := flag.Duration("idempotency-window", 24*time.Hour, "how long an Idempotency-Key maps to its original receipt")
+	dedupeContent := flag.Bool("dedupe-content", false, "return the existing ID for resubmissions of identical receipts within the idempotency window")
+	purgeAfter := flag.Duration("purge-after", 30*24*time.Hour, "grace period before deleted receipts are permanently purged")
+	batchMax := flag.Int("batch-max", defaultBatchMax, "most receipts one POST /receipts/process:batch may hold")
+	asyncWorkers := flag.Int("async-workers", defaultJobWorkers, "receipts submitted with ?async=true processed at once")
+	asyncQueue := flag.Int("async-queue", defaultJobQueueDepth, "receipts submitted with ?async=true that may wait to be processed before submissions are refused")
+	followURL := flag.String("follow", "", "URL of a primary instance to serve as a read replica of, e.g. http://localhost:8080")
+	port := flag.String("port", "8080", "port to serve on")
+	var legacy apiDeprecation
+	flag.Func("unversioned-deprecated-at", "date, e.g. 2025-01-01, the unversioned routes were deprecated in favor of "+apiVersionPrefix+" (not deprecated when unset)", dateFlag(&legacy.At))
+	flag.Func("unversioned-sunset", "date the unversioned routes stop being served, announced once they are deprecated", dateFlag(&legacy.Sunset))
+	flag.Parse()
+
+	if *asyncWorkers < 1 || *asyncQueue < 1 {
+		log.Fatal("-async-workers and -async-queue must be at least 1")
+	}
+
+	keys, err := storeOpts.keyring()
+	if err != nil {
+		log.Fatalf("Error loading encryption keys: %s", err)
+	}
+
+	// Cancelled by SIGINT or SIGTERM, which shut the server down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var store ReceiptStore
+	var replicator *follower
+	closeStore := func() error { return nil }
+	if *followURL != "" {
+		// Followers hold a copy of the primary's receipts in memory
+		if storeOpts.durable() || storeOpts.limits.enabled() {
+			log.Fatal("-follow cannot be combined with -data-dir, -journal or store limits")
+		}
+
+		replica := newMemoryStore()
+		replicator, err = newFollower(*followURL, os.Getenv("ADMIN_TOKEN"), replica)
+		if err != nil {
+			log.Fatalf("Error following primary: %s", err)
+		}
+		go replicator.run(ctx)
+		store = replica
+	} else {
+		store, closeStore, err = storeOpts.open()
+		if err != nil {
+			log.Fatalf("Error opening receipt store: %s", err)
+		}
+	}
 
 	apiCfg := apiConfig{
-		DB: database,
+		DB:          store,
+		AdminToken:  os.Getenv("ADMIN_TOKEN"),
+		Idempotency: newIdempotencyCache(*idempotencyWindow, *dedupeContent),
+		PurgeAfter:  *purgeAfter,
+		Keys:        keys,
+		BatchMax:    *batchMax,
+		Follower:    replicator,
+		Events:      newReceiptEvents(receiptEventRetention),
+	}
+
+	// Repeat submissions of evicted receipts are stored again
+	if bounded, ok := store.(*boundedStore); ok {
+		bounded.onDropped(apiCfg.Idempotency.forgetReceipt)
+	}
+
+	// Background work, stopped once the server has shut down and waited for
+	// where it writes to the store, since that is closed next
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	// Followers receive purges from the primary, and forward webhooks and jobs to it
+	if replicator == nil {
+		background.Add(2)
+		go func() {
+			defer background.Done()
+			runPurger(backgroundCtx, apiCfg.DB, apiCfg.PurgeAfter, min(apiCfg.PurgeAfter, time.Hour))
+		}()
+
+		apiCfg.Webhooks = newWebhookDispatcher()
+		go apiCfg.Webhooks.run(backgroundCtx, webhookWorkers)
+
+		apiCfg.Jobs = newJobQueue(*asyncQueue)
+		go func() {
+			defer background.Done()
+			apiCfg.Jobs.run(backgroundCtx, *asyncWorkers, apiCfg.processReceiptJob)
+		}()
 	}
 
 	mux := http.NewServeMux()
@@ -22,16 +163,118 @@ func main() {
 	// Processes and stores receipts (POST)
 	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts) // Receipt  // Return ID
 
+	// Processes and stores an array of receipts, each independently unless atomic (POST)
+	mux.HandleFunc("POST /receipts/process:batch", apiCfg.handlerProcessReceiptsBatch) // Receipts  // Return results
+
+	// Reports the status of a receipt submitted for asynchronous processing (GET)
+	mux.HandleFunc("GET /jobs/{id}", apiCfg.handlerGetJob) // ID  // Return job
+
+	// Pages through stored receipts matching filters (GET)
+	mux.HandleFunc("GET /receipts", apiCfg.handlerListReceipts) // Filters, sort, cursor  // Return page
+
+	// Streams receipts as they are processed, as Server-Sent Events (GET)
+	mux.HandleFunc("GET /receipts/events", apiCfg.handlerReceiptEvents) // Last-Event-ID  // Return event stream
+
+	// Returns a stored receipt with its submission time and points (GET)
+	mux.HandleFunc("GET /receipts/{id}", apiCfg.handlerGetReceipt) // ID  // Return receipt
+
+	// Scores a receipt without storing it (POST)
+	mux.HandleFunc("POST /receipts/score", apiCfg.handlerScoreReceipt) // Receipt  // Return points
+
 	// Determines and returns points awarded to a receipt (GET)
 	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID) // ID  // Return points
 
-	port := "8080"
+	// Explains the points awarded to a receipt rule by rule (GET)
+	mux.HandleFunc("GET /receipts/{id}/points/breakdown", apiCfg.handlerGetPointsBreakdown) // ID  // Return rules
+
+	// Stores a corrected receipt as a new revision (PUT)
+	mux.HandleFunc("PUT /receipts/{id}", apiCfg.handlerAmendReceipt) // Receipt  // Return revision
+
+	// Lists every revision of a receipt (GET)
+	mux.HandleFunc("GET /receipts/{id}/revisions", apiCfg.handlerGetRevisions) // ID  // Return revisions
+
+	// Soft-deletes a receipt (DELETE)
+	mux.HandleFunc("DELETE /receipts/{id}", apiCfg.handlerDeleteReceipt) // ID
+
+	// Restores a soft-deleted receipt, or permanently removes expired ones (admin)
+	mux.HandleFunc("POST /admin/receipts/{id}/undelete", apiCfg.requireAdmin(apiCfg.handlerUndeleteReceipt)) // ID  // Return ID
+	mux.HandleFunc("POST /admin/purge", apiCfg.requireAdmin(apiCfg.handlerPurgeReceipts))                    // Return purged IDs
+
+	// Streams receipts out and backfills them in as newline-delimited JSON (admin)
+	mux.HandleFunc("GET /admin/receipts/export", apiCfg.requireAdmin(apiCfg.handlerExportReceipts))  // Return NDJSON
+	mux.HandleFunc("POST /admin/receipts/import", apiCfg.requireAdmin(apiCfg.handlerImportReceipts)) // NDJSON  // Return report
+
+	// Dumps and restores every stored receipt (admin)
+	mux.HandleFunc("GET /admin/snapshot", apiCfg.requireAdmin(apiCfg.handlerSnapshot)) // Return snapshot file
+	mux.HandleFunc("POST /admin/restore", apiCfg.requireAdmin(apiCfg.handlerRestore))  // Snapshot file  // Return count
+
+	// Rescores stored receipts with the current rules (admin)
+	mux.HandleFunc("POST /admin/points/recompute", apiCfg.requireAdmin(apiCfg.handlerRecomputePoints)) // Return rescored revisions
+
+	// Registers endpoints notified of receipt changes, and reports their deliveries (admin)
+	mux.HandleFunc("POST /admin/webhooks", apiCfg.requireAdmin(apiCfg.handlerCreateWebhook))             // URL, events, secret  // Return subscription
+	mux.HandleFunc("GET /admin/webhooks", apiCfg.requireAdmin(apiCfg.handlerListWebhooks))               // Return subscriptions
+	mux.HandleFunc("GET /admin/webhooks/{id}", apiCfg.requireAdmin(apiCfg.handlerGetWebhook))            // ID  // Return subscription and deliveries
+	mux.HandleFunc("DELETE /admin/webhooks/{id}", apiCfg.requireAdmin(apiCfg.handlerDeleteWebhook))      // ID
+	mux.HandleFunc("POST /admin/webhooks/{id}/enable", apiCfg.requireAdmin(apiCfg.handlerEnableWebhook)) // ID  // Return subscription
+
+	// Reports receipt and eviction counts (admin)
+	mux.HandleFunc("GET /admin/stats", apiCfg.requireAdmin(apiCfg.handlerStoreStats)) // Return stats
+
+	// Streams stored receipts and their changes to followers (admin)
+	mux.HandleFunc("GET /replication/snapshot", apiCfg.requireAdmin(apiCfg.handlerReplicationSnapshot)) // Return records
+	mux.HandleFunc("GET /replication/changes", apiCfg.requireAdmin(apiCfg.handlerReplicationChanges))   // Return changes
+
+	// Reports the instance's role and, on followers, replication lag (GET)
+	mux.HandleFunc("GET /replication/status", apiCfg.handlerReplicationStatus) // Return status
+
+	// Routes are served under the current version's prefix, and unprefixed
+	// with the contract from before versioning
+	legacy.Successor = apiVersionPrefix
+	root := http.NewServeMux()
+	mountAPIVersion(root, apiVersionPrefix, mux)
+	root.Handle("/", legacy.announce(mux))
+
+	// Followers serve reads and forward writes to the primary
+	var handler http.Handler = root
+	if replicator != nil {
+		handler = replicator.forwardWrites(root)
+	}
+
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:    ":" + *port,
+		Handler: handler,
 	}
 
-	log.Printf("Serving files on port: %v", port)
-	log.Fatal(srv.ListenAndServe())
+	served := make(chan error, 1)
+	go func() {
+		log.Printf("Serving files on port: %v", *port)
+		served <- srv.ListenAndServe()
+	}()
+
+	// Stop taking requests and let in-flight ones finish, cutting off any
+	// still running (e.g. event streams) after shutdownTimeout
+	var serveErr error
+	select {
+	case serveErr = <-served:
+		log.Printf("Error serving: %s", serveErr)
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down: %s", err)
+			srv.Close()
+		}
+		cancel()
+	}
 
+	// Flush and close the store once nothing else can write to it
+	stopBackground()
+	background.Wait()
+	if err := closeStore(); err != nil {
+		log.Fatalf("Error closing receipt store: %s", err)
+	}
+	if serveErr != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// In-memory ReceiptStore, safe for concurrent use
+type memoryStore struct {
+	mu      sync.RWMutex
+	records map[string]ReceiptRecord
+	index   *receiptIndex
+	changes *changeLog
+	now     func() time.Time
+
+	// Optional hook used by durable stores, called with the write lock held
+	// before a mutation is applied. A nil record means id is being removed.
+	// Returning an error aborts the mutation and leaves memory untouched.
+	persist func(id string, record *ReceiptRecord) error
+
+	// Optional hook used by durable stores to atomically persist a full
+	// replacement of the contents, called with the write lock held
+	persistAll func(records map[string]ReceiptRecord) error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records: make(map[string]ReceiptRecord),
+		index:   newReceiptIndex(),
+		changes: newChangeLog(changeLogRetention),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryStore) Put(ctx context.Context, receipt Receipt) error {
+	if receipt.ID == "" {
+		return errors.New("receipt has no ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := newReceiptRecord(receipt, s.now().UTC())
+	record.Revisions[0] = scoredRevision(record.Revisions[0])
+	return s.commit(record)
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Receipt, error) {
+	record, err := s.GetRecord(ctx, id)
+	if err != nil {
+		return Receipt{}, err
+	}
+	return record.Latest().Receipt, nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Receipt, error) {
+	records, err := s.ListRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	receipts := make([]Receipt, 0, len(records))
+	for _, record := range records {
+		if record.DeletedAt == nil {
+			receipts = append(receipts, record.Latest().Receipt)
+		}
+	}
+	return receipts, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.live(id)
+	if err != nil {
+		return err
+	}
+
+	deletedAt := s.now().UTC()
+	record.DeletedAt = &deletedAt
+	return s.commit(record)
+}
+
+func (s *memoryStore) Undelete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[id]
+	if !ok || record.DeletedAt == nil {
+		return ErrReceiptNotFound
+	}
+
+	record.DeletedAt = nil
+	return s.commit(record)
+}
+
+func (s *memoryStore) Remove(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[id]; !ok {
+		return ErrReceiptNotFound
+	}
+	return s.remove(id)
+}
+
+func (s *memoryStore) Purge(ctx context.Context, deletedBefore time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged []string
+	for id, record := range s.records {
+		if record.DeletedAt == nil || !record.DeletedAt.Before(deletedBefore) {
+			continue
+		}
+
+		err := s.remove(id)
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, id)
+	}
+
+	sort.Strings(purged)
+	return purged, nil
+}
+
+func (s *memoryStore) Amend(ctx context.Context, receipt Receipt) (ReceiptRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.live(receipt.ID)
+	if err != nil {
+		return ReceiptRevision{}, err
+	}
+
+	revision := scoredRevision(ReceiptRevision{
+		Revision:  len(record.Revisions) + 1,
+		CreatedAt: s.now().UTC(),
+		Receipt:   receipt,
+	})
+
+	// Clip so the append never writes into a slice a reader may still hold
+	record.Revisions = append(slices.Clip(record.Revisions), revision)
+
+	err = s.commit(record)
+	if err != nil {
+		return ReceiptRevision{}, err
+	}
+	return revision, nil
+}
+
+func (s *memoryStore) Rescore(ctx context.Context, id string) ([]ReceiptRevision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[id]
+	if !ok {
+		return nil, ErrReceiptNotFound
+	}
+
+	// Clone so a failed commit leaves the stored revisions untouched
+	revisions := slices.Clone(record.Revisions)
+	var rescored []ReceiptRevision
+	for i, revision := range revisions {
+		points := scoreReceipt(revision.Receipt)
+		if revision.Points != nil && *revision.Points == points {
+			continue
+		}
+
+		revision.Rescores = append(slices.Clip(revision.Rescores), PointsRescore{
+			RescoredAt: s.now().UTC(),
+			OldPoints:  revision.Points,
+			NewPoints:  points,
+		})
+		revision.Points = &points
+		revisions[i] = revision
+		rescored = append(rescored, revision)
+	}
+	if len(rescored) == 0 {
+		return nil, nil
+	}
+
+	record.Revisions = revisions
+	err := s.commit(record)
+	if err != nil {
+		return nil, err
+	}
+	return rescored, nil
+}
+
+func (s *memoryStore) GetRecord(ctx context.Context, id string) (ReceiptRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.live(id)
+}
+
+func (s *memoryStore) ListRecords(ctx context.Context) ([]ReceiptRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make([]ReceiptRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID < records[j].ID
+	})
+
+	return records, nil
+}
+
+func (s *memoryStore) Find(ctx context.Context, query ReceiptQuery) ([]Receipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := s.index.find(query)
+	sort.Strings(ids)
+
+	receipts := make([]Receipt, 0, len(ids))
+	for _, id := range ids {
+		receipts = append(receipts, s.records[id].Latest().Receipt)
+	}
+	return receipts, nil
+}
+
+func (s *memoryStore) Page(ctx context.Context, request ReceiptPageRequest) (ReceiptPage, error) {
+	if request.Limit < 1 {
+		return ReceiptPage{}, errors.New("page limit must be positive")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	positions := s.index.page(request)
+
+	var page ReceiptPage
+	if len(positions) > request.Limit {
+		positions = positions[:request.Limit]
+		page.Next = &positions[len(positions)-1]
+	}
+
+	page.Records = make([]ReceiptRecord, 0, len(positions))
+	for _, position := range positions {
+		page.Records = append(page.Records, s.records[position.ID])
+	}
+	return page, nil
+}
+
+func (s *memoryStore) Replace(ctx context.Context, records []ReceiptRecord) error {
+	replacement := make(map[string]ReceiptRecord, len(records))
+	for _, record := range records {
+		if record.ID == "" {
+			return errors.New("receipt has no ID")
+		}
+		if len(record.Revisions) == 0 {
+			return fmt.Errorf("receipt %v has no revisions", record.ID)
+		}
+		if _, ok := replacement[record.ID]; ok {
+			return fmt.Errorf("duplicate receipt ID: %v", record.ID)
+		}
+		record.SchemaVersion = receiptSchemaVersion
+		replacement[record.ID] = record
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.persistAll != nil {
+		err := s.persistAll(replacement)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.records = replacement
+	s.reindex()
+	s.changes.reset()
+	return nil
+}
+
+// Rebuilds the secondary indexes from scratch, called with the write lock held
+// or before the store is shared
+func (s *memoryStore) reindex() {
+	s.index = buildReceiptIndex(s.records)
+}
+
+// Returns the record under id unless it is missing or deleted, called with the lock held
+func (s *memoryStore) live(id string) (ReceiptRecord, error) {
+	record, ok := s.records[id]
+	if !ok {
+		return ReceiptRecord{}, ErrReceiptNotFound
+	}
+	if record.DeletedAt != nil {
+		return ReceiptRecord{}, ErrReceiptDeleted
+	}
+	return record, nil
+}
+
+// Persists and applies the removal of id, called with the write lock held
+func (s *memoryStore) remove(id string) error {
+	if s.persist != nil {
+		err := s.persist(id, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	delete(s.records, id)
+	s.index.remove(id)
+	s.changes.append(id, s.now().UTC())
+	return nil
+}
+
+// Persists and applies record, called with the write lock held
+func (s *memoryStore) commit(record ReceiptRecord) error {
+	record.SchemaVersion = receiptSchemaVersion
+	if s.persist != nil {
+		err := s.persist(record.ID, &record)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.records[record.ID] = record
+	s.index.add(record)
+	s.changes.append(record.ID, s.now().UTC())
+	return nil
+}
+
+func (s *memoryStore) changeLog() *changeLog {
+	return s.changes
+}
+
+func (s *memoryStore) replicationSnapshot() ([]ReceiptRecord, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Changes are logged with the write lock held, so none can land between these
+	records := make([]ReceiptRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	return records, s.changes.headSeq()
+}
+
+// Changes after seq after, each with its ID's current record or nil if it
+// was removed. Only the last change to each ID is served, since earlier ones
+// would carry the same record
+func (s *memoryStore) replicationChanges(after uint64) ([]change, uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Changes are logged with the write lock held, so the records reflect head
+	changes, head, ok := s.changes.since(after)
+	if !ok {
+		return nil, head, false
+	}
+
+	last := make(map[string]int, len(changes))
+	for i, change := range changes {
+		last[change.ID] = i
+	}
+	served := changes[:0]
+	for i, change := range changes {
+		if last[change.ID] != i {
+			continue
+		}
+		if record, ok := s.records[change.ID]; ok {
+			change.Record = &record
+		}
+		served = append(served, change)
+	}
+	return served, head, true
+}
+
+// Applies a change streamed from a primary, leaving id removed if record is nil
+func (s *memoryStore) applyChange(id string, record *ReceiptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record == nil {
+		if _, ok := s.records[id]; !ok {
+			return nil
+		}
+		return s.remove(id)
+	}
+	return s.commit(*record)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Longest line accepted by POST /admin/receipts/import
+const importMaxLineBytes = 1 << 20
+
+// Lines of an import reported individually, later ones are only counted
+const importResultsKept = 1000
+
+// One line of GET /admin/receipts/export
+type exportedReceipt struct {
+	Receipt
+	Points int64 `json:"points"`
+}
+
+// Outcome of one line of POST /admin/receipts/import
+type importResult struct {
+	Line  int    `json:"line"`
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Streams the latest revision of every stored receipt, with its points, as
+// newline-delimited JSON. With encryption keys each line is sealed under the primary key
+func (cfg *apiConfig) handlerExportReceipts(w http.ResponseWriter, r *http.Request) {
+	records, err := cfg.DB.ListRecords(r.Context())
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to list receipts.", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	writer := bufio.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+
+	exported := 0
+	for _, record := range records {
+		if record.DeletedAt != nil {
+			continue
+		}
+
+		latest := record.Latest()
+		line, err := json.Marshal(exportedReceipt{
+			Receipt: latest.Receipt,
+			Points:  latest.Score().Points,
+		})
+		if err == nil {
+			line, err = cfg.Keys.seal(line)
+		}
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			// The client has gone away, the status line is already sent
+			log.Printf("Error exporting receipts: %s", err)
+			return
+		}
+
+		// Push out a chunk every so often so large exports start streaming right away
+		exported++
+		if exported%1000 == 0 {
+			writer.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	writer.Flush()
+}
+
+// Stores every receipt in a newline-delimited JSON body, one per line,
+// keeping supplied IDs. Lines are validated and stored independently and
+// the body is read one line at a time
+func (cfg *apiConfig) handlerImportReceipts(w http.ResponseWriter, r *http.Request) {
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), importMaxLineBytes)
+
+	type ResponseBody struct {
+		Imported int            `json:"imported"`
+		Failed   int            `json:"failed"`
+		Results  []importResult `json:"results"`
+		Error    string         `json:"error,omitempty"`
+
+		// Set when the body held more lines than are reported
+		Truncated bool `json:"truncated,omitempty"`
+	}
+	report := ResponseBody{
+		Results: []importResult{},
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		result := importResult{
+			Line: line,
+		}
+
+		id, err := cfg.importReceipt(r.Context(), scanner.Bytes())
+		result.Id = id
+		if err != nil {
+			result.Error = err.Error()
+			report.Failed++
+		} else {
+			report.Imported++
+		}
+		if len(report.Results) < importResultsKept {
+			report.Results = append(report.Results, result)
+		} else {
+			report.Truncated = true
+		}
+	}
+
+	// Lines up to the failure are already stored, so report them along with the failure
+	if err := scanner.Err(); err != nil {
+		report.Error = err.Error()
+		if errors.Is(err, bufio.ErrTooLong) {
+			report.Error = "line too long"
+		}
+		log.Printf("Error reading import at line %v: %s", line+1, err)
+	}
+
+	respond(w, r, http.StatusOK, report)
+}
+
+// Validates and stores one import line, sealed or not, returning the receipt's ID
+func (cfg *apiConfig) importReceipt(ctx context.Context, line []byte) (string, error) {
+	line, _, err := cfg.Keys.open(line)
+	if err != nil {
+		return "", err
+	}
+
+	var receipt Receipt
+	err = json.Unmarshal(line, &receipt)
+	if err != nil {
+		return "", errors.New("invalid JSON")
+	}
+
+	if !validateReceipt(receipt) {
+		return receipt.ID, errors.New("the receipt is invalid")
+	}
+
+	if receipt.ID == "" {
+		receipt.ID = uuid.New().String()
+	} else if !receiptIDPattern.MatchString(receipt.ID) {
+		return receipt.ID, errors.New("the receipt ID is invalid")
+	}
+
+	// Backfills never overwrite receipts that are already stored, even deleted ones.
+	// Imports are serialised so two cannot both find an ID free and store it
+	cfg.importMu.Lock()
+	defer cfg.importMu.Unlock()
+
+	_, err = cfg.DB.Get(ctx, receipt.ID)
+	switch {
+	case err == nil, errors.Is(err, ErrReceiptDeleted):
+		return receipt.ID, errors.New("a receipt with that ID already exists")
+	case !errors.Is(err, ErrReceiptNotFound) && !errors.Is(err, ErrReceiptGone):
+		return receipt.ID, err
+	}
+
+	err = cfg.DB.Put(ctx, receipt)
+	if err != nil {
+		return receipt.ID, err
+	}
+	return receipt.ID, nil
+}
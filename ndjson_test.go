@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Expecting one line per live receipt, carrying its ID and points
+func TestHandlerExportReceipts(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+
+	ids := []string{
+		"00000000-0000-0000-0000-000000000000",
+		"10000000-2000-3000-4000-500000000000",
+		"20000000-0000-0000-0000-000000000000",
+	}
+	for _, id := range ids {
+		err := apiCfg.DB.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := apiCfg.DB.Delete(ctx, ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/receipts/export", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerExportReceipts)(w, req)
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("handler returned wrong content type: %v", contentType)
+	}
+
+	var lines []exportedReceipt
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var line exportedReceipt
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("handler exported wrong number of receipts\nexpected: %v\nactual: %v", 2, len(lines))
+	}
+	for i, line := range lines {
+		if line.ID != ids[i] || line.Points != 89 || line.Retailer != "Test Retailer" {
+			t.Errorf("handler exported wrong line: %+v", line)
+		}
+	}
+}
+
+// Expecting each line to be validated and stored independently, keeping supplied IDs
+func TestHandlerImportReceipts(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+
+	existingID := "20000000-0000-0000-0000-000000000000"
+	err := apiCfg.DB.Put(ctx, newTestReceipt(existingID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func(id string) string {
+		dat, _ := json.Marshal(newTestReceipt(id))
+		return string(dat)
+	}
+	invalid := newTestReceipt("30000000-0000-0000-0000-000000000000")
+	invalid.Total = ""
+	invalidLine, _ := json.Marshal(invalid)
+
+	body := strings.Join([]string{
+		valid("00000000-0000-0000-0000-000000000000"),
+		valid(""),
+		"",
+		string(invalidLine),
+		"{not json",
+		valid(existingID),
+		valid("../escape"),
+		valid("10000000-2000-3000-4000-500000000000"),
+	}, "\n")
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/receipts/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerImportReceipts)(w, req)
+
+	var report struct {
+		Imported int            `json:"imported"`
+		Failed   int            `json:"failed"`
+		Results  []importResult `json:"results"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Imported != 3 || report.Failed != 4 || len(report.Results) != 7 {
+		t.Fatalf("handler returned wrong report: %+v", report)
+	}
+
+	failedLines := map[int]bool{}
+	for _, result := range report.Results {
+		if result.Error != "" {
+			failedLines[result.Line] = true
+		}
+	}
+	for _, line := range []int{4, 5, 6, 7} {
+		if !failedLines[line] {
+			t.Errorf("handler did not report line %v as failed: %+v", line, report.Results)
+		}
+	}
+
+	// Assert supplied IDs were kept and a missing one was generated
+	for _, id := range []string{"00000000-0000-0000-0000-000000000000", "10000000-2000-3000-4000-500000000000", report.Results[1].Id} {
+		_, err := apiCfg.DB.Get(ctx, id)
+		if err != nil {
+			t.Errorf("imported receipt %q missing: %v", id, err)
+		}
+	}
+}
+
+// Expecting lines beyond the limit to stop the import and be reported
+func TestHandlerImportReceipts_LineTooLong(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+
+	dat, _ := json.Marshal(newTestReceipt("00000000-0000-0000-0000-000000000000"))
+	body := string(dat) + "\n" + strings.Repeat("x", importMaxLineBytes+1)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/receipts/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerImportReceipts)(w, req)
+
+	var report map[string]interface{}
+	err := json.NewDecoder(w.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report["imported"] != float64(1) || report["error"] != "line too long" {
+		t.Errorf("handler returned wrong report: %v", report)
+	}
+}
+
+// A store whose lookups are slow, widening the gap between checking for a receipt and storing one
+type slowGetStore struct {
+	ReceiptStore
+}
+
+func (s slowGetStore) Get(ctx context.Context, id string) (Receipt, error) {
+	receipt, err := s.ReceiptStore.Get(ctx, id)
+	time.Sleep(10 * time.Millisecond)
+	return receipt, err
+}
+
+// Expecting concurrent imports of the same ID to store it once
+func TestHandlerImportReceipts_Concurrent(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:         slowGetStore{newMemoryStore()},
+		AdminToken: "secret",
+	}
+
+	dat, err := json.Marshal(newTestReceipt("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := make([]struct {
+		Imported int `json:"imported"`
+	}, 8)
+	var wg sync.WaitGroup
+	for i := range reports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/admin/receipts/import", bytes.NewReader(dat))
+			req.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			apiCfg.requireAdmin(apiCfg.handlerImportReceipts)(w, req)
+			json.NewDecoder(w.Body).Decode(&reports[i])
+		}()
+	}
+	wg.Wait()
+
+	imported := 0
+	for _, report := range reports {
+		imported += report.Imported
+	}
+	if imported != 1 {
+		t.Errorf("concurrent imports stored the receipt %v times, expected once", imported)
+	}
+}
+
+// Expecting the report to stop listing lines past importResultsKept, while still counting them
+func TestHandlerImportReceipts_Truncated(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+
+	body := strings.Repeat("{not json\n", importResultsKept+5)
+	req := httptest.NewRequest(http.MethodPost, "/admin/receipts/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerImportReceipts)(w, req)
+
+	var report struct {
+		Failed    int            `json:"failed"`
+		Results   []importResult `json:"results"`
+		Truncated bool           `json:"truncated"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != importResultsKept+5 || len(report.Results) != importResultsKept || !report.Truncated {
+		t.Errorf("handler reported %v failed lines with %v results, truncated: %v", report.Failed, len(report.Results), report.Truncated)
+	}
+}
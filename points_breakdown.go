@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// One rule's share of a receipt's points, with the facts about the receipt it was decided on
+type ruleExplanation struct {
+	Rule   string `json:"rule"`
+	Points int64  `json:"points"`
+	Reason any    `json:"reason"`
+}
+
+type retailerReason struct {
+	Alphanumeric int `json:"alphanumeric"`
+}
+
+type totalReason struct {
+	Cents             int  `json:"cents"`
+	RoundDollar       bool `json:"roundDollar"`
+	MultipleOfQuarter bool `json:"multipleOfQuarter"`
+}
+
+type itemsReason struct {
+	Items int `json:"items"`
+	Pairs int `json:"pairs"`
+}
+
+type shortDescriptionReason struct {
+	// Only items whose trimmed description length is a multiple of 3 score
+	Items []scoredItem `json:"items"`
+}
+
+type scoredItem struct {
+	Index            int    `json:"index"`
+	ShortDescription string `json:"shortDescription"`
+	TrimmedLength    int    `json:"trimmedLength"`
+	Price            string `json:"price"`
+	Points           int    `json:"points"`
+}
+
+type purchaseDateReason struct {
+	Day    int  `json:"day"`
+	OddDay bool `json:"oddDay"`
+}
+
+type purchaseTimeReason struct {
+	Time           string `json:"time"`
+	Between2And4PM bool   `json:"between2And4PM"`
+}
+
+// Explains each rule's share of the points awarded to receipt. Points come
+// from the same rule functions scoreReceipt uses, so they sum to its total
+func explainPoints(receipt Receipt) []ruleExplanation {
+	return []ruleExplanation{
+		explainRetailer(receipt.Retailer),
+		explainTotal(receipt.Total),
+		explainItems(receipt.Items),
+		explainShortDescriptions(receipt.Items),
+		explainPurchaseDate(receipt.PurchaseDate),
+		explainPurchaseTime(receipt.PurchaseTime),
+	}
+}
+
+func explainRetailer(retailer string) ruleExplanation {
+	var reason retailerReason
+	for _, cha := range retailer {
+		if unicode.IsLetter(cha) || unicode.IsDigit(cha) {
+			reason.Alphanumeric++
+		}
+	}
+
+	return ruleExplanation{
+		Rule:   "retailer",
+		Points: int64(retailerPoints(retailer)),
+		Reason: reason,
+	}
+}
+
+func explainTotal(total string) ruleExplanation {
+	var reason totalReason
+	if _, cents, ok := strings.Cut(total, "."); ok {
+		reason.Cents, _ = strconv.Atoi(cents)
+		reason.RoundDollar = cents == "00"
+	}
+	reason.MultipleOfQuarter = reason.Cents%25 == 0
+
+	return ruleExplanation{
+		Rule:   "total",
+		Points: int64(totalPoints(total)),
+		Reason: reason,
+	}
+}
+
+func explainItems(items []Item) ruleExplanation {
+	return ruleExplanation{
+		Rule:   "items",
+		Points: int64(itemPoints(items)),
+		Reason: itemsReason{
+			Items: len(items),
+			Pairs: len(items) / 2,
+		},
+	}
+}
+
+func explainShortDescriptions(items []Item) ruleExplanation {
+	reason := shortDescriptionReason{
+		Items: []scoredItem{},
+	}
+	for i, item := range items {
+		trimmedLength := len(strings.TrimSpace(item.ShortDescription))
+		if trimmedLength%3 != 0 {
+			continue
+		}
+
+		reason.Items = append(reason.Items, scoredItem{
+			Index:            i,
+			ShortDescription: item.ShortDescription,
+			TrimmedLength:    trimmedLength,
+			Price:            item.Price,
+			Points:           shortDescriptionPoints([]Item{item}),
+		})
+	}
+
+	return ruleExplanation{
+		Rule:   "shortDescription",
+		Points: int64(shortDescriptionPoints(items)),
+		Reason: reason,
+	}
+}
+
+func explainPurchaseDate(purchaseDate string) ruleExplanation {
+	var reason purchaseDateReason
+	if len(purchaseDate) >= 10 {
+		reason.Day, _ = strconv.Atoi(purchaseDate[8:10])
+	}
+	reason.OddDay = reason.Day%2 != 0
+
+	return ruleExplanation{
+		Rule:   "purchaseDate",
+		Points: int64(purchaseDatePoints(purchaseDate)),
+		Reason: reason,
+	}
+}
+
+func explainPurchaseTime(purchaseTime string) ruleExplanation {
+	points := purchaseTimePoints(purchaseTime)
+
+	return ruleExplanation{
+		Rule:   "purchaseTime",
+		Points: int64(points),
+		Reason: purchaseTimeReason{
+			Time:           purchaseTime,
+			Between2And4PM: points > 0,
+		},
+	}
+}
+
+// Explains the points awarded to a receipt rule by rule
+func (cfg *apiConfig) handlerGetPointsBreakdown(w http.ResponseWriter, r *http.Request) {
+	receiptID := r.PathValue("id")
+
+	record, err := cfg.DB.GetRecord(r.Context(), receiptID)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	// Explains the latest revision unless "?revision=" asks for an older one
+	revision, ok := requestedRevision(w, r, record)
+	if !ok {
+		return
+	}
+
+	type ResponseBody struct {
+		Id       string            `json:"id"`
+		Revision int               `json:"revision"`
+		Points   int64             `json:"points"`
+		Rules    []ruleExplanation `json:"rules"`
+
+		// Set when the points were stored under rules that have since changed,
+		// until an admin rescores. Points may then differ from the rules' sum
+		Stale bool `json:"stale,omitempty"`
+	}
+
+	if notModified(w, r, revisionValidators(revision)) {
+		return
+	}
+
+	stored := revision.Score()
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Id:       receiptID,
+		Revision: revision.Revision,
+		Points:   stored.Points,
+		Rules:    explainPoints(revision.Receipt),
+		Stale:    scoreReceipt(revision.Receipt) != stored,
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Expecting each rule's points and reason, summing to the points endpoint's total
+func TestHandlerGetPointsBreakdown(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}/points/breakdown", apiCfg.handlerGetPointsBreakdown)
+
+	// The 28 point example from the challenge
+	testReceipt := Receipt{
+		ID:           "00000000-0000-0000-0000-000000000000",
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+	err := apiCfg.DB.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type ResponseBody struct {
+		Points int64 `json:"points"`
+		Rules  []struct {
+			Rule   string          `json:"rule"`
+			Points int64           `json:"points"`
+			Reason json.RawMessage `json:"reason"`
+		} `json:"rules"`
+		Stale bool `json:"stale"`
+	}
+
+	getBreakdown := func(id string) (int, ResponseBody) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/points/breakdown", nil))
+
+		var body ResponseBody
+		if w.Code == http.StatusOK {
+			err := json.NewDecoder(w.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, body
+	}
+
+	code, body := getBreakdown(testReceipt.ID)
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, code)
+	}
+
+	expected := []struct {
+		rule   string
+		points int64
+		reason string
+	}{
+		{"retailer", 6, `{"alphanumeric":6}`},
+		{"total", 0, `{"cents":35,"roundDollar":false,"multipleOfQuarter":false}`},
+		{"items", 10, `{"items":5,"pairs":2}`},
+		{"shortDescription", 6, `{"items":[{"index":1,"shortDescription":"Emils Cheese Pizza","trimmedLength":18,"price":"12.25","points":3},{"index":4,"shortDescription":"   Klarbrunn 12-PK 12 FL OZ  ","trimmedLength":24,"price":"12.00","points":3}]}`},
+		{"purchaseDate", 6, `{"day":1,"oddDay":true}`},
+		{"purchaseTime", 0, `{"time":"13:01","between2And4PM":false}`},
+	}
+	if len(body.Rules) != len(expected) {
+		t.Fatalf("handler returned %v rules, expected %v", len(body.Rules), len(expected))
+	}
+
+	var sum int64
+	for i, rule := range body.Rules {
+		sum += rule.Points
+		if rule.Rule != expected[i].rule || rule.Points != expected[i].points || string(rule.Reason) != expected[i].reason {
+			t.Errorf("handler explained rule wrong\nexpected: %v %v %s\nactual: %v %v %s", expected[i].rule, expected[i].points, expected[i].reason, rule.Rule, rule.Points, rule.Reason)
+		}
+	}
+	if body.Points != 28 || sum != body.Points || body.Stale {
+		t.Errorf("handler returned rules summing to %v for %v points, stale: %v", sum, body.Points, body.Stale)
+	}
+
+	// Expecting points stored under older rules to be flagged
+	stale := newTestRecord("10000000-2000-3000-4000-500000000000")
+	stale.Revisions[0].Points = &ReceiptPoints{Points: 5, Breakdown: PointsBreakdown{Retailer: 5}}
+	err = apiCfg.DB.Replace(ctx, []ReceiptRecord{stale})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := getBreakdown(stale.ID); body.Points != 5 || !body.Stale {
+		t.Errorf("handler did not flag stale points: %+v", body)
+	}
+
+	if code, _ := getBreakdown(testReceipt.ID); code != http.StatusNotFound {
+		t.Errorf("handler returned %v for a missing receipt, expected %v", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Receipts one POST /receipts/process:batch may hold when -batch-max is not set
+const defaultBatchMax = 1000
+
+// Bytes allowed per receipt a batch may hold, bounding how much of a batch
+// is buffered before it is rejected
+const batchReceiptBytes = 64 << 10
+
+// Returned by decodeBatch when a batch holds more receipts than allowed
+var errBatchTooLarge = errors.New("batch holds too many receipts")
+
+// Result for the receipt at Index in a batch: its ID, or why it was not stored
+type batchResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+
+	// Set when content deduplication returned an earlier submission's ID
+	Replayed bool `json:"replayed,omitempty"`
+
+	// Why the receipt was not stored, and for invalid receipts what is wrong with it
+	Error            string   `json:"error,omitempty"`
+	ValidationErrors []string `json:"validationErrors,omitempty"`
+}
+
+// Validates and stores each receipt of a JSON array independently, reporting
+// a result per receipt.
+//
+// With "?atomic=true" nothing is kept unless every receipt is stored. This is
+// not a transaction: receipts are still stored one at a time and removed
+// again if a later one fails, so until then readers, followers and the
+// journal see the first ones, and a crash in between can leave them stored.
+// Events and webhooks are only sent once the whole batch is stored
+func (cfg *apiConfig) handlerProcessReceiptsBatch(w http.ResponseWriter, r *http.Request) {
+	var atomic bool
+	if atomicParam := r.URL.Query().Get("atomic"); atomicParam != "" {
+		var err error
+		atomic, err = strconv.ParseBool(atomicParam)
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "The atomic parameter is invalid.", err)
+			return
+		}
+	}
+
+	batchMax := cfg.BatchMax
+	if batchMax <= 0 {
+		batchMax = defaultBatchMax
+	}
+
+	body := http.MaxBytesReader(w, r.Body, int64(batchMax)*batchReceiptBytes)
+	batch, err := decodeBatch(body, batchMax)
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, errBatchTooLarge) || errors.As(err, &maxBytesErr) {
+		respondWithError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("A batch may hold at most %v receipts of %v bytes.", batchMax, batchReceiptBytes), err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The batch must be a JSON array of receipts.", err)
+		return
+	}
+	if len(batch) == 0 {
+		respondWithError(w, r, http.StatusBadRequest, "The batch is empty.", nil)
+		return
+	}
+
+	type ResponseBody struct {
+		Stored  int           `json:"stored"`
+		Failed  int           `json:"failed"`
+		Results []batchResult `json:"results"`
+	}
+
+	// Reports every receipt without an ID as failed
+	respondWithResults := func(code int, results []batchResult) {
+		body := ResponseBody{
+			Results: results,
+		}
+		for _, result := range results {
+			if result.ID != "" {
+				body.Stored++
+			} else {
+				body.Failed++
+			}
+		}
+		respond(w, r, code, body)
+	}
+
+	// Every receipt is validated before any is stored
+	results := make([]batchResult, len(batch))
+	receipts := make([]Receipt, len(batch))
+	invalid := false
+	for i, dat := range batch {
+		results[i].Index = i
+		receipts[i], err = decodeReceipt(bytes.NewReader(dat))
+		if err != nil {
+			results[i].Error = "The receipt is invalid."
+			results[i].ValidationErrors = validationProblems(err)
+			invalid = true
+		}
+	}
+
+	if atomic && invalid {
+		for i := range results {
+			if results[i].Error == "" {
+				results[i].Error = "Not stored, another receipt in the batch is invalid."
+			}
+		}
+		respondWithResults(http.StatusBadRequest, results)
+		return
+	}
+
+	// Receipts stored by this batch, which an atomic batch removes again if a
+	// later one fails, and the points each was stored with
+	var stored []int
+	points := make([]ReceiptPoints, len(receipts))
+	for i, receipt := range receipts {
+		if results[i].Error != "" {
+			continue
+		}
+
+		id, receiptPoints, replayed, err := cfg.storeReceipt(r.Context(), receipt, "")
+		if err != nil {
+			log.Printf("Error storing receipt %v of batch: %s", i, err)
+			results[i].Error = "Unable to store receipt."
+
+			if atomic {
+				cfg.rollbackBatch(r, results, stored)
+				respondWithResults(http.StatusInternalServerError, results)
+				return
+			}
+			continue
+		}
+
+		results[i].ID = id
+		results[i].Replayed = replayed
+		if !replayed {
+			stored = append(stored, i)
+			points[i] = receiptPoints
+		}
+	}
+
+	// Only announced once the batch can no longer be rolled back
+	for _, i := range stored {
+		cfg.announceProcessed(results[i].ID, receipts[i], points[i])
+	}
+
+	respondWithResults(http.StatusOK, results)
+}
+
+// Reads a JSON array of at most max receipts, stopping at the first receipt
+// beyond that rather than reading the whole body
+func decodeBatch(body io.Reader, max int) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, errors.New("batch is not an array")
+	}
+
+	var batch []json.RawMessage
+	for decoder.More() {
+		if len(batch) == max {
+			return nil, errBatchTooLarge
+		}
+		var dat json.RawMessage
+		err := decoder.Decode(&dat)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, dat)
+	}
+
+	// Consumes the closing bracket, failing on a truncated array
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Removes the receipts an atomic batch stored before one failed, and marks
+// every receipt left without an ID as not stored. Receipts a bounded store
+// already evicted count as removed. Receipts that could not be removed, and
+// earlier submissions returned by deduplication, keep their IDs
+func (cfg *apiConfig) rollbackBatch(r *http.Request, results []batchResult, stored []int) {
+	for _, i := range stored {
+		err := cfg.DB.Remove(r.Context(), results[i].ID)
+		if err != nil && !errors.Is(err, ErrReceiptGone) && !errors.Is(err, ErrReceiptNotFound) {
+			log.Printf("Error rolling back receipt %v of batch: %s", results[i].ID, err)
+			continue
+		}
+		cfg.Idempotency.forgetReceipt(results[i].ID)
+		results[i].ID = ""
+	}
+
+	for i := range results {
+		if results[i].ID == "" && results[i].Error == "" {
+			results[i].Error = "Not stored, another receipt in the batch failed."
+		}
+	}
+}
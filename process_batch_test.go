@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A store whose Put fails from the failAt'th call on
+type failingPutStore struct {
+	ReceiptStore
+	failAt int
+	puts   int
+}
+
+func (s *failingPutStore) Put(ctx context.Context, receipt Receipt) error {
+	s.puts++
+	if s.puts >= s.failAt {
+		return errors.New("disk full")
+	}
+	return s.ReceiptStore.Put(ctx, receipt)
+}
+
+type batchResponseBody struct {
+	Stored  int           `json:"stored"`
+	Failed  int           `json:"failed"`
+	Results []batchResult `json:"results"`
+}
+
+// Posts receipts as a batch to path, decoding the report
+func postBatch(t *testing.T, apiCfg *apiConfig, path string, receipts ...Receipt) (int, batchResponseBody) {
+	t.Helper()
+	var body batchResponseBody
+	code := serveJSON(t, http.HandlerFunc(apiCfg.handlerProcessReceiptsBatch), http.MethodPost, path, append([]Receipt{}, receipts...), &body)
+	return code, body
+}
+
+// Expecting each receipt to be stored independently, with a result per index
+func TestHandlerProcessReceiptsBatch(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	invalid := newTestReceipt("")
+	invalid.Total = "10"
+
+	code, body := postBatch(t, &apiCfg, "/receipts/process:batch", newTestReceipt(""), invalid, newTestReceipt(""))
+	if code != http.StatusOK || body.Stored != 2 || body.Failed != 1 || len(body.Results) != 3 {
+		t.Fatalf("handler returned wrong report: %v %+v", code, body)
+	}
+	for i, result := range body.Results {
+		if result.Index != i {
+			t.Errorf("result %v reported index %v", i, result.Index)
+		}
+	}
+	if body.Results[0].ID == "" || body.Results[2].ID == "" || body.Results[0].ID == body.Results[2].ID {
+		t.Errorf("handler returned wrong IDs: %+v", body.Results)
+	}
+	if body.Results[1].ID != "" || body.Results[1].Error == "" {
+		t.Errorf("handler did not report the invalid receipt: %+v", body.Results[1])
+	}
+	if problems := body.Results[1].ValidationErrors; len(problems) != 1 || problems[0] != `total is malformed: "10"` {
+		t.Errorf("handler reported the wrong problems: %q", problems)
+	}
+
+	for _, i := range []int{0, 2} {
+		_, err := apiCfg.DB.Get(context.Background(), body.Results[i].ID)
+		if err != nil {
+			t.Errorf("receipt %v was not stored: %v", i, err)
+		}
+	}
+	if n := countReceipts(t, apiCfg.DB); n != 2 {
+		t.Errorf("store holds %v receipts, expected 2", n)
+	}
+}
+
+// Expecting an atomic batch to store nothing unless every receipt is stored
+func TestHandlerProcessReceiptsBatch_Atomic(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	invalid := newTestReceipt("")
+	invalid.Retailer = "Not $ valid"
+
+	code, body := postBatch(t, &apiCfg, "/receipts/process:batch?atomic=true", newTestReceipt(""), invalid)
+	if code != http.StatusBadRequest || body.Stored != 0 || body.Failed != 2 {
+		t.Errorf("handler returned wrong report for an invalid atomic batch: %v %+v", code, body)
+	}
+	if n := countReceipts(t, apiCfg.DB); n != 0 {
+		t.Errorf("invalid atomic batch stored %v receipts", n)
+	}
+
+	// Expecting receipts stored before a failing one to be removed again
+	store := &failingPutStore{ReceiptStore: newMemoryStore(), failAt: 3}
+	apiCfg.DB = store
+	apiCfg.Idempotency = newIdempotencyCache(time.Hour, true)
+
+	first := newTestReceipt("")
+	second := newTestReceipt("")
+	second.Total = "20.00"
+	third := newTestReceipt("")
+	third.Total = "30.00"
+
+	code, body = postBatch(t, &apiCfg, "/receipts/process:batch?atomic=true", first, second, third)
+	if code != http.StatusInternalServerError || body.Stored != 0 || body.Failed != 3 {
+		t.Errorf("handler returned wrong report for a failed atomic batch: %v %+v", code, body)
+	}
+	if n := countReceipts(t, store); n != 0 {
+		t.Errorf("failed atomic batch left %v receipts stored", n)
+	}
+
+	// Expecting rolled back receipts not to be deduplicated against
+	store.failAt = 100
+	code, body = postBatch(t, &apiCfg, "/receipts/process:batch?atomic=true", first)
+	if code != http.StatusOK || body.Stored != 1 || body.Results[0].Replayed {
+		t.Errorf("handler returned wrong report after a rollback: %v %+v", code, body)
+	}
+	if n := countReceipts(t, store); n != 1 {
+		t.Errorf("store holds %v receipts, expected 1", n)
+	}
+}
+
+// Expecting receipts a bounded store evicted during a failed atomic batch to count as rolled back
+func TestHandlerProcessReceiptsBatch_AtomicEvicted(t *testing.T) {
+	store := &failingPutStore{ReceiptStore: newBoundedStore(newMemoryStore(), storeLimits{MaxReceipts: 1}), failAt: 3}
+	apiCfg := apiConfig{
+		DB: store,
+	}
+
+	second := newTestReceipt("")
+	second.Total = "20.00"
+	third := newTestReceipt("")
+	third.Total = "30.00"
+
+	code, body := postBatch(t, &apiCfg, "/receipts/process:batch?atomic=true", newTestReceipt(""), second, third)
+	if code != http.StatusInternalServerError || body.Stored != 0 || body.Failed != 3 {
+		t.Errorf("handler returned wrong report for a failed atomic batch: %v %+v", code, body)
+	}
+	for _, result := range body.Results {
+		if result.ID != "" {
+			t.Errorf("handler reported receipt %v as stored: %+v", result.Index, result)
+		}
+	}
+	if n := countReceipts(t, store); n != 0 {
+		t.Errorf("failed atomic batch left %v receipts stored", n)
+	}
+}
+
+// Expecting identical receipts to share an ID when content deduplication is enabled
+func TestHandlerProcessReceiptsBatch_Dedupe(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:          newMemoryStore(),
+		Idempotency: newIdempotencyCache(time.Hour, true),
+	}
+
+	code, body := postBatch(t, &apiCfg, "/receipts/process:batch", newTestReceipt(""), newTestReceipt(""))
+	if code != http.StatusOK || body.Stored != 2 {
+		t.Fatalf("handler returned wrong report: %v %+v", code, body)
+	}
+	if body.Results[0].ID != body.Results[1].ID || body.Results[0].Replayed || !body.Results[1].Replayed {
+		t.Errorf("handler did not deduplicate: %+v", body.Results)
+	}
+	if n := countReceipts(t, apiCfg.DB); n != 1 {
+		t.Errorf("store holds %v receipts, expected 1", n)
+	}
+}
+
+// Expecting malformed, empty and oversized batches to be rejected whole
+func TestHandlerProcessReceiptsBatch_Rejected(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:       newMemoryStore(),
+		BatchMax: 2,
+	}
+
+	if code, _ := postBatch(t, &apiCfg, "/receipts/process:batch", newTestReceipt(""), newTestReceipt(""), newTestReceipt("")); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned %v for an oversized batch, expected %v", code, http.StatusRequestEntityTooLarge)
+	}
+	if code, _ := postBatch(t, &apiCfg, "/receipts/process:batch"); code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for an empty batch, expected %v", code, http.StatusBadRequest)
+	}
+	if code, _ := postBatch(t, &apiCfg, "/receipts/process:batch?atomic=sometimes", newTestReceipt("")); code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for an invalid atomic parameter, expected %v", code, http.StatusBadRequest)
+	}
+
+	w := httptest.NewRecorder()
+	apiCfg.handlerProcessReceiptsBatch(w, httptest.NewRequest(http.MethodPost, "/receipts/process:batch", bytes.NewReader([]byte(`{"retailer":"Target"}`))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for a batch that is not an array, expected %v", w.Code, http.StatusBadRequest)
+	}
+
+	// Expecting a body larger than the batch could need to be refused without reading it all
+	padded := append(append([]byte("["), bytes.Repeat([]byte(" "), 2*batchReceiptBytes+1)...), ']')
+	w = httptest.NewRecorder()
+	apiCfg.handlerProcessReceiptsBatch(w, httptest.NewRequest(http.MethodPost, "/receipts/process:batch", bytes.NewReader(padded)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned %v for an oversized body, expected %v", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	if n := countReceipts(t, apiCfg.DB); n != 0 {
+		t.Errorf("rejected batches stored %v receipts", n)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"regexp"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -23,8 +28,206 @@ type Item struct {
 	Price            string `json:"price"`
 }
 
+// Returned by decodeReceipt, wrapped in a receiptValidationError listing
+// what is wrong, when a receipt fails validation
+var errInvalidReceipt = errors.New("receipt failed validation")
+
+type receiptValidationError struct {
+	Problems []string
+}
+
+func (e *receiptValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", errInvalidReceipt, strings.Join(e.Problems, "; "))
+}
+
+func (e *receiptValidationError) Unwrap() error {
+	return errInvalidReceipt
+}
+
+// What is wrong with a receipt decodeReceipt rejected, for reporting to the client
+func validationProblems(err error) []string {
+	var validationErr *receiptValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Problems
+	}
+	return []string{err.Error()}
+}
+
+// Reads a receipt sent as JSON, XML or YAML, as JSON. Answers 415 with the
+// accepted types, or 400, and returns false when it cannot be read
+func receiptBody(w http.ResponseWriter, r *http.Request) (io.Reader, bool) {
+	body, err := requestBodyJSON(r)
+	if errors.Is(err, errUnsupportedMediaType) {
+		w.Header().Set("Accept-Post", strings.Join(mediaTypes(requestFormats), ", "))
+		respondWithError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("The receipt must be sent as %v.", strings.Join(mediaTypes(requestFormats), ", ")), err)
+		return nil, false
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The receipt is invalid.", err)
+		return nil, false
+	}
+	return body, true
+}
+
+// Returned by storeReceipt when the store fails to write a receipt
+var errStoringReceipt = errors.New("unable to store receipt")
+
 // Determines and returns points awarded to a receipt
 func (cfg *apiConfig) handlerProcessReceipts(w http.ResponseWriter, r *http.Request) {
+	body, ok := receiptBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Retried submissions (same Idempotency-Key, or identical content when
+	// content deduplication is enabled) get the original ID back
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > idempotencyKeyMaxLength {
+		respondWithError(w, r, http.StatusBadRequest, "The Idempotency-Key header is too long.", nil)
+		return
+	}
+
+	// Clients asking for asynchronous processing get a job to poll instead
+	async, err := wantsAsync(r)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The async parameter is invalid.", err)
+		return
+	}
+	if async {
+		cfg.submitReceiptJob(w, r, body, idempotencyKey)
+		return
+	}
+
+	newReceipt, err := decodeReceipt(body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The receipt is invalid.", err)
+		return
+	}
+
+	// Structure of JSON response body
+	type ResponseBody struct {
+		Id string `json:"id"`
+	}
+
+	id, points, replayed, err := cfg.storeReceipt(r.Context(), newReceipt, idempotencyKey)
+	if err != nil {
+		code, msg := storeReceiptError(err)
+		respondWithError(w, r, code, msg, err)
+		return
+	}
+	if !replayed {
+		cfg.announceProcessed(id, newReceipt, points)
+	}
+
+	// Versioned routes answer a new receipt with 201 Created and where to find
+	// it; the unversioned aliases keep answering 200
+	code := http.StatusOK
+	if apiPrefix(r) != "" {
+		w.Header().Set("Location", apiPrefix(r)+"/receipts/"+id)
+		if !replayed {
+			code = http.StatusCreated
+		}
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+
+	respond(w, r, code, ResponseBody{
+		Id: id,
+	})
+
+}
+
+// Stores a validated receipt under a newly generated ID, unless the
+// idempotency key or its content maps it to an earlier submission. Returns
+// the receipt's ID, the points it was stored with (unset for an earlier
+// submission's) and whether it is the earlier submission's
+func (cfg *apiConfig) storeReceipt(ctx context.Context, receipt Receipt, idempotencyKey string) (string, ReceiptPoints, bool, error) {
+	hash := receiptContentHash(receipt)
+	existingID, commit, err := cfg.Idempotency.begin(ctx, idempotencyKey, hash)
+	for err == nil && existingID != "" {
+		var replay bool
+		replay, err = cfg.replayable(ctx, existingID, idempotencyKey, hash)
+		if err != nil {
+			return "", ReceiptPoints{}, false, err
+		}
+		if replay {
+			return existingID, ReceiptPoints{}, true, nil
+		}
+		existingID, commit, err = cfg.Idempotency.begin(ctx, idempotencyKey, hash)
+	}
+	if err != nil {
+		return "", ReceiptPoints{}, false, err
+	}
+
+	// Generate new UUID using "github.com/google/uuid"
+	newUUID := uuid.New()
+	uuidString := newUUID.String()
+	receipt.ID = uuidString
+
+	// Store newly validated Receipt in DB, using UUID generated as the key
+	err = cfg.DB.Put(ctx, receipt)
+	if err != nil {
+		commit("")
+		return "", ReceiptPoints{}, false, fmt.Errorf("%w: %w", errStoringReceipt, err)
+	}
+	commit(uuidString)
+
+	// The store scored it on ingest, so read those points back rather than scoring it again
+	record, err := cfg.DB.GetRecord(ctx, uuidString)
+	if err != nil {
+		log.Printf("Error reading back stored receipt %v: %s", uuidString, err)
+		return uuidString, scoreReceipt(receipt), false, nil
+	}
+	return uuidString, record.Revisions[0].Score(), false, nil
+}
+
+// Whether an earlier submission's receipt can be returned for a repeat of
+// it. Mappings to receipts deleted or evicted since are forgotten, as are
+// content matches for receipts amended since, so the repeat is stored anew
+func (cfg *apiConfig) replayable(ctx context.Context, existingID string, idempotencyKey string, hash string) (bool, error) {
+	current, err := cfg.DB.Get(ctx, existingID)
+	switch {
+	case errors.Is(err, ErrReceiptNotFound), errors.Is(err, ErrReceiptGone), errors.Is(err, ErrReceiptDeleted):
+		cfg.Idempotency.forgetReceipt(existingID)
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("%w: %w", errStoringReceipt, err)
+	}
+
+	// A retried Idempotency-Key names the submission, however it was amended since
+	if receiptContentHash(current) == hash || cfg.Idempotency.storedWithKey(idempotencyKey, existingID) {
+		return true, nil
+	}
+	cfg.Idempotency.forget(hash, existingID)
+	return false, nil
+}
+
+// Status and description of the response to a storeReceipt error
+func storeReceiptError(err error) (int, string) {
+	switch {
+	case errors.Is(err, errIdempotencyConflict):
+		return http.StatusConflict, "The Idempotency-Key was already used for a different receipt."
+	case errors.Is(err, errStoringReceipt):
+		return http.StatusInternalServerError, "Unable to store receipt."
+	default:
+		return http.StatusInternalServerError, "Unable to process receipt."
+	}
+}
+
+// Tells event stream clients and webhook subscribers about a newly stored
+// receipt and the points it was stored with
+func (cfg *apiConfig) announceProcessed(id string, receipt Receipt, points ReceiptPoints) {
+	cfg.Events.publish(id, receipt, points.Points)
+	cfg.Webhooks.notify(webhookReceiptProcessed, receiptEvent{
+		ID:       id,
+		Retailer: receipt.Retailer,
+		Points:   points.Points,
+	})
+}
+
+// Decodes and validates a receipt from a JSON request body, leaving its ID unset
+func decodeReceipt(body io.Reader) (Receipt, error) {
 	type parameters struct {
 		Retailer     string `json:"retailer"`
 		PurchaseDate string `json:"purchaseDate"`
@@ -34,21 +237,15 @@ func (cfg *apiConfig) handlerProcessReceipts(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Decode JSON request body into Go readable struct
-	decoder := json.NewDecoder(r.Body)
+	decoder := json.NewDecoder(body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "The receipt is invalid.", err)
-		return
+		return Receipt{}, err
 	}
 
-	// Generate new UUID using "github.com/google/uuid"
-	newUUID := uuid.New()
-	uuidString := newUUID.String()
-
 	// Store params data in a new Receipt object.
-	newReceipt := Receipt{
-		ID:           uuidString,
+	receipt := Receipt{
 		Retailer:     params.Retailer,
 		PurchaseDate: params.PurchaseDate,
 		PurchaseTime: params.PurchaseTime,
@@ -57,73 +254,47 @@ func (cfg *apiConfig) handlerProcessReceipts(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Validates "Receipt" fields
-	valid := validateReceipt(newReceipt)
-	if !valid {
-		respondWithError(w, http.StatusBadRequest, "The receipt is invalid.", err)
-		return
+	if problems := receiptProblems(receipt); len(problems) > 0 {
+		return Receipt{}, &receiptValidationError{Problems: problems}
 	}
 
-	// Structure of JSON response body
-	type ResponseBody struct {
-		Id string `json:"id"`
-	}
-
-	// Store newly validated Receipt in DB (sync.Map), using UUID generated as the key
-	cfg.DB.Store(uuidString, newReceipt)
-
-	respondWithJSON(w, http.StatusOK, ResponseBody{
-		Id: uuidString,
-	})
-
+	return receipt, nil
 }
 
 // Ensures each Receipt field conforms to expected patterns
 // -> true If valid
 // -> false If invalid
 func validateReceipt(receipt Receipt) bool {
-	textPattern := regexp.MustCompile(`^[\w\s&-]+$`)
-	valid := textPattern.MatchString(receipt.Retailer)
-	if !valid {
-		log.Printf("Malformed Retailer field: %v", receipt.Retailer)
-		return valid
-	}
-
-	purchaseDatePattern := regexp.MustCompile(`\d{4}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])`)
-	valid = purchaseDatePattern.MatchString(receipt.PurchaseDate)
-	if !valid {
-		log.Printf("Malformed PurchaseDate field: %v", receipt.PurchaseDate)
-		return valid
-	}
-
-	purchaseTimePattern := regexp.MustCompile(`(0[0-9]|1[0-9]|2[0-4]):[0-5][0-9]`)
-	valid = purchaseTimePattern.MatchString(receipt.PurchaseTime)
-	if !valid {
-		log.Printf("Malformed PurchaseTime field: %v", receipt.PurchaseTime)
-		return valid
-	}
-
-	expensePattern := regexp.MustCompile(`^\d+\.\d{2}$`)
-	valid = expensePattern.MatchString(receipt.Total)
-	if !valid {
-		log.Printf("Malformed Total field: %v", receipt.Total)
-		return valid
+	problems := receiptProblems(receipt)
+	for _, problem := range problems {
+		log.Printf("Malformed receipt: %v", problem)
 	}
+	return len(problems) == 0
+}
 
-	items := receipt.Items
-	for _, item := range items {
-		valid = textPattern.MatchString(item.ShortDescription)
-		if !valid {
-			log.Printf("Malformed ShortDescription field: %v", item.ShortDescription)
-			return valid
-		}
+var (
+	textPattern         = regexp.MustCompile(`^[\w\s&-]+$`)
+	purchaseDatePattern = regexp.MustCompile(`\d{4}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])`)
+	purchaseTimePattern = regexp.MustCompile(`(0[0-9]|1[0-9]|2[0-4]):[0-5][0-9]`)
+	expensePattern      = regexp.MustCompile(`^\d+\.\d{2}$`)
+)
 
-		valid = expensePattern.MatchString(item.Price)
-		if !valid {
-			log.Printf("Malformed Price field: %v", item.Price)
-			return valid
+// Describes every Receipt field that does not conform to its expected pattern
+func receiptProblems(receipt Receipt) []string {
+	var problems []string
+	check := func(pattern *regexp.Regexp, field string, value string) {
+		if !pattern.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("%v is malformed: %q", field, value))
 		}
-
 	}
 
-	return valid
+	check(textPattern, "retailer", receipt.Retailer)
+	check(purchaseDatePattern, "purchaseDate", receipt.PurchaseDate)
+	check(purchaseTimePattern, "purchaseTime", receipt.PurchaseTime)
+	check(expensePattern, "total", receipt.Total)
+	for i, item := range receipt.Items {
+		check(textPattern, fmt.Sprintf("items[%v].shortDescription", i), item.ShortDescription)
+		check(expensePattern, fmt.Sprintf("items[%v].price", i), item.Price)
+	}
+	return problems
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Events kept for reconnecting clients to resume from
+const receiptEventRetention = 10_000
+
+// Events a client may fall behind by before it is disconnected, so a stuck
+// client never holds up the receipts being processed
+const eventSubscriberBuffer = 256
+
+// How often an idle stream is sent a comment, keeping proxies from closing it
+const eventsKeepAlive = 15 * time.Second
+
+// Longest a single write to a client may take before it is disconnected
+const eventsWriteTimeout = 10 * time.Second
+
+// A receipt accepted by POST /receipts/process, as streamed to dashboards
+type receiptEvent struct {
+	Seq      uint64 `json:"-"`
+	ID       string `json:"id"`
+	Retailer string `json:"retailer"`
+	Points   int64  `json:"points"`
+}
+
+// Bounded buffer of the most recent receipt events, fanned out to every
+// subscribed client. The epoch identifies one run of the server, since
+// sequence numbers restart with it
+type receiptEvents struct {
+	epoch  string
+	retain int
+
+	mu          sync.Mutex
+	head        uint64
+	events      []receiptEvent
+	subscribers map[*eventSubscriber]struct{}
+}
+
+// A client streaming events
+type eventSubscriber struct {
+	events chan receiptEvent
+
+	// Closed when the client fell too far behind and was dropped
+	dropped chan struct{}
+}
+
+func newReceiptEvents(retain int) *receiptEvents {
+	return &receiptEvents{
+		epoch:       uuid.New().String(),
+		retain:      retain,
+		subscribers: map[*eventSubscriber]struct{}{},
+	}
+}
+
+// Records that a receipt was accepted with points and sends it to every
+// subscriber, dropping those whose buffer is full rather than waiting on
+// them. Does nothing on a nil receiptEvents
+func (e *receiptEvents) publish(id string, receipt Receipt, points int64) {
+	if e == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.head++
+	event := receiptEvent{
+		Seq:      e.head,
+		ID:       id,
+		Retailer: receipt.Retailer,
+		Points:   points,
+	}
+	e.events = append(e.events, event)
+	// Trimmed in batches so publishing stays cheap, keeping between retain and twice that
+	if len(e.events) >= 2*e.retain {
+		e.events = append(e.events[:0:0], e.events[len(e.events)-e.retain:]...)
+	}
+
+	for subscriber := range e.subscribers {
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(e.subscribers, subscriber)
+			close(subscriber.dropped)
+		}
+	}
+}
+
+// Subscribes a client resuming after the event lastEventID names, or from
+// now if it names none. Returns the retained events it missed, and false if
+// some it missed are no longer retained or are from an earlier run
+func (e *receiptEvents) subscribe(lastEventID string) (*eventSubscriber, []receiptEvent, bool) {
+	subscriber := &eventSubscriber{
+		events:  make(chan receiptEvent, eventSubscriberBuffer),
+		dropped: make(chan struct{}),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.subscribers[subscriber] = struct{}{}
+	if lastEventID == "" {
+		return subscriber, nil, true
+	}
+
+	epoch, seqParam, _ := strings.Cut(lastEventID, ".")
+	after, err := strconv.ParseUint(seqParam, 10, 64)
+	if err != nil || epoch != e.epoch || after > e.head {
+		return subscriber, nil, false
+	}
+
+	// Retained events run up to head without gaps
+	oldest := e.head - uint64(len(e.events)) + 1
+	if after+1 < oldest {
+		return subscriber, append([]receiptEvent{}, e.events...), false
+	}
+	return subscriber, append([]receiptEvent{}, e.events[after+1-oldest:]...), true
+}
+
+func (e *receiptEvents) unsubscribe(subscriber *eventSubscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.subscribers, subscriber)
+}
+
+// ID a client sends back in Last-Event-ID to resume after event
+func (e *receiptEvents) eventID(event receiptEvent) string {
+	return fmt.Sprintf("%v.%v", e.epoch, event.Seq)
+}
+
+// Streams each accepted receipt as a Server-Sent Event. Clients reconnecting
+// with Last-Event-ID first get the events they missed, preceded by a "reset"
+// event if some of them are no longer retained
+func (cfg *apiConfig) handlerReceiptEvents(w http.ResponseWriter, r *http.Request) {
+	if cfg.Events == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Receipt events are not enabled.", nil)
+		return
+	}
+
+	subscriber, missed, complete := cfg.Events.subscribe(r.Header.Get("Last-Event-ID"))
+	defer cfg.Events.unsubscribe(subscriber)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Keeps reverse proxies from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	write := func(message string) bool {
+		controller.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		_, err := fmt.Fprint(w, message)
+		if err == nil {
+			err = controller.Flush()
+		}
+		return err == nil
+	}
+	send := func(event receiptEvent) bool {
+		dat, _ := json.Marshal(event)
+		return write(fmt.Sprintf("id: %v\ndata: %s\n\n", cfg.Events.eventID(event), dat))
+	}
+
+	// Commits the response, even if there is nothing to send yet
+	if !write(": connected\n\n") {
+		return
+	}
+	// Tells the client to reload what it shows, since it missed events
+	if !complete && !write("event: reset\ndata: {}\n\n") {
+		return
+	}
+	for _, event := range missed {
+		if !send(event) {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-subscriber.dropped:
+			return
+		case <-keepAlive.C:
+			if !write(": keep-alive\n\n") {
+				return
+			}
+		case event := <-subscriber.events:
+			if !send(event) {
+				return
+			}
+		}
+	}
+}
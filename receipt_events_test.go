@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Reads the next Server-Sent Event from a stream, skipping comments
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(fields) > 0 {
+			return fields
+		}
+		if name, value, ok := strings.Cut(line, ": "); ok && name != "" {
+			fields[name] = value
+		}
+	}
+}
+
+// Expecting processed receipts to be streamed, and reconnecting clients to resume after the last event they saw
+func TestHandlerReceiptEvents(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:     newMemoryStore(),
+		Events: newReceiptEvents(receiptEventRetention),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("GET /receipts/events", apiCfg.handlerReceiptEvents)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	subscribe := func(lastEventID string) *bufio.Reader {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/receipts/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("handler returned %v %v", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+
+		// Waits until subscribed, so no event is published before
+		reader := bufio.NewReader(res.Body)
+		if line, _ := reader.ReadString('\n'); line != ": connected\n" {
+			t.Fatalf("stream began with %q", line)
+		}
+		reader.ReadString('\n')
+		return reader
+	}
+	process := func() string {
+		t.Helper()
+		dat, err := json.Marshal(newTestReceipt(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.Post(srv.URL+"/receipts/process", "application/json", bytes.NewReader(dat))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var body struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(res.Body).Decode(&body)
+		return body.ID
+	}
+
+	stream := subscribe("")
+	id := process()
+	event := readEvent(t, stream)
+
+	var data receiptEvent
+	err := json.Unmarshal([]byte(event["data"]), &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.ID != id || data.Retailer != "Test Retailer" || data.Points != 89 || event["id"] == "" {
+		t.Errorf("stream sent the wrong event: %v", event)
+	}
+
+	// Expecting a client reconnecting after the first event to get only the second
+	secondID := process()
+	event = readEvent(t, subscribe(event["id"]))
+	if !strings.Contains(event["data"], secondID) {
+		t.Errorf("resumed stream sent the wrong event: %v", event)
+	}
+
+	// Expecting an ID from an earlier run to be answered with a reset
+	resumed := subscribe("00000000-0000-0000-0000-000000000000.1")
+	process()
+	if event := readEvent(t, resumed); event["event"] != "reset" {
+		t.Errorf("stream did not reset: %v", event)
+	}
+}
+
+// Expecting a client that stops reading to be dropped instead of holding up publishing
+func TestReceiptEvents_SlowSubscriber(t *testing.T) {
+	events := newReceiptEvents(receiptEventRetention)
+	slow, _, _ := events.subscribe("")
+	fast, _, _ := events.subscribe("")
+
+	for range eventSubscriberBuffer + 1 {
+		events.publish("00000000-0000-0000-0000-000000000000", newTestReceipt(""), 89)
+		<-fast.events
+	}
+
+	select {
+	case <-slow.dropped:
+	default:
+		t.Error("slow subscriber was not dropped")
+	}
+	select {
+	case <-fast.dropped:
+		t.Error("subscriber keeping up was dropped")
+	default:
+	}
+}
+
+// Expecting resumption to report events that are no longer retained
+func TestReceiptEvents_Resume(t *testing.T) {
+	events := newReceiptEvents(2)
+	for range 5 {
+		events.publish("00000000-0000-0000-0000-000000000000", newTestReceipt(""), 89)
+	}
+	id := func(seq uint64) string {
+		return events.eventID(receiptEvent{Seq: seq})
+	}
+
+	tests := []struct {
+		lastEventID string
+		expected    []uint64
+		complete    bool
+	}{
+		{lastEventID: "", expected: nil, complete: true},
+		{lastEventID: id(2), expected: []uint64{3, 4, 5}, complete: true},
+		{lastEventID: id(5), expected: nil, complete: true},
+		// Trimmed in batches, so a few more than retain may be kept
+		{lastEventID: id(1), expected: []uint64{3, 4, 5}, complete: false},
+		{lastEventID: id(6), expected: nil, complete: false},
+		{lastEventID: "invalid", expected: nil, complete: false},
+	}
+	for _, tc := range tests {
+		_, missed, complete := events.subscribe(tc.lastEventID)
+		var actual []uint64
+		for _, event := range missed {
+			actual = append(actual, event.Seq)
+		}
+		if complete != tc.complete || len(actual) != len(tc.expected) || (len(actual) > 0 && actual[0] != tc.expected[0]) {
+			t.Errorf("Last-Event-ID %q\nexpected: %v %v\nactual: %v %v", tc.lastEventID, tc.expected, tc.complete, actual, complete)
+		}
+	}
+}
+
+// Store whose receipts report a fixed number of points, as if scored under other rules
+type fixedPointsStore struct {
+	*memoryStore
+	points int64
+}
+
+func (s fixedPointsStore) GetRecord(ctx context.Context, id string) (ReceiptRecord, error) {
+	record, err := s.memoryStore.GetRecord(ctx, id)
+	if err == nil {
+		record.Revisions[0].Points = &ReceiptPoints{Points: s.points}
+	}
+	return record, err
+}
+
+// Expecting processed receipts to be announced with the points they were stored with, not scored again
+func TestHandlerProcessReceipts_AnnouncesStoredPoints(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:     fixedPointsStore{memoryStore: newMemoryStore(), points: 1000},
+		Events: newReceiptEvents(receiptEventRetention),
+	}
+	processedID(t, postTestReceipt(t, &apiCfg, newTestReceipt(""), ""))
+
+	if len(apiCfg.Events.events) != 1 || apiCfg.Events.events[0].Points != 1000 {
+		t.Errorf("handler announced %+v, expected 1000 points", apiCfg.Events.events)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filters for ReceiptStore.Find. Zero fields match everything
+type ReceiptQuery struct {
+	// Matched against the retailer after normalizeRetailer
+	Retailer string
+
+	// Inclusive purchase date bounds, only the date part is used
+	PurchasedFrom time.Time
+	PurchasedTo   time.Time
+
+	// Inclusive points bounds
+	MinPoints *int64
+	MaxPoints *int64
+
+	// Inclusive total bounds, in cents
+	MinTotal *int64
+	MaxTotal *int64
+}
+
+// Orders ReceiptStore.Page can list receipts in. Receipts with equal keys
+// are ordered by ID, so every order is stable
+type ReceiptOrder string
+
+const (
+	// By when the receipt was first submitted
+	OrderSubmitted ReceiptOrder = "submitted"
+
+	// By the points awarded to its latest revision
+	OrderPoints ReceiptOrder = "points"
+)
+
+// Parameters for ReceiptStore.Page
+type ReceiptPageRequest struct {
+	Query      ReceiptQuery
+	Order      ReceiptOrder
+	Descending bool
+
+	// Lists the receipts after this one, from the start when nil
+	After *ReceiptCursor
+
+	Limit int
+}
+
+// Position in a paged listing: the order key and ID of the last receipt returned
+type ReceiptCursor struct {
+	Key int64  `json:"key"`
+	ID  string `json:"id"`
+}
+
+// One page of receipts. Next is nil on the last page
+type ReceiptPage struct {
+	Records []ReceiptRecord
+	Next    *ReceiptCursor
+}
+
+// Secondary indexes over the latest revision of every live receipt, so a
+// query costs in proportion to its result rather than to the store.
+// Soft-deleted receipts are not indexed. Not safe for concurrent use, the
+// owning memoryStore's lock guards it
+type receiptIndex struct {
+	entries    map[string]indexEntry
+	byRetailer map[string]map[string]struct{}
+	byDate     rangeIndex
+	byPoints   rangeIndex
+	byTotal    rangeIndex
+
+	// Only used for ordering
+	bySubmitted rangeIndex
+}
+
+// Keys a receipt was indexed under, kept so it can be unindexed exactly
+type indexEntry struct {
+	retailer string
+	date     int64
+	hasDate  bool
+	points   int64
+	total    int64
+	hasTotal bool
+
+	// First submission time, in microseconds since the Unix epoch
+	submitted int64
+}
+
+// IDs grouped by an integer key, with the distinct keys kept sorted for range
+// scans and each key's IDs kept sorted so paging can start at a cursor
+type rangeIndex struct {
+	keys []int64
+	ids  map[int64][]string
+
+	// Set while bulk loading, when keys and IDs are appended and sorted once at the end
+	unsorted bool
+}
+
+func newReceiptIndex() *receiptIndex {
+	return &receiptIndex{
+		entries:    make(map[string]indexEntry),
+		byRetailer: make(map[string]map[string]struct{}),
+		byDate:     rangeIndex{ids: make(map[int64][]string)},
+		byPoints:   rangeIndex{ids: make(map[int64][]string)},
+		byTotal:    rangeIndex{ids: make(map[int64][]string)},
+
+		bySubmitted: rangeIndex{ids: make(map[int64][]string)},
+	}
+}
+
+// Lower-cases the retailer and collapses runs of whitespace, so
+// "M&M  Corner Market" and "m&m corner market" index together
+func normalizeRetailer(retailer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(retailer), " "))
+}
+
+// Parses a purchase date into days since the Unix epoch
+func purchaseDay(purchaseDate string) (int64, bool) {
+	date, err := time.Parse(time.DateOnly, purchaseDate)
+	if err != nil {
+		return 0, false
+	}
+	return dayOf(date), true
+}
+
+// Days since the Unix epoch of t's calendar date
+func dayOf(t time.Time) int64 {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+}
+
+// Parses a total such as "35.35" into cents
+func totalCents(total string) (int64, bool) {
+	whole, fraction, ok := strings.Cut(total, ".")
+	if !ok || len(fraction) != 2 {
+		return 0, false
+	}
+
+	dollars, err := strconv.ParseUint(whole, 10, 63)
+	if err != nil || dollars > math.MaxInt64/100-1 {
+		return 0, false
+	}
+	cents, err := strconv.ParseUint(fraction, 10, 8)
+	if err != nil {
+		return 0, false
+	}
+	return int64(dollars)*100 + int64(cents), true
+}
+
+// Indexes every record, sorting the keys and IDs of each range index once rather
+// than inserting them one at a time, which is quadratic in their number
+func buildReceiptIndex(records map[string]ReceiptRecord) *receiptIndex {
+	x := newReceiptIndex()
+	ranges := []*rangeIndex{&x.byDate, &x.byPoints, &x.byTotal, &x.bySubmitted}
+
+	for _, r := range ranges {
+		r.unsorted = true
+	}
+	for _, record := range records {
+		x.add(record)
+	}
+	for _, r := range ranges {
+		slices.Sort(r.keys)
+		for _, ids := range r.ids {
+			slices.Sort(ids)
+		}
+		r.unsorted = false
+	}
+	return x
+}
+
+// Indexes the latest revision of record, replacing whatever was indexed under its ID
+func (x *receiptIndex) add(record ReceiptRecord) {
+	x.remove(record.ID)
+	if record.DeletedAt != nil {
+		return
+	}
+
+	latest := record.Latest()
+	receipt := latest.Receipt
+	entry := indexEntry{
+		retailer: normalizeRetailer(receipt.Retailer),
+		points:   latest.Score().Points,
+
+		submitted: record.Revisions[0].CreatedAt.UnixMicro(),
+	}
+	entry.date, entry.hasDate = purchaseDay(receipt.PurchaseDate)
+	entry.total, entry.hasTotal = totalCents(receipt.Total)
+
+	x.entries[record.ID] = entry
+	addID(x.byRetailer, entry.retailer, record.ID)
+	if entry.hasDate {
+		x.byDate.add(entry.date, record.ID)
+	}
+	x.byPoints.add(entry.points, record.ID)
+	if entry.hasTotal {
+		x.byTotal.add(entry.total, record.ID)
+	}
+	x.bySubmitted.add(entry.submitted, record.ID)
+}
+
+// Drops id from every index, if it is indexed
+func (x *receiptIndex) remove(id string) {
+	entry, ok := x.entries[id]
+	if !ok {
+		return
+	}
+
+	delete(x.entries, id)
+	removeID(x.byRetailer, entry.retailer, id)
+	if entry.hasDate {
+		x.byDate.remove(entry.date, id)
+	}
+	x.byPoints.remove(entry.points, id)
+	if entry.hasTotal {
+		x.byTotal.remove(entry.total, id)
+	}
+	x.bySubmitted.remove(entry.submitted, id)
+}
+
+// Returns the IDs of indexed receipts matching query, in no particular order.
+// Candidates come from the most selective index the query uses and are then
+// checked against the remaining filters
+func (x *receiptIndex) find(query ReceiptQuery) []string {
+	bounds := newIndexBounds(query)
+
+	var ids []string
+	collect := func(id string) {
+		if bounds.matches(x.entries[id]) {
+			ids = append(ids, id)
+		}
+	}
+
+	switch {
+	case bounds.retailer != "":
+		for id := range x.byRetailer[bounds.retailer] {
+			collect(id)
+		}
+	case bounds.byDate:
+		x.byDate.scan(bounds.fromDay, bounds.toDay, collect)
+	case bounds.byTotal:
+		x.byTotal.scan(bounds.minTotal, bounds.maxTotal, collect)
+	default:
+		x.byPoints.scan(bounds.minPoints, bounds.maxPoints, collect)
+	}
+
+	return ids
+}
+
+// Returns the positions of up to limit+1 indexed receipts matching the
+// request, in its order. The extra one tells the caller whether there is a
+// next page. Filtered requests are served from find and sorted; unfiltered
+// ones walk the order's index from the cursor, searching the cursor's key for
+// its ID, so either way the cost follows the matches or the page size rather
+// than the number of stored receipts or receipts sharing a key
+func (x *receiptIndex) page(request ReceiptPageRequest) []ReceiptCursor {
+	bounds := newIndexBounds(request.Query)
+	byKey := &x.bySubmitted
+	key := func(entry indexEntry) int64 { return entry.submitted }
+	if request.Order == OrderPoints {
+		byKey = &x.byPoints
+		key = func(entry indexEntry) int64 { return entry.points }
+	}
+
+	compare := func(a, b ReceiptCursor) int {
+		c := cmp.Or(cmp.Compare(a.Key, b.Key), strings.Compare(a.ID, b.ID))
+		if request.Descending {
+			return -c
+		}
+		return c
+	}
+	afterCursor := func(position ReceiptCursor) bool {
+		return request.After == nil || compare(position, *request.After) > 0
+	}
+
+	var positions []ReceiptCursor
+	if bounds.filtered() {
+		for _, id := range x.find(request.Query) {
+			position := ReceiptCursor{Key: key(x.entries[id]), ID: id}
+			if afterCursor(position) {
+				positions = append(positions, position)
+			}
+		}
+		slices.SortFunc(positions, compare)
+		return positions[:min(len(positions), request.Limit+1)]
+	}
+
+	// Walks keys from the cursor's, in the requested direction
+	step := 1
+	i := 0
+	if request.After != nil {
+		i, _ = slices.BinarySearch(byKey.keys, request.After.Key)
+	}
+	if request.Descending {
+		step = -1
+		if request.After == nil {
+			i = len(byKey.keys) - 1
+		} else if i == len(byKey.keys) || byKey.keys[i] != request.After.Key {
+			i--
+		}
+	}
+
+	for ; i >= 0 && i < len(byKey.keys) && len(positions) <= request.Limit; i += step {
+		key := byKey.keys[i]
+		ids := byKey.ids[key]
+
+		// Within the cursor's key, only the IDs past the cursor's
+		lo, hi := 0, len(ids)
+		if request.After != nil && key == request.After.Key {
+			j, found := slices.BinarySearch(ids, request.After.ID)
+			if request.Descending {
+				hi = j
+			} else if found {
+				lo = j + 1
+			} else {
+				lo = j
+			}
+		}
+
+		for n := 0; n < hi-lo && len(positions) <= request.Limit; n++ {
+			j := lo + n
+			if request.Descending {
+				j = hi - 1 - n
+			}
+			positions = append(positions, ReceiptCursor{Key: key, ID: ids[j]})
+		}
+	}
+	return positions
+}
+
+// A ReceiptQuery resolved to index keys
+type indexBounds struct {
+	retailer             string
+	byDate               bool
+	fromDay, toDay       int64
+	minPoints, maxPoints int64
+	byTotal              bool
+	minTotal, maxTotal   int64
+}
+
+func newIndexBounds(query ReceiptQuery) indexBounds {
+	bounds := indexBounds{
+		retailer:  normalizeRetailer(query.Retailer),
+		fromDay:   math.MinInt64,
+		toDay:     math.MaxInt64,
+		minPoints: math.MinInt64,
+		maxPoints: math.MaxInt64,
+		minTotal:  math.MinInt64,
+		maxTotal:  math.MaxInt64,
+	}
+
+	if !query.PurchasedFrom.IsZero() {
+		bounds.byDate = true
+		bounds.fromDay = dayOf(query.PurchasedFrom)
+	}
+	if !query.PurchasedTo.IsZero() {
+		bounds.byDate = true
+		bounds.toDay = dayOf(query.PurchasedTo)
+	}
+	if query.MinPoints != nil {
+		bounds.minPoints = *query.MinPoints
+	}
+	if query.MaxPoints != nil {
+		bounds.maxPoints = *query.MaxPoints
+	}
+	if query.MinTotal != nil {
+		bounds.byTotal = true
+		bounds.minTotal = *query.MinTotal
+	}
+	if query.MaxTotal != nil {
+		bounds.byTotal = true
+		bounds.maxTotal = *query.MaxTotal
+	}
+
+	return bounds
+}
+
+// Whether an indexed receipt is within every bound
+func (b indexBounds) matches(entry indexEntry) bool {
+	if b.retailer != "" && entry.retailer != b.retailer {
+		return false
+	}
+	if b.byDate && (!entry.hasDate || entry.date < b.fromDay || entry.date > b.toDay) {
+		return false
+	}
+	if b.byTotal && (!entry.hasTotal || entry.total < b.minTotal || entry.total > b.maxTotal) {
+		return false
+	}
+	return entry.points >= b.minPoints && entry.points <= b.maxPoints
+}
+
+// Whether any bound excludes receipts
+func (b indexBounds) filtered() bool {
+	return b.retailer != "" || b.byDate || b.byTotal || b.minPoints != math.MinInt64 || b.maxPoints != math.MaxInt64
+}
+
+func (x *rangeIndex) add(key int64, id string) {
+	ids, ok := x.ids[key]
+	if x.unsorted {
+		if !ok {
+			x.keys = append(x.keys, key)
+		}
+		x.ids[key] = append(ids, id)
+		return
+	}
+
+	if !ok {
+		i, _ := slices.BinarySearch(x.keys, key)
+		x.keys = slices.Insert(x.keys, i, key)
+	}
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		x.ids[key] = slices.Insert(ids, i, id)
+	}
+}
+
+func (x *rangeIndex) remove(key int64, id string) {
+	ids := x.ids[key]
+	i, found := slices.BinarySearch(ids, id)
+	if !found {
+		return
+	}
+	if len(ids) > 1 {
+		x.ids[key] = slices.Delete(ids, i, i+1)
+		return
+	}
+
+	delete(x.ids, key)
+	i, found = slices.BinarySearch(x.keys, key)
+	if found {
+		x.keys = slices.Delete(x.keys, i, i+1)
+	}
+}
+
+// Calls fn with every ID whose key is within [lo, hi]
+func (x *rangeIndex) scan(lo, hi int64, fn func(id string)) {
+	i, _ := slices.BinarySearch(x.keys, lo)
+	for ; i < len(x.keys) && x.keys[i] <= hi; i++ {
+		for _, id := range x.ids[x.keys[i]] {
+			fn(id)
+		}
+	}
+}
+
+func addID[K comparable](sets map[K]map[string]struct{}, key K, id string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		sets[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+// Removes id from the set under key, dropping the set once it is empty
+func removeID[K comparable](sets map[K]map[string]struct{}, key K, id string) {
+	set := sets[key]
+	delete(set, id)
+	if len(set) == 0 {
+		delete(sets, key)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const benchmarkReceipts = 1_000_000
+
+var (
+	benchmarkStoreOnce sync.Once
+	benchmarkStore     *memoryStore
+)
+
+// A memoryStore holding 1M receipts spread over 1000 retailers and 1000
+// purchase days, submitted a second apart
+func newBenchmarkStore(b *testing.B) *memoryStore {
+	benchmarkStoreOnce.Do(func() {
+		start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		createdAt := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+
+		records := make([]ReceiptRecord, 0, benchmarkReceipts)
+		for i := range benchmarkReceipts {
+			receipt := newTestReceipt(fmt.Sprintf("%08d-0000-0000-0000-000000000000", i))
+			receipt.Retailer = fmt.Sprintf("Retailer %v", i%1000)
+			receipt.PurchaseDate = start.AddDate(0, 0, i%1000).Format(time.DateOnly)
+			receipt.Total = fmt.Sprintf("%v.%02d", i%100, i%100)
+			records = append(records, newReceiptRecord(receipt, createdAt.Add(time.Duration(i)*time.Second)))
+		}
+
+		benchmarkStore = newMemoryStore()
+		err := benchmarkStore.Replace(context.Background(), records)
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+	return benchmarkStore
+}
+
+// Expecting pages through receipts that share a key to resume at the cursor
+// in either direction, however the index was built
+func TestReceiptIndex_PageSharedKey(t *testing.T) {
+	createdAt := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+	records := map[string]ReceiptRecord{}
+	for i := range 25 {
+		// Inserted out of order, all scoring the same
+		id := fmt.Sprintf("00000000-0000-0000-0000-0000000000%02d", (i*7)%25)
+		records[id] = newReceiptRecord(newTestReceipt(id), createdAt)
+	}
+	other := newTestReceipt("10000000-0000-0000-0000-000000000000")
+	other.Retailer = "Walgreens"
+	records[other.ID] = newReceiptRecord(other, createdAt)
+
+	added := newReceiptIndex()
+	for _, record := range records {
+		added.add(record)
+	}
+	indexes := map[string]*receiptIndex{"built": buildReceiptIndex(records), "added": added}
+
+	for name, x := range indexes {
+		for _, descending := range []bool{false, true} {
+			expected := make([]ReceiptCursor, 0, len(records))
+			for id, entry := range x.entries {
+				expected = append(expected, ReceiptCursor{Key: entry.points, ID: id})
+			}
+			slices.SortFunc(expected, func(a, b ReceiptCursor) int {
+				c := cmp.Or(cmp.Compare(a.Key, b.Key), strings.Compare(a.ID, b.ID))
+				if descending {
+					return -c
+				}
+				return c
+			})
+
+			var actual []ReceiptCursor
+			request := ReceiptPageRequest{Order: OrderPoints, Descending: descending, Limit: 4}
+			for {
+				page := x.page(request)
+				actual = append(actual, page[:min(len(page), request.Limit)]...)
+				if len(page) <= request.Limit {
+					break
+				}
+				request.After = &page[request.Limit-1]
+			}
+			if !slices.Equal(actual, expected) {
+				t.Errorf("%v index, descending %v: paged\n%v\nexpected\n%v", name, descending, actual, expected)
+			}
+		}
+	}
+}
+
+// Lookups against 1M stored receipts, next to the full scan the indexes replace.
+// The queries match 1000 (retailer), 7000 (a week of purchase dates) and 42000 (points) receipts
+func BenchmarkFind(b *testing.B) {
+	ctx := context.Background()
+	store := newBenchmarkStore(b)
+	points := scoreReceipt(store.records["00000042-0000-0000-0000-000000000000"].Latest().Receipt).Points
+
+	queries := map[string]ReceiptQuery{
+		"Retailer": {
+			Retailer: "retailer 42",
+		},
+		"PurchaseDate": {
+			PurchasedFrom: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+			PurchasedTo:   time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC),
+		},
+		"Points": {
+			MinPoints: &points,
+			MaxPoints: &points,
+		},
+	}
+	for name, query := range queries {
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				_, err := store.Find(ctx, query)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("RetailerFullScan", func(b *testing.B) {
+		for range b.N {
+			receipts, err := store.List(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var found []Receipt
+			for _, receipt := range receipts {
+				if normalizeRetailer(receipt.Retailer) == "retailer 42" {
+					found = append(found, receipt)
+				}
+			}
+		}
+	})
+}
+
+// Pages of 50 from deep within 1M stored receipts, unfiltered and filtered
+func BenchmarkPage(b *testing.B) {
+	ctx := context.Background()
+	store := newBenchmarkStore(b)
+	middle := store.records["00500000-0000-0000-0000-000000000000"]
+
+	requests := map[string]ReceiptPageRequest{
+		"Submitted": {
+			Order: OrderSubmitted,
+			After: &ReceiptCursor{Key: middle.Revisions[0].CreatedAt.UnixMicro(), ID: middle.ID},
+		},
+		"Points": {
+			Order: OrderPoints,
+			After: &ReceiptCursor{Key: middle.Latest().Score().Points, ID: middle.ID},
+		},
+		"RetailerByPoints": {
+			Query: ReceiptQuery{Retailer: "retailer 42"},
+			Order: OrderPoints,
+		},
+	}
+	for name, request := range requests {
+		request.Limit = 50
+		b.Run(name, func(b *testing.B) {
+			for range b.N {
+				page, err := store.Page(ctx, request)
+				if err != nil || len(page.Records) != request.Limit {
+					b.Fatal(len(page.Records), err)
+				}
+			}
+		})
+	}
+}
+
+// Inserts into a store already holding 1M receipts, index maintenance included
+func BenchmarkPutIndexed(b *testing.B) {
+	ctx := context.Background()
+	store := newBenchmarkStore(b)
+
+	b.ResetTimer()
+	for i := range b.N {
+		receipt := newTestReceipt(fmt.Sprintf("bench-%v", i))
+		err := store.Put(ctx, receipt)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	for i := range b.N {
+		store.Remove(ctx, fmt.Sprintf("bench-%v", i))
+	}
+}
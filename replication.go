@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Changes kept for followers to catch up from. A follower further behind
+// starts over from a snapshot. Only IDs are kept, records are read from the
+// store when changes are served
+const changeLogRetention = 100_000
+
+// Longest a follower's request for changes is held open waiting for one
+const changesMaxWait = time.Minute
+
+// One mutation of a store, as streamed to followers
+type change struct {
+	Seq uint64    `json:"seq"`
+	At  time.Time `json:"at"`
+	ID  string    `json:"id"`
+
+	// The record as it is when the change is served, nil if it was removed.
+	// Never set in the changeLog, so it holds no receipts itself
+	Record *ReceiptRecord `json:"record"`
+}
+
+// Sequence numbered log of the most recent changes to a store. The epoch
+// identifies one run of the store, since sequence numbers restart with it
+type changeLog struct {
+	epoch  string
+	retain int
+
+	mu      sync.Mutex
+	head    uint64
+	changes []change
+
+	// Closed and replaced whenever head moves, to wake waiting followers
+	notify chan struct{}
+}
+
+func newChangeLog(retain int) *changeLog {
+	return &changeLog{
+		epoch:  uuid.New().String(),
+		retain: retain,
+		notify: make(chan struct{}),
+	}
+}
+
+// Records that id was stored or removed
+func (l *changeLog) append(id string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.head++
+	l.changes = append(l.changes, change{
+		Seq: l.head,
+		At:  at,
+		ID:  id,
+	})
+	// Trimmed in batches so appends stay cheap, keeping between retain and twice that
+	if len(l.changes) >= 2*l.retain {
+		l.changes = append(l.changes[:0:0], l.changes[len(l.changes)-l.retain:]...)
+	}
+	l.wake()
+}
+
+// Drops every retained change, so every follower starts over from a
+// snapshot. Used when the whole store is replaced
+func (l *changeLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.head++
+	l.changes = nil
+	l.wake()
+}
+
+// Called with the lock held
+func (l *changeLog) wake() {
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+func (l *changeLog) headSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.head
+}
+
+// Returns the changes after seq after and the current head. ok is false if
+// some of them are no longer retained
+func (l *changeLog) since(after uint64) (changes []change, head uint64, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if after >= l.head {
+		return nil, l.head, after == l.head
+	}
+
+	// Retained changes run up to head without gaps
+	oldest := l.head - uint64(len(l.changes)) + 1
+	if after+1 < oldest {
+		return nil, l.head, false
+	}
+
+	return append([]change{}, l.changes[after+1-oldest:]...), l.head, true
+}
+
+// Blocks until the log moves past seq after, or ctx is done
+func (l *changeLog) wait(ctx context.Context, after uint64) {
+	l.mu.Lock()
+	head, notify := l.head, l.notify
+	l.mu.Unlock()
+
+	if head != after {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-notify:
+	}
+}
+
+// Implemented by stores that log their changes for followers
+type replicationSource interface {
+	// The store's change log
+	changeLog() *changeLog
+
+	// Every stored record, and the change log head they reflect
+	replicationSnapshot() ([]ReceiptRecord, uint64)
+
+	// The changes after seq after with their records, as changeLog.since
+	replicationChanges(after uint64) (changes []change, head uint64, ok bool)
+}
+
+// Serves every stored record and the change log position they reflect,
+// so a follower can start tailing changes from there
+func (cfg *apiConfig) handlerReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	source, ok := cfg.DB.(replicationSource)
+	if !ok {
+		respondWithError(w, r, http.StatusNotImplemented, "This store does not support replication.", nil)
+		return
+	}
+
+	records, seq := source.replicationSnapshot()
+
+	type ResponseBody struct {
+		Epoch   string          `json:"epoch"`
+		Seq     uint64          `json:"seq"`
+		Records []ReceiptRecord `json:"records"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Epoch:   source.changeLog().epoch,
+		Seq:     seq,
+		Records: records,
+	})
+}
+
+// Serves the changes after "?after=", holding the request open for up to
+// "?wait=" until there is one. Answers 410 Gone if some of them are no
+// longer retained, so the follower starts over from a snapshot
+func (cfg *apiConfig) handlerReplicationChanges(w http.ResponseWriter, r *http.Request) {
+	source, ok := cfg.DB.(replicationSource)
+	if !ok {
+		respondWithError(w, r, http.StatusNotImplemented, "This store does not support replication.", nil)
+		return
+	}
+	changeLog := source.changeLog()
+
+	after, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The after parameter is invalid.", err)
+		return
+	}
+
+	var wait time.Duration
+	if waitParam := r.URL.Query().Get("wait"); waitParam != "" {
+		wait, err = time.ParseDuration(waitParam)
+		if err != nil || wait < 0 {
+			respondWithError(w, r, http.StatusBadRequest, "The wait parameter is invalid.", err)
+			return
+		}
+	}
+
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), min(wait, changesMaxWait))
+		changeLog.wait(ctx, after)
+		cancel()
+	}
+
+	changes, head, ok := source.replicationChanges(after)
+	if !ok {
+		respondWithError(w, r, http.StatusGone, "Those changes are no longer retained.", nil)
+		return
+	}
+
+	type ResponseBody struct {
+		Epoch   string   `json:"epoch"`
+		Head    uint64   `json:"head"`
+		Changes []change `json:"changes"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Epoch:   changeLog.epoch,
+		Head:    head,
+		Changes: append([]change{}, changes...),
+	})
+}
+
+// Reports whether this instance is a primary or a follower and, for
+// followers, how far behind the primary they are
+func (cfg *apiConfig) handlerReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	if cfg.Follower != nil {
+		respond(w, r, http.StatusOK, cfg.Follower.status())
+		return
+	}
+
+	type ResponseBody struct {
+		Role  string `json:"role"`
+		Epoch string `json:"epoch,omitempty"`
+		Head  uint64 `json:"head"`
+	}
+
+	body := ResponseBody{
+		Role: "primary",
+	}
+	if source, ok := cfg.DB.(replicationSource); ok {
+		body.Epoch = source.changeLog().epoch
+		body.Head = source.changeLog().headSeq()
+	}
+	respond(w, r, http.StatusOK, body)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Serves the replication routes of a primary holding store
+func newTestPrimary(t *testing.T, store ReceiptStore) *httptest.Server {
+	apiCfg := apiConfig{
+		DB:         store,
+		AdminToken: "secret",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("GET /replication/snapshot", apiCfg.requireAdmin(apiCfg.handlerReplicationSnapshot))
+	mux.HandleFunc("GET /replication/changes", apiCfg.requireAdmin(apiCfg.handlerReplicationChanges))
+
+	root := http.NewServeMux()
+	mountAPIVersion(root, apiVersionPrefix, mux)
+	root.Handle("/", mux)
+
+	srv := httptest.NewServer(root)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Polls until cond holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Expecting writes, deletes and replacements on the primary to reach the follower
+func TestFollower_TailsPrimary(t *testing.T) {
+	ctx := context.Background()
+	primary := newMemoryStore()
+	err := primary.Put(ctx, newTestReceipt("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestPrimary(t, primary)
+
+	replica := newMemoryStore()
+	follower, err := newFollower(srv.URL, "secret", replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	go follower.run(runCtx)
+
+	// Expecting receipts stored before the follower started to come from the snapshot
+	waitFor(t, "snapshot", func() bool {
+		_, err := replica.Get(ctx, "00000000-0000-0000-0000-000000000000")
+		return err == nil
+	})
+
+	err = primary.Put(ctx, newTestReceipt("10000000-2000-3000-4000-500000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "put", func() bool {
+		_, err := replica.Get(ctx, "10000000-2000-3000-4000-500000000000")
+		return err == nil
+	})
+
+	// Expecting a delete to replicate as a tombstone
+	err = primary.Delete(ctx, "00000000-0000-0000-0000-000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "delete", func() bool {
+		_, err := replica.Get(ctx, "00000000-0000-0000-0000-000000000000")
+		return errors.Is(err, ErrReceiptDeleted)
+	})
+
+	err = primary.Remove(ctx, "00000000-0000-0000-0000-000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "remove", func() bool {
+		_, err := replica.Get(ctx, "00000000-0000-0000-0000-000000000000")
+		return errors.Is(err, ErrReceiptNotFound)
+	})
+
+	// Expecting a replaced store to be loaded again from a snapshot
+	err = primary.Replace(ctx, []ReceiptRecord{newTestRecord("20000000-0000-0000-0000-000000000000")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "resync", func() bool {
+		receipts, err := replica.List(ctx)
+		return err == nil && len(receipts) == 1 && receipts[0].ID == "20000000-0000-0000-0000-000000000000"
+	})
+
+	status := follower.status()
+	if !status.Loaded || status.LagChanges != 0 || status.Epoch != primary.changeLog().epoch {
+		t.Errorf("follower reported wrong status: %+v", status)
+	}
+}
+
+// Expecting a follower to keep following a primary from before API versioning
+func TestFollower_UnversionedPrimary(t *testing.T) {
+	ctx := context.Background()
+	primary := newMemoryStore()
+	err := primary.Put(ctx, newTestReceipt("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apiCfg := apiConfig{
+		DB:         primary,
+		AdminToken: "secret",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /replication/snapshot", apiCfg.requireAdmin(apiCfg.handlerReplicationSnapshot))
+	mux.HandleFunc("GET /replication/changes", apiCfg.requireAdmin(apiCfg.handlerReplicationChanges))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	replica := newMemoryStore()
+	follower, err := newFollower(srv.URL, "secret", replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+	go follower.run(runCtx)
+
+	waitFor(t, "snapshot", func() bool {
+		_, err := replica.Get(ctx, "00000000-0000-0000-0000-000000000000")
+		return err == nil
+	})
+	err = primary.Put(ctx, newTestReceipt("10000000-2000-3000-4000-500000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "put", func() bool {
+		_, err := replica.Get(ctx, "10000000-2000-3000-4000-500000000000")
+		return err == nil
+	})
+}
+
+// Expecting a follower to report how far behind the primary it is
+func TestHandlerReplicationStatus(t *testing.T) {
+	follower, err := newFollower("http://localhost:8080", "secret", newMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiCfg := apiConfig{
+		DB:       follower.store,
+		Follower: follower,
+	}
+
+	getStatus := func() followerStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		apiCfg.handlerReplicationStatus(w, httptest.NewRequest(http.MethodGet, "/replication/status", nil))
+
+		var status followerStatus
+		err := json.NewDecoder(w.Body).Decode(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if status := getStatus(); status.Role != "follower" || status.Loaded || status.LagSeconds > 60 {
+		t.Errorf("handler reported a follower without a snapshot as loaded, or lagging since before it started: %+v", status)
+	}
+
+	now := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+	follower.now = func() time.Time { return now }
+	follower.epoch = "epoch"
+	follower.applied = 3
+	follower.contacted(3)
+
+	if status := getStatus(); status.LagChanges != 0 || status.LagSeconds != 0 {
+		t.Errorf("handler reported lag for a caught up follower: %+v", status)
+	}
+
+	// Two changes behind for ten seconds
+	now = now.Add(10 * time.Second)
+	follower.contacted(5)
+
+	status := getStatus()
+	if status.Applied != 3 || status.PrimaryHead != 5 || status.LagChanges != 2 || status.LagSeconds != 10 {
+		t.Errorf("handler reported wrong lag: %+v", status)
+	}
+
+	// Expecting a primary to report its own position
+	apiCfg.Follower = nil
+	w := httptest.NewRecorder()
+	apiCfg.handlerReplicationStatus(w, httptest.NewRequest(http.MethodGet, "/replication/status", nil))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"role":"primary"`)) {
+		t.Errorf("handler returned %v %s", w.Code, w.Body.String())
+	}
+}
+
+// Expecting reads to be served locally and writes to be forwarded to the primary
+func TestFollower_ForwardWrites(t *testing.T) {
+	ctx := context.Background()
+	primary := newMemoryStore()
+	srv := newTestPrimary(t, primary)
+
+	follower, err := newFollower(srv.URL, "secret", newMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiCfg := apiConfig{
+		DB: follower.store,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	handler := follower.forwardWrites(mux)
+
+	dat, err := json.Marshal(newTestReceipt(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receipts/process", bytes.NewReader(dat)))
+	if w.Code != http.StatusOK || w.Header().Get("Forwarded-To-Primary") != "true" {
+		t.Fatalf("handler did not forward the write: %v %s", w.Code, w.Body.String())
+	}
+
+	var body struct {
+		ID string `json:"id"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.Get(ctx, body.ID); err != nil {
+		t.Errorf("primary did not store the forwarded receipt: %v", err)
+	}
+	if _, err := follower.store.Get(ctx, body.ID); !errors.Is(err, ErrReceiptNotFound) {
+		t.Errorf("follower stored the forwarded receipt itself: %v", err)
+	}
+
+	// Not yet replicated, so the local read misses
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+body.ID+"/points", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("Forwarded-To-Primary") != "" {
+		t.Errorf("handler did not serve the read locally: %v", w.Code)
+	}
+}
+
+// Expecting changes to be served while retained, and 410 Gone once they are not
+func TestHandlerReplicationChanges(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	store.changes = newChangeLog(2)
+	apiCfg := apiConfig{
+		DB: store,
+	}
+
+	for _, id := range []string{
+		"00000000-0000-0000-0000-000000000001",
+		"00000000-0000-0000-0000-000000000002",
+		"00000000-0000-0000-0000-000000000003",
+		"00000000-0000-0000-0000-000000000004",
+		"00000000-0000-0000-0000-000000000005",
+	} {
+		err := store.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getChanges := func(query string) (int, []change) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		apiCfg.handlerReplicationChanges(w, httptest.NewRequest(http.MethodGet, "/replication/changes?"+query, nil))
+
+		var body struct {
+			Head    uint64   `json:"head"`
+			Changes []change `json:"changes"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		return w.Code, body.Changes
+	}
+
+	code, changes := getChanges("after=2")
+	if code != http.StatusOK || len(changes) != 3 || changes[0].Seq != 3 || changes[2].Record.ID != "00000000-0000-0000-0000-000000000005" {
+		t.Errorf("handler returned wrong changes: %v %+v", code, changes)
+	}
+
+	if code, _ := getChanges("after=0"); code != http.StatusGone {
+		t.Errorf("handler returned %v for changes no longer retained, expected %v", code, http.StatusGone)
+	}
+	if code, _ := getChanges("after=6"); code != http.StatusGone {
+		t.Errorf("handler returned %v for changes from the future, expected %v", code, http.StatusGone)
+	}
+	if code, _ := getChanges("after=x"); code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for an invalid position, expected %v", code, http.StatusBadRequest)
+	}
+
+	// Expecting a caught up follower to be held until the wait runs out
+	start := time.Now()
+	code, changes = getChanges("after=5&wait=50ms")
+	if code != http.StatusOK || len(changes) != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("handler did not wait for changes: %v %+v", code, changes)
+	}
+
+	// Expecting a waiting follower to be woken by the next change
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.Delete(ctx, "00000000-0000-0000-0000-000000000005")
+	}()
+	code, changes = getChanges("after=5&wait=10s")
+	if code != http.StatusOK || len(changes) != 1 || changes[0].Record.DeletedAt == nil {
+		t.Errorf("handler returned wrong change: %v %+v", code, changes)
+	}
+}
+
+// Expecting the change log to hold no receipts, so receipts a bounded store
+// evicts are served as removed rather than kept in memory for followers
+func TestHandlerReplicationChanges_Evicted(t *testing.T) {
+	ctx := context.Background()
+	inner := newMemoryStore()
+	apiCfg := apiConfig{
+		DB: newBoundedStore(inner, storeLimits{MaxReceipts: 1}),
+	}
+
+	evicted := newTestReceipt("00000000-0000-0000-0000-000000000001")
+	kept := newTestReceipt("00000000-0000-0000-0000-000000000002")
+	err := apiCfg.DB.Put(ctx, evicted)
+	if err == nil {
+		err = apiCfg.DB.Put(ctx, kept)
+	}
+	if err == nil {
+		_, err = apiCfg.DB.Amend(ctx, kept)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, logged := range inner.changes.changes {
+		if logged.Record != nil {
+			t.Errorf("change log holds the record of %v", logged.ID)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	apiCfg.handlerReplicationChanges(w, httptest.NewRequest(http.MethodGet, "/replication/changes?after=0", nil))
+	var body struct {
+		Head    uint64   `json:"head"`
+		Changes []change `json:"changes"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The evicted receipt was put then removed, the kept one put then amended
+	if body.Head != 4 || len(body.Changes) != 2 {
+		t.Fatalf("handler returned head %v and changes %+v", body.Head, body.Changes)
+	}
+	if body.Changes[0].ID != evicted.ID || body.Changes[0].Record != nil {
+		t.Errorf("handler served the evicted receipt as %+v", body.Changes[0])
+	}
+	if body.Changes[1].ID != kept.ID || body.Changes[1].Seq != 4 || len(body.Changes[1].Record.Revisions) != 2 {
+		t.Errorf("handler served the kept receipt as %+v", body.Changes[1])
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// One revision whose stored points changed in a rescore
+type rescoredRevision struct {
+	Id         string         `json:"id"`
+	Revision   int            `json:"revision"`
+	RescoredAt time.Time      `json:"rescoredAt"`
+	OldPoints  *ReceiptPoints `json:"oldPoints"`
+	NewPoints  ReceiptPoints  `json:"newPoints"`
+}
+
+// Rescores every stored receipt with the current rules, e.g. after a scoring
+// change, and reports the revisions whose points changed
+func (cfg *apiConfig) handlerRecomputePoints(w http.ResponseWriter, r *http.Request) {
+	scanned, rescored, err := rescoreAll(r.Context(), cfg.DB)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to recompute points.", err)
+		return
+	}
+
+	type ResponseBody struct {
+		Scanned  int                `json:"scanned"`
+		Rescored []rescoredRevision `json:"rescored"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Scanned:  scanned,
+		Rescored: append([]rescoredRevision{}, rescored...),
+	})
+}
+
+// Rescores the receipts in store one at a time, so other requests are only
+// held up for a single receipt. Returns how many receipts were scanned and
+// the revisions that were rescored
+func rescoreAll(ctx context.Context, store ReceiptStore) (int, []rescoredRevision, error) {
+	records, err := store.ListRecords(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var rescored []rescoredRevision
+	for _, record := range records {
+		revisions, err := store.Rescore(ctx, record.ID)
+		if errors.Is(err, ErrReceiptNotFound) || errors.Is(err, ErrReceiptGone) {
+			// Removed since it was listed
+			continue
+		}
+		if err != nil {
+			return 0, rescored, err
+		}
+
+		for _, revision := range revisions {
+			change := revision.Rescores[len(revision.Rescores)-1]
+			rescored = append(rescored, rescoredRevision{
+				Id:         record.ID,
+				Revision:   revision.Revision,
+				RescoredAt: change.RescoredAt,
+				OldPoints:  change.OldPoints,
+				NewPoints:  change.NewPoints,
+			})
+		}
+	}
+
+	log.Printf("Rescored %v revisions across %v receipts", len(rescored), len(records))
+	return len(records), rescored, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Expecting the GET to serve stored points, and a recompute to replace stale
+// ones while recording the old and new values
+func TestHandlerRecomputePoints(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	mux.HandleFunc("POST /admin/points/recompute", apiCfg.requireAdmin(apiCfg.handlerRecomputePoints))
+
+	// One receipt scored under older rules, one stored before points were
+	stale := newTestRecord("00000000-0000-0000-0000-000000000000")
+	stale.Revisions[0].Points = &ReceiptPoints{Points: 5, Breakdown: PointsBreakdown{Retailer: 5}}
+	unscored := newTestRecord("10000000-2000-3000-4000-500000000000")
+	current := newTestRecord("20000000-0000-0000-0000-000000000000")
+	current.Revisions[0] = scoredRevision(current.Revisions[0])
+
+	err := apiCfg.DB.Replace(ctx, []ReceiptRecord{stale, unscored, current})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getPoints := func(id string) int64 {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/points", nil))
+
+		var body struct {
+			Points int64 `json:"points"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body.Points
+	}
+
+	if actual := getPoints(stale.ID); actual != 5 {
+		t.Errorf("handler recalculated stored points\nexpected: %v\nactual: %v", 5, actual)
+	}
+
+	recompute := func() (int, []rescoredRevision) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/points/recompute", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+		}
+
+		var body struct {
+			Scanned  int                `json:"scanned"`
+			Rescored []rescoredRevision `json:"rescored"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body.Scanned, body.Rescored
+	}
+
+	scanned, rescored := recompute()
+	if scanned != 3 || len(rescored) != 2 {
+		t.Fatalf("handler returned wrong report, scanned: %v, rescored: %+v", scanned, rescored)
+	}
+	if rescored[0].Id != stale.ID || rescored[0].OldPoints == nil || rescored[0].OldPoints.Points != 5 || rescored[0].NewPoints.Points != 89 {
+		t.Errorf("handler reported wrong change for stale receipt: %+v", rescored[0])
+	}
+	if rescored[1].Id != unscored.ID || rescored[1].OldPoints != nil || rescored[1].NewPoints.Points != 89 {
+		t.Errorf("handler reported wrong change for unscored receipt: %+v", rescored[1])
+	}
+
+	if actual := getPoints(stale.ID); actual != 89 {
+		t.Errorf("handler returned points from before the recompute\nexpected: %v\nactual: %v", 89, actual)
+	}
+
+	// Expecting the change to be kept on the revision
+	record, err := apiCfg.DB.GetRecord(ctx, stale.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rescores := record.Latest().Rescores
+	if len(rescores) != 1 || rescores[0].OldPoints.Points != 5 || rescores[0].NewPoints.Points != 89 {
+		t.Errorf("store did not record the rescore: %+v", rescores)
+	}
+
+	// Expecting nothing left to rescore
+	_, rescored = recompute()
+	if len(rescored) != 0 {
+		t.Errorf("handler rescored up to date receipts: %+v", rescored)
+	}
+}
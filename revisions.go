@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Stores a corrected receipt as a new revision, keeping every previous one
+func (cfg *apiConfig) handlerAmendReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID := r.PathValue("id")
+
+	body, ok := receiptBody(w, r)
+	if !ok {
+		return
+	}
+
+	receipt, err := decodeReceipt(body)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The receipt is invalid.", err)
+		return
+	}
+	receipt.ID = receiptID
+
+	revision, err := cfg.DB.Amend(r.Context(), receipt)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	cfg.Webhooks.notify(webhookReceiptAmended, struct {
+		receiptEvent
+		Revision int `json:"revision"`
+	}{
+		receiptEvent: receiptEvent{ID: receiptID, Retailer: receipt.Retailer, Points: revision.Score().Points},
+		Revision:     revision.Revision,
+	})
+
+	type ResponseBody struct {
+		Id        string    `json:"id"`
+		Revision  int       `json:"revision"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Id:        receiptID,
+		Revision:  revision.Revision,
+		CreatedAt: revision.CreatedAt,
+	})
+}
+
+// Lists every revision of a receipt, oldest first
+func (cfg *apiConfig) handlerGetRevisions(w http.ResponseWriter, r *http.Request) {
+	receiptID := r.PathValue("id")
+
+	record, err := cfg.DB.GetRecord(r.Context(), receiptID)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	if notModified(w, r, recordValidators(record)) {
+		return
+	}
+
+	type ResponseBody struct {
+		Id        string            `json:"id"`
+		Revisions []ReceiptRevision `json:"revisions"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Id:        receiptID,
+		Revisions: record.Revisions,
+	})
+}
+
+// Returns the revision asked for by "?revision=", or the latest one. Responds
+// with an error and returns false if there is no such revision
+func requestedRevision(w http.ResponseWriter, r *http.Request, record ReceiptRecord) (ReceiptRevision, bool) {
+	revisionParam := r.URL.Query().Get("revision")
+	if revisionParam == "" {
+		return record.Latest(), true
+	}
+
+	n, err := strconv.Atoi(revisionParam)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The revision is invalid.", err)
+		return ReceiptRevision{}, false
+	}
+
+	revision, ok := record.Revision(n)
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "No revision found for that receipt.", nil)
+		return ReceiptRevision{}, false
+	}
+	return revision, true
+}
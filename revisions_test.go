@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newRevisionsTestMux(apiCfg *apiConfig) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /receipts/{id}", apiCfg.handlerAmendReceipt)
+	mux.HandleFunc("GET /receipts/{id}/revisions", apiCfg.handlerGetRevisions)
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	return mux
+}
+
+func amendTestReceipt(t *testing.T, mux *http.ServeMux, id string, receipt Receipt) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b bytes.Buffer
+	err := json.NewEncoder(&b).Encode(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/receipts/"+id, &b))
+	return w
+}
+
+// Expecting an amended receipt to be scored at its latest revision, and older revisions on request
+func TestHandlerAmendReceipt_Success(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	mux := newRevisionsTestMux(&apiCfg)
+
+	testReceiptID := "00000000-0000-0000-0000-000000000000"
+	err := apiCfg.DB.Put(context.Background(), newTestReceipt(testReceiptID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amended := newTestReceipt("")
+	amended.Total = "10.01"
+	w := amendTestReceipt(t, mux, testReceiptID, amended)
+	if w.Code != http.StatusOK {
+		t.Fatalf("amend handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+	}
+
+	var amendBody map[string]interface{}
+	err = json.NewDecoder(w.Body).Decode(&amendBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amendBody["id"] != testReceiptID || amendBody["revision"] != float64(2) {
+		t.Errorf("amend handler returned wrong body: %v", amendBody)
+	}
+
+	// Assert points for the latest and the original revision
+	expected := map[string]int64{
+		"":            14,
+		"?revision=2": 14,
+		"?revision=1": 89,
+	}
+	for query, expectedPoints := range expected {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+testReceiptID+"/points"+query, nil))
+
+		var responseBody map[string]int64
+		err = json.NewDecoder(w.Body).Decode(&responseBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseBody["points"] != expectedPoints {
+			t.Errorf("points handler returned incorrect number of points for %q, %v, expected: %v", query, responseBody["points"], expectedPoints)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+testReceiptID+"/revisions", nil))
+
+	var revisionsBody struct {
+		Id        string            `json:"id"`
+		Revisions []ReceiptRevision `json:"revisions"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&revisionsBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisionsBody.Revisions) != 2 || revisionsBody.Revisions[0].Receipt.Total != "10.00" || revisionsBody.Revisions[1].Receipt.Total != "10.01" {
+		t.Errorf("revisions handler returned wrong revisions: %+v", revisionsBody.Revisions)
+	}
+	for _, revision := range revisionsBody.Revisions {
+		if revision.CreatedAt.IsZero() {
+			t.Errorf("revisions handler returned revision without timestamp: %+v", revision)
+		}
+	}
+}
+
+// Expecting invalid amendments and unknown IDs to be rejected
+func TestHandlerAmendReceipt_Rejected(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	mux := newRevisionsTestMux(&apiCfg)
+
+	testReceiptID := "00000000-0000-0000-0000-000000000000"
+	err := apiCfg.DB.Put(context.Background(), newTestReceipt(testReceiptID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := newTestReceipt("")
+	invalid.Total = "ten dollars"
+	w := amendTestReceipt(t, mux, testReceiptID, invalid)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("amend handler returned wrong status code for invalid receipt\nexpected: %v\nactual: %v", http.StatusBadRequest, w.Code)
+	}
+
+	w = amendTestReceipt(t, mux, "10000000-2000-3000-4000-500000000000", newTestReceipt(""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("amend handler returned wrong status code for unknown receipt\nexpected: %v\nactual: %v", http.StatusNotFound, w.Code)
+	}
+
+	record, err := apiCfg.DB.GetRecord(context.Background(), testReceiptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Revisions) != 1 {
+		t.Errorf("rejected amendment added a revision: %+v", record.Revisions)
+	}
+}
+
+// Expecting bad and unknown "?revision=" values to be rejected
+func TestHandlerGetPoints_Revision(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	mux := newRevisionsTestMux(&apiCfg)
+
+	testReceiptID := "00000000-0000-0000-0000-000000000000"
+	err := apiCfg.DB.Put(context.Background(), newTestReceipt(testReceiptID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{
+		"?revision=latest": http.StatusBadRequest,
+		"?revision=0":      http.StatusNotFound,
+		"?revision=2":      http.StatusNotFound,
+	}
+	for query, status := range expected {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+testReceiptID+"/points"+query, nil))
+		if w.Code != status {
+			t.Errorf("points handler returned wrong status code for %q\nexpected: %v\nactual: %v", query, status, w.Code)
+		}
+	}
+}
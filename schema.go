@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// Schema version of the ReceiptRecords this build writes. Every persisted
+// record carries the version it was written at, and older ones are upgraded
+// through schemaMigrations when they are read.
+//
+//	1: a bare Receipt, written before revisions existed
+//	2: a ReceiptRecord holding revisions, written before points were stored
+//	3: revisions carry the points awarded when they were stored
+const receiptSchemaVersion = 3
+
+// Returned when a persisted record cannot be decoded or upgraded. Unlike a
+// torn write this is not repaired by truncation, so stores refuse to open
+var errUnreadableRecord = errors.New("unreadable receipt record")
+
+// Upgrades a record, as generic JSON, from version from to from+1.
+// Migrations work on generic JSON rather than on the current structs so they
+// keep working as those structs change
+type schemaMigration struct {
+	from        int
+	description string
+	migrate     func(record map[string]any) error
+}
+
+// Registry of migrations, one per version, in order
+var schemaMigrations = []schemaMigration{
+	{
+		from:        1,
+		description: "wrap bare receipt as revision 1 of a record",
+		migrate: func(record map[string]any) error {
+			receipt := make(map[string]any, len(record))
+			for key, value := range record {
+				receipt[key] = value
+				delete(record, key)
+			}
+
+			id, _ := receipt["id"].(string)
+			if id == "" {
+				return errors.New("record has no ID")
+			}
+
+			record["id"] = id
+			record["revisions"] = []any{
+				map[string]any{
+					"revision":  1,
+					"createdAt": "0001-01-01T00:00:00Z",
+					"receipt":   receipt,
+				},
+			}
+			return nil
+		},
+	},
+	{
+		from:        2,
+		description: "store points awarded to each revision",
+		migrate: func(record map[string]any) error {
+			revisions, _ := record["revisions"].([]any)
+			for _, value := range revisions {
+				revision, ok := value.(map[string]any)
+				if !ok {
+					return errors.New("malformed revision")
+				}
+				if revision["points"] != nil {
+					continue
+				}
+
+				var receipt Receipt
+				err := remarshal(revision["receipt"], &receipt)
+				if err != nil {
+					return fmt.Errorf("decoding revision receipt: %w", err)
+				}
+				// Scoring assumes a valid receipt, and may panic on a malformed one
+				if problems := receiptProblems(receipt); len(problems) > 0 {
+					return &receiptValidationError{Problems: problems}
+				}
+				revision["points"] = scoreReceipt(receipt)
+			}
+			return nil
+		},
+	},
+}
+
+// Decodes a persisted ReceiptRecord written at any schema version up to the
+// current one, upgrading it as needed
+func decodeReceiptRecord(dat []byte) (ReceiptRecord, error) {
+	var record ReceiptRecord
+
+	// Records at the current version decode directly
+	err := json.Unmarshal(dat, &record)
+	if err == nil && record.SchemaVersion == receiptSchemaVersion {
+		return validDecodedRecord(record)
+	}
+	record = ReceiptRecord{}
+
+	var generic map[string]any
+	err = json.Unmarshal(dat, &generic)
+	if err != nil {
+		return record, fmt.Errorf("%w: %w", errUnreadableRecord, err)
+	}
+
+	version := recordSchemaVersion(generic)
+	if version < 1 || version > receiptSchemaVersion {
+		return record, fmt.Errorf("%w: unsupported schema version %v, this build reads up to %v", errUnreadableRecord, version, receiptSchemaVersion)
+	}
+
+	if version < receiptSchemaVersion {
+		for _, migration := range schemaMigrations[version-1:] {
+			err = migration.migrate(generic)
+			if err != nil {
+				return record, fmt.Errorf("%w: migrating from schema version %v (%v): %w", errUnreadableRecord, migration.from, migration.description, err)
+			}
+		}
+		generic["schemaVersion"] = receiptSchemaVersion
+
+		dat, err = json.Marshal(generic)
+		if err != nil {
+			return record, err
+		}
+	}
+
+	err = json.Unmarshal(dat, &record)
+	if err != nil {
+		return record, fmt.Errorf("%w: %w", errUnreadableRecord, err)
+	}
+	return validDecodedRecord(record)
+}
+
+func validDecodedRecord(record ReceiptRecord) (ReceiptRecord, error) {
+	if record.ID == "" || len(record.Revisions) == 0 {
+		return record, fmt.Errorf("%w: record has no ID or revisions", errUnreadableRecord)
+	}
+	return record, nil
+}
+
+// Version a persisted record was written at. Records from before versions
+// were stored are told apart by their shape
+func recordSchemaVersion(record map[string]any) int {
+	if version, ok := record["schemaVersion"].(float64); ok {
+		return int(version)
+	}
+	if _, ok := record["revisions"]; ok {
+		return 2
+	}
+	return 1
+}
+
+// Converts generic JSON into v
+func remarshal(value any, v any) error {
+	dat, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// Runs the "migrate" command, which upgrades every record in a durable store
+// to the current schema version by rewriting the store. The server must not
+// be running against the same store at the same time
+func runMigrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var storeOpts storeOptions
+	storeOpts.register(fs)
+	fs.Parse(args)
+
+	if !storeOpts.durable() {
+		return errors.New("one of -data-dir or -journal is required")
+	}
+
+	// Records are upgraded in memory as the store is opened
+	store, closeStore, err := storeOpts.open()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	ctx := context.Background()
+	records, err := store.ListRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = store.Replace(ctx, records)
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %v receipts to schema version %v", len(records), receiptSchemaVersion)
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Records as written by builds at each older schema version, all holding newTestReceipt
+var legacyRecordFixtures = map[int]string{
+	1: `{"id":"00000000-0000-0000-0000-000000000001","retailer":"Test Retailer","purchaseDate":"2024-12-18","purchaseTime":"12:00","items":[{"shortDescription":"Test Item","price":"10.00"}],"total":"10.00"}`,
+	2: `{"id":"00000000-0000-0000-0000-000000000002","revisions":[{"revision":1,"createdAt":"2024-12-18T12:00:00Z","receipt":{"id":"00000000-0000-0000-0000-000000000002","retailer":"Test Retailer","purchaseDate":"2024-12-18","purchaseTime":"12:00","items":[{"shortDescription":"Test Item","price":"10.00"}],"total":"10.00"}}],"deletedAt":null}`,
+}
+
+// Expecting one migration per older version, in order
+func TestSchemaMigrations_Registry(t *testing.T) {
+	if len(schemaMigrations) != receiptSchemaVersion-1 {
+		t.Fatalf("expected %v migrations, registry holds %v", receiptSchemaVersion-1, len(schemaMigrations))
+	}
+	for i, migration := range schemaMigrations {
+		if migration.from != i+1 {
+			t.Errorf("migration %v upgrades from version %v, expected %v", i, migration.from, i+1)
+		}
+	}
+
+	for version := 1; version < receiptSchemaVersion; version++ {
+		if _, ok := legacyRecordFixtures[version]; !ok {
+			t.Errorf("no fixture for schema version %v", version)
+		}
+	}
+}
+
+// Expecting records at every older version to upgrade, and unknown versions to be rejected
+func TestDecodeReceiptRecord(t *testing.T) {
+	for version, fixture := range legacyRecordFixtures {
+		record, err := decodeReceiptRecord([]byte(fixture))
+		if err != nil {
+			t.Fatalf("version %v: %v", version, err)
+		}
+
+		latest := record.Latest()
+		if record.SchemaVersion != receiptSchemaVersion || latest.Revision != 1 || latest.Receipt.ID != record.ID || !validRecord(record) {
+			t.Errorf("version %v: decoded wrong record: %+v", version, record)
+		}
+		if latest.Points == nil || latest.Points.Points != 89 {
+			t.Errorf("version %v: migration did not store points: %+v", version, latest.Points)
+		}
+	}
+
+	current, err := json.Marshal(newTestRecord("00000000-0000-0000-0000-000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := decodeReceiptRecord(current)
+	if err != nil || record.Latest().Points != nil {
+		t.Errorf("current record was migrated: %+v, error: %v", record, err)
+	}
+
+	rejected := map[string]string{
+		"FutureVersion": `{"schemaVersion":99,"id":"00000000-0000-0000-0000-000000000000","revisions":[]}`,
+		"ZeroVersion":   `{"schemaVersion":0,"id":"00000000-0000-0000-0000-000000000000","revisions":[]}`,
+		"NoID":          `{"retailer":"Test Retailer"}`,
+		"NotJSON":       `{`,
+		// Scoring these during migration used to panic
+		"MalformedV1": `{"id":"00000000-0000-0000-0000-000000000000","retailer":"Test Retailer","purchaseDate":"2022","purchaseTime":"12:00","items":[],"total":"10.00"}`,
+		"MalformedV2": `{"id":"00000000-0000-0000-0000-000000000000","revisions":[{"revision":1,"receipt":{"id":"00000000-0000-0000-0000-000000000000","retailer":"Test Retailer","purchaseDate":"2022-01-01","purchaseTime":"12:00","items":[],"total":"10"}}]}`,
+	}
+	for name, dat := range rejected {
+		_, err := decodeReceiptRecord([]byte(dat))
+		if !errors.Is(err, errUnreadableRecord) {
+			t.Errorf("%v: expected errUnreadableRecord, got: %v", name, err)
+		}
+	}
+}
+
+func legacyFixtureID(fixture string) string {
+	var record struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal([]byte(fixture), &record)
+	return record.ID
+}
+
+// Frames a raw journal payload, as builds at older schema versions wrote them
+func legacyJournalFrame(payload string) []byte {
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum([]byte(payload), journalCRCTable))
+	return append(frame, payload...)
+}
+
+// Expecting receipts persisted at every older schema version to be served by
+// GET /receipts/{id}/points, from each durable store
+func TestHandlerGetPointsByID_OlderSchemas(t *testing.T) {
+	stores := map[string]func(t *testing.T) ReceiptStore{
+		"file": func(t *testing.T) ReceiptStore {
+			dataDir := t.TempDir()
+			dir := filepath.Join(dataDir, "receipts")
+			err := os.MkdirAll(dir, 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, fixture := range legacyRecordFixtures {
+				err := os.WriteFile(filepath.Join(dir, legacyFixtureID(fixture)+".json"), []byte(fixture), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			store, err := openFileStore(dataDir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		"journal": func(t *testing.T) ReceiptStore {
+			path := filepath.Join(t.TempDir(), "receipts.journal")
+
+			var journal []byte
+			journal = append(journal, legacyJournalFrame(`{"op":"put","id":"00000000-0000-0000-0000-000000000001","receipt":`+legacyRecordFixtures[1]+`}`)...)
+			journal = append(journal, legacyJournalFrame(`{"op":"put","id":"00000000-0000-0000-0000-000000000002","record":`+legacyRecordFixtures[2]+`}`)...)
+			err := os.WriteFile(path, journal, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return openTestJournalStore(t, path, 0)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			apiCfg := apiConfig{
+				DB: newStore(t),
+			}
+
+			for version, fixture := range legacyRecordFixtures {
+				id := legacyFixtureID(fixture)
+				req := httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/points", nil)
+				req.SetPathValue("id", id)
+				w := httptest.NewRecorder()
+				apiCfg.handlerGetPointsByID(w, req)
+
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"points":89`) {
+					t.Errorf("version %v: handler returned %v %s", version, w.Code, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// Expecting the migrate command to rewrite every record at the current version
+func TestRunMigrateCommand(t *testing.T) {
+	dataDir := t.TempDir()
+	dir := filepath.Join(dataDir, "receipts")
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "00000000-0000-0000-0000-000000000001.json"), []byte(legacyRecordFixtures[1]), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runMigrateCommand([]string{"-data-dir", dataDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat, err := os.ReadFile(filepath.Join(dir, "00000000-0000-0000-0000-000000000001.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record ReceiptRecord
+	err = json.Unmarshal(dat, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.SchemaVersion != receiptSchemaVersion || record.Latest().Points == nil {
+		t.Errorf("migrate left record at an older version: %s", dat)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Scores a receipt without storing it, e.g. to show an estimate before it is
+// submitted. Validation and scoring are those of POST /receipts/process, so
+// the estimate matches the points a submission would be awarded
+func (cfg *apiConfig) handlerScoreReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptJSON, ok := receiptBody(w, r)
+	if !ok {
+		return
+	}
+	receipt, err := decodeReceipt(receiptJSON)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The receipt is invalid.", err)
+		return
+	}
+
+	// Includes the share awarded by each rule when "?breakdown=true"
+	var withBreakdown bool
+	if breakdownParam := r.URL.Query().Get("breakdown"); breakdownParam != "" {
+		withBreakdown, err = strconv.ParseBool(breakdownParam)
+		if err != nil {
+			respondWithError(w, r, http.StatusBadRequest, "The breakdown parameter is invalid.", err)
+			return
+		}
+	}
+
+	type ResponseBody struct {
+		Points    int64            `json:"points"`
+		Breakdown *PointsBreakdown `json:"breakdown,omitempty"`
+	}
+
+	points := scoreReceipt(receipt)
+	body := ResponseBody{
+		Points: points.Points,
+	}
+	if withBreakdown {
+		body.Breakdown = &points.Breakdown
+	}
+
+	respond(w, r, http.StatusOK, body)
+}
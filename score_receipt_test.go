@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Expecting the estimate to match the points a submission is awarded, without storing anything
+func TestHandlerScoreReceipt(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("POST /receipts/score", apiCfg.handlerScoreReceipt)
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+
+	dat, err := json.Marshal(newTestReceipt(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path string, dat []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(dat)))
+		return w
+	}
+
+	type ResponseBody struct {
+		Points    int64            `json:"points"`
+		Breakdown *PointsBreakdown `json:"breakdown"`
+	}
+
+	w := post("/receipts/score", dat)
+	if w.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+	}
+	var estimate ResponseBody
+	err = json.NewDecoder(w.Body).Decode(&estimate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Breakdown != nil {
+		t.Errorf("handler returned a breakdown that was not asked for: %+v", estimate.Breakdown)
+	}
+
+	receipts, err := apiCfg.DB.List(context.Background())
+	if err != nil || len(receipts) != 0 {
+		t.Fatalf("handler stored the scored receipt: %v, error: %v", receipts, err)
+	}
+
+	// Expecting the submitted receipt to be awarded the estimate
+	w = post("/receipts/process", dat)
+	var processed struct {
+		ID string `json:"id"`
+	}
+	err = json.NewDecoder(w.Body).Decode(&processed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+processed.ID+"/points", nil))
+	var awarded ResponseBody
+	err = json.NewDecoder(w.Body).Decode(&awarded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Points != 89 || awarded.Points != estimate.Points {
+		t.Errorf("estimate disagrees with submission\nestimated: %v\nawarded: %v", estimate.Points, awarded.Points)
+	}
+
+	w = post("/receipts/score?breakdown=true", dat)
+	var detailed ResponseBody
+	err = json.NewDecoder(w.Body).Decode(&detailed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detailed.Breakdown == nil || *detailed.Breakdown != scoreReceipt(newTestReceipt("")).Breakdown {
+		t.Errorf("handler returned wrong breakdown: %+v", detailed.Breakdown)
+	}
+
+	// Expecting receipts a submission would reject to be rejected
+	invalid := newTestReceipt("")
+	invalid.Total = "10"
+	dat, err = json.Marshal(invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := post("/receipts/score", dat); w.Code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for an invalid receipt, expected %v", w.Code, http.StatusBadRequest)
+	}
+	if w := post("/receipts/score?breakdown=maybe", dat); w.Code != http.StatusBadRequest {
+		t.Errorf("handler returned %v for an invalid breakdown parameter, expected %v", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Snapshot files hold a single JSON header line followed by a JSON array of
+// every stored ReceiptRecord. The header carries the format version and the
+// SHA-256 of the array so a restore can be verified before it is applied.
+//
+// Version 1 snapshots, written before revisions existed, hold an array of
+// bare Receipts and are still accepted.
+//
+// With a keyring the array is sealed under its primary key and the header
+// names that key. The checksum covers the sealed bytes, so a snapshot can be
+// verified without the key
+const (
+	snapshotFormat  = "fetch-receipts-snapshot"
+	snapshotVersion = 2
+)
+
+// Largest snapshot accepted by POST /admin/restore
+const snapshotMaxBytes = 1 << 30
+
+type snapshotHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Count     int       `json:"count"`
+	SHA256    string    `json:"sha256"`
+	KeyID     string    `json:"keyId,omitempty"`
+}
+
+// Writes records to w in the snapshot format, sealed under the primary key if keys is not nil
+func writeSnapshot(w io.Writer, records []ReceiptRecord, keys *keyring) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	body, err = keys.seal(body)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+
+	keyID := ""
+	if keys != nil {
+		keyID = keys.primary
+	}
+
+	header, err := json.Marshal(snapshotHeader{
+		Format:    snapshotFormat,
+		Version:   snapshotVersion,
+		CreatedAt: time.Now().UTC(),
+		Count:     len(records),
+		SHA256:    hex.EncodeToString(sum[:]),
+		KeyID:     keyID,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(header, '\n'))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// Reads a snapshot, verifying its header, checksum and every receipt
+func readSnapshot(r io.Reader, keys *keyring) ([]ReceiptRecord, error) {
+	reader := bufio.NewReader(r)
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.New("missing snapshot header")
+	}
+
+	var header snapshotHeader
+	err = json.Unmarshal(line, &header)
+	if err != nil || header.Format != snapshotFormat {
+		return nil, errors.New("not a receipt snapshot")
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %v", header.Version)
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != header.SHA256 {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+
+	body, keyID, err := keys.open(body)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != header.KeyID {
+		return nil, fmt.Errorf("snapshot is sealed under key %q, header declares %q", keyID, header.KeyID)
+	}
+
+	// Version 1 bare Receipts are upgraded like any record at an older schema version
+	var persisted []json.RawMessage
+	err = json.Unmarshal(body, &persisted)
+	if err != nil {
+		return nil, fmt.Errorf("decoding snapshot: %w", err)
+	}
+
+	records := make([]ReceiptRecord, 0, len(persisted))
+	for i, dat := range persisted {
+		record, err := decodeReceiptRecord(dat)
+		if err != nil {
+			return nil, fmt.Errorf("decoding snapshot receipt %v: %w", i, err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != header.Count {
+		return nil, fmt.Errorf("snapshot holds %v receipts, header declares %v", len(records), header.Count)
+	}
+
+	for _, record := range records {
+		if !validRecord(record) {
+			return nil, fmt.Errorf("snapshot holds invalid receipt %q", record.ID)
+		}
+	}
+
+	return records, nil
+}
+
+// Whether every revision of record is a valid receipt under record.ID, numbered from 1
+func validRecord(record ReceiptRecord) bool {
+	if record.ID == "" || len(record.Revisions) == 0 {
+		return false
+	}
+
+	for i, revision := range record.Revisions {
+		if revision.Revision != i+1 || revision.Receipt.ID != record.ID || !validateReceipt(revision.Receipt) {
+			return false
+		}
+	}
+	return true
+}
+
+// Dumps every stored receipt as a snapshot file
+func (cfg *apiConfig) handlerSnapshot(w http.ResponseWriter, r *http.Request) {
+	records, err := cfg.DB.ListRecords(r.Context())
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to list receipts.", err)
+		return
+	}
+
+	var b bytes.Buffer
+	err = writeSnapshot(&b, records, cfg.Keys)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to write snapshot.", err)
+		return
+	}
+
+	filename := fmt.Sprintf("receipts-%v.snapshot", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+}
+
+// Replaces every stored receipt with the contents of the snapshot in the request body
+func (cfg *apiConfig) handlerRestore(w http.ResponseWriter, r *http.Request) {
+	records, err := readSnapshot(http.MaxBytesReader(w, r.Body, snapshotMaxBytes), cfg.Keys)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The snapshot is invalid.", err)
+		return
+	}
+
+	err = cfg.DB.Replace(r.Context(), records)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to restore snapshot.", err)
+		return
+	}
+
+	type ResponseBody struct {
+		Restored int `json:"restored"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Restored: len(records),
+	})
+}
+
+// Runs the "snapshot" or "restore" command against a durable store.
+// The server must not be running against the same store at the same time
+func runSnapshotCommand(name string, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var storeOpts storeOptions
+	storeOpts.register(fs)
+	path := fs.String("file", "", "snapshot file to write (snapshot) or read (restore)")
+	fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("-file is required")
+	}
+	if !storeOpts.durable() {
+		return errors.New("one of -data-dir or -journal is required")
+	}
+
+	keys, err := storeOpts.keyring()
+	if err != nil {
+		return err
+	}
+
+	store, closeStore, err := storeOpts.open()
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	ctx := context.Background()
+
+	if name == "restore" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		records, err := readSnapshot(f, keys)
+		if err != nil {
+			return err
+		}
+
+		err = store.Replace(ctx, records)
+		if err != nil {
+			return err
+		}
+		log.Printf("Restored %v receipts from %v", len(records), *path)
+		return nil
+	}
+
+	records, err := store.ListRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	err = writeSnapshot(&b, records, keys)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(*path, b.Bytes())
+	if err != nil {
+		return err
+	}
+	log.Printf("Wrote %v receipts to %v", len(records), *path)
+	return nil
+}
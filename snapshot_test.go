@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Expecting a written snapshot to read back unchanged
+func TestSnapshot_RoundTrip(t *testing.T) {
+	receipts := []ReceiptRecord{
+		newTestRecord("00000000-0000-0000-0000-000000000000"),
+		newTestRecord("10000000-2000-3000-4000-500000000000"),
+	}
+	deletedAt := time.Date(2024, 12, 19, 12, 0, 0, 0, time.UTC)
+	receipts[1].DeletedAt = &deletedAt
+
+	var b bytes.Buffer
+	err := writeSnapshot(&b, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := readSnapshot(&b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 2 || actual[0].ID != receipts[0].ID || actual[1].ID != receipts[1].ID || actual[1].DeletedAt == nil {
+		t.Errorf("snapshot read back wrong receipts\nexpected: %+v\nactual: %+v", receipts, actual)
+	}
+}
+
+// Expecting damaged, foreign and invalid snapshots to be rejected
+func TestSnapshot_Rejected(t *testing.T) {
+	var b bytes.Buffer
+	err := writeSnapshot(&b, []ReceiptRecord{newTestRecord("00000000-0000-0000-0000-000000000000")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := b.String()
+
+	invalidRecord := newTestRecord("00000000-0000-0000-0000-000000000000")
+	invalidRecord.Revisions[0].Receipt.Total = ""
+	b.Reset()
+	err = writeSnapshot(&b, []ReceiptRecord{invalidRecord}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots := map[string]string{
+		"Empty":          "",
+		"NotSnapshot":    `{"retailer":"Test Retailer"}` + "\n[]",
+		"FutureVersion":  strings.Replace(valid, `"version":2`, `"version":3`, 1),
+		"BadChecksum":    strings.Replace(valid, "Test Retailer", "Test Retailes", 1),
+		"InvalidReceipt": b.String(),
+	}
+
+	for name, snapshot := range snapshots {
+		_, err := readSnapshot(strings.NewReader(snapshot), nil)
+		if err == nil {
+			t.Errorf("%v: snapshot was accepted", name)
+		}
+	}
+}
+
+// Expecting a snapshot taken over HTTP to restore into another store
+func TestHandlerSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+
+	source := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err := source.DB.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	source.requireAdmin(source.handlerSnapshot)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("snapshot handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+	}
+	snapshot := w.Body.Bytes()
+
+	target := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+	err = target.DB.Put(ctx, newTestReceipt("10000000-2000-3000-4000-500000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(snapshot))
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	target.requireAdmin(target.handlerRestore)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+	}
+
+	var responseBody map[string]int
+	err = json.NewDecoder(w.Body).Decode(&responseBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseBody["restored"] != 1 {
+		t.Errorf("restore handler returned wrong count\nexpected: %v\nactual: %v", 1, responseBody["restored"])
+	}
+
+	receipts, err := target.DB.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 1 || receipts[0].ID != testReceipt.ID {
+		t.Errorf("restore left wrong receipts\nexpected: [%v]\nactual: %+v", testReceipt.ID, receipts)
+	}
+}
+
+// Expecting a corrupt snapshot to be rejected without touching the store
+func TestHandlerRestore_BadRequest(t *testing.T) {
+	ctx := context.Background()
+
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+	}
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err := apiCfg.DB.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader("not a snapshot"))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerRestore)(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("restore handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusBadRequest, w.Code)
+	}
+
+	_, err = apiCfg.DB.Get(ctx, testReceipt.ID)
+	if err != nil {
+		t.Errorf("rejected restore changed the store: %v", err)
+	}
+}
+
+// Expecting admin routes to require the configured bearer token
+func TestRequireAdmin(t *testing.T) {
+	tests := map[string]struct {
+		adminToken    string
+		authorization string
+		expected      int
+	}{
+		"Disabled":   {"", "Bearer ", http.StatusForbidden},
+		"Missing":    {"secret", "", http.StatusUnauthorized},
+		"WrongToken": {"secret", "Bearer guess", http.StatusUnauthorized},
+		"Valid":      {"secret", "Bearer secret", http.StatusOK},
+	}
+
+	for name, test := range tests {
+		apiCfg := apiConfig{
+			DB:         newMemoryStore(),
+			AdminToken: test.adminToken,
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		apiCfg.requireAdmin(apiCfg.handlerSnapshot)(w, req)
+
+		if w.Code != test.expected {
+			t.Errorf("%v: wrong status code\nexpected: %v\nactual: %v", name, test.expected, w.Code)
+		}
+	}
+}
+
+// Expecting the snapshot and restore commands to move receipts between data directories
+func TestRunSnapshotCommand(t *testing.T) {
+	ctx := context.Background()
+	sourceDir := t.TempDir()
+	targetDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "receipts.snapshot")
+
+	source, err := openFileStore(sourceDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+	err = source.Put(ctx, testReceipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runSnapshotCommand("snapshot", []string{"-data-dir", sourceDir, "-file", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runSnapshotCommand("restore", []string{"-data-dir", targetDir, "-file", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := openFileStore(targetDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = target.Get(ctx, testReceipt.ID)
+	if err != nil {
+		t.Errorf("restored store is missing receipt: %v", err)
+	}
+}
+
+// Expecting version 1 snapshots of bare receipts to still restore
+func TestSnapshot_Version1(t *testing.T) {
+	body := `[{"id":"00000000-0000-0000-0000-000000000000","retailer":"Test Retailer","purchaseDate":"2024-12-18","purchaseTime":"12:00","items":[{"shortDescription":"Test Item","price":"10.00"}],"total":"10.00"}]`
+	sum := sha256.Sum256([]byte(body))
+	snapshot := `{"format":"fetch-receipts-snapshot","version":1,"count":1,"sha256":"` + hex.EncodeToString(sum[:]) + `"}` + "\n" + body
+
+	records, err := readSnapshot(strings.NewReader(snapshot), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || len(records[0].Revisions) != 1 || records[0].Latest().Receipt.Total != "10.00" {
+		t.Errorf("snapshot read back wrong records: %+v", records)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Returned by a ReceiptStore when no receipt exists for the requested ID
+var ErrReceiptNotFound = errors.New("receipt not found")
+
+// Returned by a ReceiptStore for receipts that have been soft-deleted
+var ErrReceiptDeleted = errors.New("receipt deleted")
+
+// Persists receipts keyed by their generated ID.
+// Handlers only depend on this interface, so backends can be swapped in main()
+type ReceiptStore interface {
+	// Stores the receipt under receipt.ID as revision 1, replacing any
+	// existing receipt and its history
+	Put(ctx context.Context, receipt Receipt) error
+
+	// Returns the latest revision of the receipt stored under id, or
+	// ErrReceiptNotFound, or ErrReceiptDeleted
+	Get(ctx context.Context, id string) (Receipt, error)
+
+	// Returns the latest revision of every stored receipt that is not deleted, ordered by ID
+	List(ctx context.Context) ([]Receipt, error)
+
+	// Soft-deletes the receipt stored under id by marking it with a tombstone,
+	// or returns ErrReceiptNotFound, or ErrReceiptDeleted
+	Delete(ctx context.Context, id string) error
+
+	// Clears the tombstone of a soft-deleted receipt, or returns ErrReceiptNotFound
+	Undelete(ctx context.Context, id string) error
+
+	// Permanently removes the receipt stored under id, deleted or not,
+	// or returns ErrReceiptNotFound
+	Remove(ctx context.Context, id string) error
+
+	// Permanently removes every receipt soft-deleted before deletedBefore,
+	// returning their IDs
+	Purge(ctx context.Context, deletedBefore time.Time) ([]string, error)
+
+	// Stores receipt as a new revision of the receipt under receipt.ID,
+	// keeping every previous revision, or returns ErrReceiptNotFound, or ErrReceiptDeleted
+	Amend(ctx context.Context, receipt Receipt) (ReceiptRevision, error)
+
+	// Returns the receipt stored under id with its full history, or
+	// ErrReceiptNotFound, or ErrReceiptDeleted
+	GetRecord(ctx context.Context, id string) (ReceiptRecord, error)
+
+	// Returns the latest revision of every receipt that is not deleted and
+	// matches query, ordered by ID. Served from secondary indexes, so the cost
+	// follows the number of matches rather than the number of stored receipts
+	Find(ctx context.Context, query ReceiptQuery) ([]Receipt, error)
+
+	// Returns up to request.Limit receipts that are not deleted and match
+	// request.Query, in request.Order after request.After, with the cursor
+	// of the next page
+	Page(ctx context.Context, request ReceiptPageRequest) (ReceiptPage, error)
+
+	// Returns every stored receipt with its full history ordered by ID,
+	// including soft-deleted ones
+	ListRecords(ctx context.Context) ([]ReceiptRecord, error)
+
+	// Atomically replaces every stored receipt with records.
+	// On error the previous contents are left untouched
+	Replace(ctx context.Context, records []ReceiptRecord) error
+
+	// Scores every revision of the receipt stored under id, deleted or not,
+	// with the current rules. Revisions whose stored points differ are
+	// updated and get the change appended to their Rescores, and are
+	// returned. Returns ErrReceiptNotFound if nothing is stored under id
+	Rescore(ctx context.Context, id string) ([]ReceiptRevision, error)
+}
+
+// One version of a receipt, numbered from 1
+type ReceiptRevision struct {
+	Revision  int       `json:"revision"`
+	CreatedAt time.Time `json:"createdAt"`
+	Receipt   Receipt   `json:"receipt"`
+
+	// Points awarded when the revision was stored. Nil for revisions stored
+	// before points were, until they are rescored
+	Points *ReceiptPoints `json:"points,omitempty"`
+
+	// Every change to Points made by a rescore, oldest first
+	Rescores []PointsRescore `json:"rescores,omitempty"`
+}
+
+// A change to a revision's points made by a rescore
+type PointsRescore struct {
+	RescoredAt time.Time      `json:"rescoredAt"`
+	OldPoints  *ReceiptPoints `json:"oldPoints"`
+	NewPoints  ReceiptPoints  `json:"newPoints"`
+}
+
+// Returns the points awarded to the revision, scoring it now only if it
+// was stored before points were
+func (rev ReceiptRevision) Score() ReceiptPoints {
+	if rev.Points != nil {
+		return *rev.Points
+	}
+	return scoreReceipt(rev.Receipt)
+}
+
+// Returns revision with its points calculated, as stored on ingest
+func scoredRevision(revision ReceiptRevision) ReceiptRevision {
+	points := scoreReceipt(revision.Receipt)
+	revision.Points = &points
+	return revision
+}
+
+// Everything stored under a receipt ID, the unit durable stores persist
+type ReceiptRecord struct {
+	// Always receiptSchemaVersion in memory, see decodeReceiptRecord
+	SchemaVersion int `json:"schemaVersion"`
+
+	ID        string            `json:"id"`
+	Revisions []ReceiptRevision `json:"revisions"`
+
+	// Tombstone set when the receipt is soft-deleted
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// Returns the latest revision
+func (rec ReceiptRecord) Latest() ReceiptRevision {
+	return rec.Revisions[len(rec.Revisions)-1]
+}
+
+// Returns revision number n, if it exists
+func (rec ReceiptRecord) Revision(n int) (ReceiptRevision, bool) {
+	if n < 1 || n > len(rec.Revisions) {
+		return ReceiptRevision{}, false
+	}
+	return rec.Revisions[n-1], true
+}
+
+// Wraps a receipt as a record holding a single revision
+func newReceiptRecord(receipt Receipt, createdAt time.Time) ReceiptRecord {
+	return ReceiptRecord{
+		SchemaVersion: receiptSchemaVersion,
+		ID:            receipt.ID,
+		Revisions: []ReceiptRevision{
+			{
+				Revision:  1,
+				CreatedAt: createdAt,
+				Receipt:   receipt,
+			},
+		},
+	}
+}
+
+// Command line options selecting the ReceiptStore backend
+type storeOptions struct {
+	dataDir             string
+	journalPath         string
+	journalCompactBytes int64
+	encryptionKeyFile   string
+	limits              storeLimits
+}
+
+func (o *storeOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.dataDir, "data-dir", "", "directory receipts are persisted to (in-memory only when empty)")
+	fs.StringVar(&o.journalPath, "journal", "", "append-only journal file receipts are persisted to (in-memory only when empty)")
+	fs.Int64Var(&o.journalCompactBytes, "journal-compact-bytes", 64<<20, "journal size that triggers background compaction (0 disables)")
+	fs.StringVar(&o.encryptionKeyFile, "encryption-key-file", "", "file of encryption keys persisted receipts are sealed with (defaults to $"+encryptionKeysEnv+", unencrypted when neither is set)")
+	fs.IntVar(&o.limits.MaxReceipts, "max-receipts", 0, "evict least recently used receipts beyond this count (0 disables)")
+	fs.Int64Var(&o.limits.MaxBytes, "max-bytes", 0, "evict least recently used receipts beyond this approximate size (0 disables)")
+	fs.DurationVar(&o.limits.TTL, "receipt-ttl", 0, "expire receipts this long after they are stored (0 disables)")
+}
+
+// Whether a durable backend was selected
+func (o *storeOptions) durable() bool {
+	return o.dataDir != "" || o.journalPath != ""
+}
+
+// Loads the keys persisted receipts, snapshots and exports are sealed with, nil if unencrypted
+func (o *storeOptions) keyring() (*keyring, error) {
+	return loadKeyring(o.encryptionKeyFile)
+}
+
+// Opens the selected store, returning a func that releases it
+func (o *storeOptions) open() (ReceiptStore, func() error, error) {
+	noop := func() error { return nil }
+
+	keys, err := o.keyring()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case o.dataDir != "" && o.journalPath != "":
+		return nil, nil, errors.New("only one of -data-dir and -journal may be set")
+
+	case o.durable() && o.limits.enabled():
+		return nil, nil, errors.New("-max-receipts, -max-bytes and -receipt-ttl only apply to the in-memory store")
+
+	case o.dataDir != "":
+		store, err := openFileStore(o.dataDir, keys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening data directory: %w", err)
+		}
+		log.Printf("Persisting receipts to: %v", o.dataDir)
+
+		// Closing waits for files still being rewritten under the primary key
+		reencrypted := make(chan struct{})
+		go func() {
+			defer close(reencrypted)
+			n, err := store.reencrypt()
+			if err != nil {
+				log.Printf("Error re-encrypting receipts: %s", err)
+			}
+			if n > 0 {
+				log.Printf("Re-encrypted %v receipts", n)
+			}
+		}()
+		return store, func() error { <-reencrypted; return nil }, nil
+
+	case o.journalPath != "":
+		store, err := openJournalStore(o.journalPath, o.journalCompactBytes, keys)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening journal: %w", err)
+		}
+		log.Printf("Journaling receipts to: %v", o.journalPath)
+		return store, store.Close, nil
+	}
+
+	if !o.limits.enabled() {
+		return newMemoryStore(), noop, nil
+	}
+
+	store := newBoundedStore(newMemoryStore(), o.limits)
+	ctx, cancel := context.WithCancel(context.Background())
+	if o.limits.TTL > 0 {
+		go store.runExpiry(ctx, min(o.limits.TTL, time.Minute))
+	}
+	log.Printf("Bounding in-memory receipts: %+v", o.limits)
+	return store, func() error { cancel(); return nil }, nil
+}
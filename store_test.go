@@ -0,0 +1,647 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Every ReceiptStore implementation, each run through the conformance suite
+var receiptStoreFactories = map[string]func(t *testing.T) ReceiptStore{
+	"memory": func(t *testing.T) ReceiptStore {
+		return newMemoryStore()
+	},
+}
+
+func TestReceiptStoreConformance(t *testing.T) {
+	for name, newStore := range receiptStoreFactories {
+		t.Run(name, func(t *testing.T) {
+			testReceiptStore(t, newStore)
+		})
+	}
+}
+
+// Runs test once against a fresh store of every kind, for handler tests
+func forEachReceiptStore(t *testing.T, test func(t *testing.T, store ReceiptStore)) {
+	for name, newStore := range receiptStoreFactories {
+		t.Run(name, func(t *testing.T) {
+			test(t, newStore(t))
+		})
+	}
+}
+
+func newTestReceipt(id string) Receipt {
+	return Receipt{
+		ID:           id,
+		Retailer:     "Test Retailer",
+		PurchaseDate: "2024-12-18",
+		PurchaseTime: "12:00",
+		Items: []Item{
+			{
+				ShortDescription: "Test Item", Price: "10.00",
+			},
+		},
+		Total: "10.00",
+	}
+}
+
+func newTestRecord(id string) ReceiptRecord {
+	return newReceiptRecord(newTestReceipt(id), time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC))
+}
+
+// Shared behaviour expected of every ReceiptStore implementation
+func testReceiptStore(t *testing.T, newStore func(t *testing.T) ReceiptStore) {
+	ctx := context.Background()
+
+	// Expecting a stored receipt to be returned unchanged
+	t.Run("PutGet", func(t *testing.T) {
+		store := newStore(t)
+		testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+		err := store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := store.Get(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.ID != testReceipt.ID || actual.Total != testReceipt.Total || len(actual.Items) != 1 {
+			t.Errorf("store returned wrong receipt\nexpected: %+v\nactual: %+v", testReceipt, actual)
+		}
+	})
+
+	// Expecting ErrReceiptNotFound for unknown IDs
+	t.Run("GetNotFound", func(t *testing.T) {
+		store := newStore(t)
+
+		_, err := store.Get(ctx, "10000000-2000-3000-4000-500000000000")
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store returned wrong error\nexpected: %v\nactual: %v", ErrReceiptNotFound, err)
+		}
+	})
+
+	// Expecting a second Put under the same ID to replace the first
+	t.Run("PutReplaces", func(t *testing.T) {
+		store := newStore(t)
+		testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+		err := store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testReceipt.Total = "20.00"
+		err = store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := store.Get(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.Total != "20.00" {
+			t.Errorf("store returned stale receipt\nexpected total: %v\nactual total: %v", "20.00", actual.Total)
+		}
+	})
+
+	// Expecting every stored receipt, ordered by ID
+	t.Run("List", func(t *testing.T) {
+		store := newStore(t)
+		ids := []string{
+			"20000000-0000-0000-0000-000000000000",
+			"00000000-0000-0000-0000-000000000000",
+			"10000000-0000-0000-0000-000000000000",
+		}
+		for _, id := range ids {
+			err := store.Put(ctx, newTestReceipt(id))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		receipts, err := store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(receipts) != len(ids) {
+			t.Fatalf("store listed wrong number of receipts\nexpected: %v\nactual: %v", len(ids), len(receipts))
+		}
+		for i := 1; i < len(receipts); i++ {
+			if receipts[i-1].ID >= receipts[i].ID {
+				t.Errorf("store listed receipts out of order: %v before %v", receipts[i-1].ID, receipts[i].ID)
+			}
+		}
+	})
+
+	// Expecting a deleted receipt to be tombstoned until it is undeleted
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+		err := store.Delete(ctx, testReceipt.ID)
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store returned wrong error deleting unknown receipt\nexpected: %v\nactual: %v", ErrReceiptNotFound, err)
+		}
+
+		err = store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.Delete(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.Get(ctx, testReceipt.ID)
+		if !errors.Is(err, ErrReceiptDeleted) {
+			t.Errorf("store returned deleted receipt, error: %v", err)
+		}
+		_, err = store.Amend(ctx, testReceipt)
+		if !errors.Is(err, ErrReceiptDeleted) {
+			t.Errorf("store amended deleted receipt, error: %v", err)
+		}
+		err = store.Delete(ctx, testReceipt.ID)
+		if !errors.Is(err, ErrReceiptDeleted) {
+			t.Errorf("store returned wrong error\nexpected: %v\nactual: %v", ErrReceiptDeleted, err)
+		}
+
+		receipts, err := store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(receipts) != 0 {
+			t.Errorf("store listed deleted receipt: %+v", receipts)
+		}
+
+		records, err := store.ListRecords(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].DeletedAt == nil {
+			t.Errorf("store did not keep tombstone: %+v", records)
+		}
+
+		err = store.Undelete(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.Get(ctx, testReceipt.ID)
+		if err != nil {
+			t.Errorf("store did not restore undeleted receipt: %v", err)
+		}
+
+		err = store.Undelete(ctx, testReceipt.ID)
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store returned wrong error undeleting live receipt\nexpected: %v\nactual: %v", ErrReceiptNotFound, err)
+		}
+	})
+
+	// Expecting Remove and Purge to permanently remove receipts
+	t.Run("RemovePurge", func(t *testing.T) {
+		store := newStore(t)
+		removed := newTestReceipt("00000000-0000-0000-0000-000000000000")
+		purged := newTestReceipt("10000000-0000-0000-0000-000000000000")
+		kept := newTestReceipt("20000000-0000-0000-0000-000000000000")
+
+		for _, receipt := range []Receipt{removed, purged, kept} {
+			err := store.Put(ctx, receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := store.Remove(ctx, removed.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.Get(ctx, removed.ID)
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store returned removed receipt, error: %v", err)
+		}
+
+		err = store.Delete(ctx, purged.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Expecting a cutoff before the deletion to keep the tombstone
+		ids, err := store.Purge(ctx, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 0 {
+			t.Errorf("store purged receipts deleted after the cutoff: %v", ids)
+		}
+
+		ids, err = store.Purge(ctx, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != purged.ID {
+			t.Errorf("store purged wrong receipts\nexpected: [%v]\nactual: %v", purged.ID, ids)
+		}
+
+		err = store.Undelete(ctx, purged.ID)
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store undeleted purged receipt, error: %v", err)
+		}
+
+		records, err := store.ListRecords(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].ID != kept.ID {
+			t.Errorf("store listed wrong records\nexpected: [%v]\nactual: %+v", kept.ID, records)
+		}
+	})
+
+	// Expecting Replace to swap the contents, and a rejected replacement to keep them
+	t.Run("Replace", func(t *testing.T) {
+		store := newStore(t)
+		err := store.Put(ctx, newTestReceipt("00000000-0000-0000-0000-000000000000"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		replacement := []ReceiptRecord{
+			newTestRecord("10000000-0000-0000-0000-000000000000"),
+			newTestRecord("20000000-0000-0000-0000-000000000000"),
+		}
+		err = store.Replace(ctx, replacement)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		receipts, err := store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(receipts) != 2 || receipts[0].ID != replacement[0].ID || receipts[1].ID != replacement[1].ID {
+			t.Errorf("store listed wrong receipts after Replace\nexpected: %+v\nactual: %+v", replacement, receipts)
+		}
+
+		duplicates := []ReceiptRecord{
+			newTestRecord("30000000-0000-0000-0000-000000000000"),
+			newTestRecord("30000000-0000-0000-0000-000000000000"),
+		}
+		err = store.Replace(ctx, duplicates)
+		if err == nil {
+			t.Errorf("store accepted replacement with duplicate IDs")
+		}
+
+		receipts, err = store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(receipts) != 2 {
+			t.Errorf("rejected Replace changed the store\nexpected: %+v\nactual: %+v", replacement, receipts)
+		}
+	})
+
+	// Expecting Amend to add a revision while keeping the previous ones
+	t.Run("Amend", func(t *testing.T) {
+		store := newStore(t)
+		testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+		_, err := store.Amend(ctx, testReceipt)
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store returned wrong error amending unknown receipt\nexpected: %v\nactual: %v", ErrReceiptNotFound, err)
+		}
+
+		err = store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		amended := testReceipt
+		amended.Total = "20.00"
+		revision, err := store.Amend(ctx, amended)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if revision.Revision != 2 || revision.CreatedAt.IsZero() {
+			t.Errorf("store returned wrong revision: %+v", revision)
+		}
+
+		actual, err := store.Get(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.Total != "20.00" {
+			t.Errorf("store returned stale revision\nexpected total: %v\nactual total: %v", "20.00", actual.Total)
+		}
+
+		record, err := store.GetRecord(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Revisions) != 2 || record.Revisions[0].Receipt.Total != "10.00" || record.Revisions[1].Receipt.Total != "20.00" {
+			t.Errorf("store returned wrong revisions: %+v", record.Revisions)
+		}
+
+		records, err := store.ListRecords(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || len(records[0].Revisions) != 2 {
+			t.Errorf("store listed wrong records: %+v", records)
+		}
+
+		// Expecting Put to start a fresh history
+		err = store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err = store.GetRecord(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Revisions) != 1 {
+			t.Errorf("store kept history across Put: %+v", record.Revisions)
+		}
+	})
+
+	// Expecting Find to follow inserts, amends, deletes and replaces
+	t.Run("Find", func(t *testing.T) {
+		store := newStore(t)
+
+		corner := newTestReceipt("00000000-0000-0000-0000-000000000000")
+		corner.Retailer = "M&M Corner Market"
+		corner.PurchaseDate = "2022-03-20"
+		target := newTestReceipt("10000000-2000-3000-4000-500000000000")
+		target.Retailer = "Target"
+		target.PurchaseDate = "2022-01-01"
+		for _, receipt := range []Receipt{corner, target} {
+			err := store.Put(ctx, receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		find := func(query ReceiptQuery) []string {
+			t.Helper()
+			receipts, err := store.Find(ctx, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, receipt := range receipts {
+				ids = append(ids, receipt.ID)
+			}
+			return ids
+		}
+		points := func(n int64) *int64 {
+			return &n
+		}
+
+		queries := []struct {
+			name     string
+			query    ReceiptQuery
+			expected []string
+		}{
+			{"All", ReceiptQuery{}, []string{corner.ID, target.ID}},
+			{"Retailer", ReceiptQuery{Retailer: "  m&m   CORNER market"}, []string{corner.ID}},
+			{"UnknownRetailer", ReceiptQuery{Retailer: "Walmart"}, []string{}},
+			{"DateRange", ReceiptQuery{PurchasedFrom: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), PurchasedTo: time.Date(2022, 3, 20, 23, 0, 0, 0, time.UTC)}, []string{corner.ID}},
+			{"DateFrom", ReceiptQuery{PurchasedFrom: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}, []string{corner.ID, target.ID}},
+			{"Points", ReceiptQuery{MinPoints: points(scoreReceipt(target).Points), MaxPoints: points(scoreReceipt(target).Points)}, []string{target.ID}},
+			{"Combined", ReceiptQuery{Retailer: "target", PurchasedTo: time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)}, []string{}},
+		}
+		for _, q := range queries {
+			actual := find(q.query)
+			if !slices.Equal(actual, q.expected) {
+				t.Errorf("%v: store found wrong receipts\nexpected: %v\nactual: %v", q.name, q.expected, actual)
+			}
+		}
+
+		// Assert an amend moves the receipt between index entries
+		amended := corner
+		amended.Retailer = "Target"
+		_, err := store.Amend(ctx, amended)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := find(ReceiptQuery{Retailer: "M&M Corner Market"}); len(actual) != 0 {
+			t.Errorf("store found amended receipt under its old retailer: %v", actual)
+		}
+		if actual := find(ReceiptQuery{Retailer: "target"}); len(actual) != 2 {
+			t.Errorf("store did not find amended receipt under its new retailer: %v", actual)
+		}
+
+		// Assert deleted receipts drop out and undeleted ones return
+		err = store.Delete(ctx, target.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := find(ReceiptQuery{Retailer: "target"}); !slices.Equal(actual, []string{corner.ID}) {
+			t.Errorf("store found deleted receipt: %v", actual)
+		}
+		err = store.Undelete(ctx, target.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := find(ReceiptQuery{Retailer: "target"}); len(actual) != 2 {
+			t.Errorf("store did not find undeleted receipt: %v", actual)
+		}
+
+		err = store.Replace(ctx, []ReceiptRecord{newTestRecord("20000000-0000-0000-0000-000000000000")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := find(ReceiptQuery{}); !slices.Equal(actual, []string{"20000000-0000-0000-0000-000000000000"}) {
+			t.Errorf("store found wrong receipts after replace: %v", actual)
+		}
+	})
+
+	// Expecting Page to list live receipts in a stable order, split across pages by cursor
+	t.Run("Page", func(t *testing.T) {
+		store := newStore(t)
+
+		submitted := time.Date(2024, 12, 18, 12, 0, 0, 0, time.UTC)
+		newRecord := func(id string, retailer string, total string, after time.Duration) ReceiptRecord {
+			receipt := newTestReceipt(id)
+			receipt.Retailer = retailer
+			receipt.Total = total
+			return newReceiptRecord(receipt, submitted.Add(after))
+		}
+		a := newRecord("00000000-0000-0000-0000-000000000001", "A", "10.00", 2*time.Hour)
+		b := newRecord("00000000-0000-0000-0000-000000000002", "Target", "10.00", 0)
+		c := newRecord("00000000-0000-0000-0000-000000000003", "Target", "10.00", 0)
+		d := newRecord("00000000-0000-0000-0000-000000000004", "Walgreens", "35.35", time.Hour)
+		deleted := newRecord("00000000-0000-0000-0000-000000000005", "Target", "10.00", 0)
+		deletedAt := submitted
+		deleted.DeletedAt = &deletedAt
+
+		err := store.Replace(ctx, []ReceiptRecord{a, b, c, d, deleted})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Collects every page, following cursors
+		pageAll := func(request ReceiptPageRequest) []string {
+			t.Helper()
+			ids := []string{}
+			for range 10 {
+				page, err := store.Page(ctx, request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page.Records) > request.Limit {
+					t.Fatalf("store returned %v receipts for a page of %v", len(page.Records), request.Limit)
+				}
+				for _, record := range page.Records {
+					ids = append(ids, record.ID)
+				}
+				if page.Next == nil {
+					return ids
+				}
+				request.After = page.Next
+			}
+			t.Fatal("store never returned the last page")
+			return nil
+		}
+		cents := func(n int64) *int64 {
+			return &n
+		}
+
+		requests := []struct {
+			name     string
+			request  ReceiptPageRequest
+			expected []string
+		}{
+			{"Submitted", ReceiptPageRequest{Order: OrderSubmitted, Limit: 2}, []string{b.ID, c.ID, d.ID, a.ID}},
+			{"SubmittedDescending", ReceiptPageRequest{Order: OrderSubmitted, Descending: true, Limit: 2}, []string{a.ID, d.ID, c.ID, b.ID}},
+			{"Points", ReceiptPageRequest{Order: OrderPoints, Limit: 3}, []string{d.ID, a.ID, b.ID, c.ID}},
+			{"PointsDescending", ReceiptPageRequest{Order: OrderPoints, Descending: true, Limit: 1}, []string{c.ID, b.ID, a.ID, d.ID}},
+			{"Retailer", ReceiptPageRequest{Query: ReceiptQuery{Retailer: "target"}, Order: OrderSubmitted, Descending: true, Limit: 1}, []string{c.ID, b.ID}},
+			{"Total", ReceiptPageRequest{Query: ReceiptQuery{MinTotal: cents(1000), MaxTotal: cents(1000)}, Order: OrderPoints, Limit: 2}, []string{a.ID, b.ID, c.ID}},
+			{"OnePage", ReceiptPageRequest{Order: OrderSubmitted, Limit: 10}, []string{b.ID, c.ID, d.ID, a.ID}},
+		}
+		for _, r := range requests {
+			actual := pageAll(r.request)
+			if !slices.Equal(actual, r.expected) {
+				t.Errorf("%v: store paged wrong receipts\nexpected: %v\nactual: %v", r.name, r.expected, actual)
+			}
+		}
+
+		// Expecting a cursor to stay valid when the receipt it points at is gone
+		page, err := store.Page(ctx, ReceiptPageRequest{Order: OrderSubmitted, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Delete(ctx, c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err = store.Page(ctx, ReceiptPageRequest{Order: OrderSubmitted, Limit: 2, After: page.Next})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Records) != 2 || page.Records[0].ID != d.ID || page.Next != nil {
+			t.Errorf("store returned wrong page after a deleted cursor: %+v", page)
+		}
+	})
+
+	// Expecting points to be stored on ingest and rescores to persist
+	t.Run("Rescore", func(t *testing.T) {
+		store := newStore(t)
+		testReceipt := newTestReceipt("00000000-0000-0000-0000-000000000000")
+
+		_, err := store.Rescore(ctx, testReceipt.ID)
+		if !errors.Is(err, ErrReceiptNotFound) {
+			t.Errorf("store returned wrong error rescoring unknown receipt\nexpected: %v\nactual: %v", ErrReceiptNotFound, err)
+		}
+
+		err = store.Put(ctx, testReceipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := store.GetRecord(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points := record.Latest().Points
+		if points == nil || points.Points != 89 || points.Breakdown.Retailer != 12 || points.Breakdown.Total != 75 {
+			t.Errorf("store did not score receipt on ingest: %+v", points)
+		}
+
+		rescored, err := store.Rescore(ctx, testReceipt.ID)
+		if err != nil || len(rescored) != 0 {
+			t.Errorf("store rescored up to date receipt: %+v, error: %v", rescored, err)
+		}
+
+		stale := newTestRecord(testReceipt.ID)
+		err = store.Replace(ctx, []ReceiptRecord{stale})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rescored, err = store.Rescore(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rescored) != 1 || rescored[0].Points == nil || len(rescored[0].Rescores) != 1 {
+			t.Fatalf("store returned wrong rescored revisions: %+v", rescored)
+		}
+
+		record, err = store.GetRecord(ctx, testReceipt.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Latest().Points == nil || len(record.Latest().Rescores) != 1 {
+			t.Errorf("store did not keep rescore: %+v", record.Latest())
+		}
+	})
+
+	// Expecting a receipt posted to the process handler to be scored by the points handler
+	t.Run("Handlers", func(t *testing.T) {
+		apiCfg := apiConfig{
+			DB: newStore(t),
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+		mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+
+		var b bytes.Buffer
+		err := json.NewEncoder(&b).Encode(newTestReceipt(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/receipts/process", &b))
+		if w.Code != http.StatusOK {
+			t.Fatalf("process handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+		}
+
+		var processed map[string]string
+		err = json.NewDecoder(w.Body).Decode(&processed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/receipts/"+processed["id"]+"/points", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("points handler returned wrong status code\nexpected: %v\nactual: %v", http.StatusOK, w.Code)
+		}
+
+		var responseBody map[string]int64
+		err = json.NewDecoder(w.Body).Decode(&responseBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if responseBody["points"] != 89 {
+			t.Errorf("points handler returned incorrect number of points\nexpected: %v\nactual: %v", 89, responseBody["points"])
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Soft-deletes a receipt, later lookups answer 410 Gone until it is undeleted or purged
+func (cfg *apiConfig) handlerDeleteReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID := r.PathValue("id")
+
+	err := cfg.DB.Delete(r.Context(), receiptID)
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+	cfg.Idempotency.forgetReceipt(receiptID)
+	cfg.Webhooks.notify(webhookReceiptDeleted, struct {
+		ID string `json:"id"`
+	}{
+		ID: receiptID,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Restores a soft-deleted receipt that has not been purged yet
+func (cfg *apiConfig) handlerUndeleteReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID := r.PathValue("id")
+
+	err := cfg.DB.Undelete(r.Context(), receiptID)
+	if errors.Is(err, ErrReceiptNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "No deleted receipt found for that ID.", err)
+		return
+	}
+	if err != nil {
+		respondWithStoreError(w, r, err)
+		return
+	}
+
+	type ResponseBody struct {
+		Id string `json:"id"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Id: receiptID,
+	})
+}
+
+// Permanently removes receipts deleted longer ago than the grace period
+func (cfg *apiConfig) handlerPurgeReceipts(w http.ResponseWriter, r *http.Request) {
+	purged, err := cfg.DB.Purge(r.Context(), time.Now().Add(-cfg.PurgeAfter))
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Unable to purge receipts.", err)
+		return
+	}
+
+	type ResponseBody struct {
+		Purged []string `json:"purged"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Purged: append([]string{}, purged...),
+	})
+}
+
+// Purges receipts deleted longer ago than grace every interval until ctx is done
+func runPurger(ctx context.Context, store ReceiptStore, grace time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := store.Purge(ctx, time.Now().Add(-grace))
+			if err != nil {
+				log.Printf("Error purging deleted receipts: %s", err)
+			}
+			if len(purged) > 0 {
+				log.Printf("Purged %v deleted receipts", len(purged))
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Expecting a deleted receipt to answer 410 Gone until it is undeleted, and 404 once purged
+func TestHandlerDeleteReceipt_Lifecycle(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+		PurgeAfter: 0,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /receipts/{id}/points", apiCfg.handlerGetPointsByID)
+	mux.HandleFunc("DELETE /receipts/{id}", apiCfg.handlerDeleteReceipt)
+	mux.HandleFunc("POST /admin/receipts/{id}/undelete", apiCfg.requireAdmin(apiCfg.handlerUndeleteReceipt))
+	mux.HandleFunc("POST /admin/purge", apiCfg.requireAdmin(apiCfg.handlerPurgeReceipts))
+
+	testReceiptID := "00000000-0000-0000-0000-000000000000"
+	err := apiCfg.DB.Put(context.Background(), newTestReceipt(testReceiptID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		method   string
+		path     string
+		expected int
+	}{
+		{http.MethodDelete, "/receipts/" + testReceiptID, http.StatusNoContent},
+		{http.MethodGet, "/receipts/" + testReceiptID + "/points", http.StatusGone},
+		{http.MethodDelete, "/receipts/" + testReceiptID, http.StatusGone},
+		{http.MethodPost, "/admin/receipts/" + testReceiptID + "/undelete", http.StatusOK},
+		{http.MethodGet, "/receipts/" + testReceiptID + "/points", http.StatusOK},
+		{http.MethodPost, "/admin/receipts/" + testReceiptID + "/undelete", http.StatusNotFound},
+		{http.MethodDelete, "/receipts/" + testReceiptID, http.StatusNoContent},
+		{http.MethodPost, "/admin/purge", http.StatusOK},
+		{http.MethodGet, "/receipts/" + testReceiptID + "/points", http.StatusNotFound},
+		{http.MethodDelete, "/receipts/10000000-2000-3000-4000-500000000000", http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		req := httptest.NewRequest(step.method, step.path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if w.Code != step.expected {
+			t.Fatalf("%v %v returned wrong status code\nexpected: %v\nactual: %v", step.method, step.path, step.expected, w.Code)
+		}
+	}
+}
+
+// Expecting the purge handler to keep tombstones still within the grace period
+func TestHandlerPurgeReceipts_GracePeriod(t *testing.T) {
+	ctx := context.Background()
+	apiCfg := apiConfig{
+		DB:         newMemoryStore(),
+		AdminToken: "secret",
+		PurgeAfter: time.Hour,
+	}
+
+	testReceiptID := "00000000-0000-0000-0000-000000000000"
+	err := apiCfg.DB.Put(ctx, newTestReceipt(testReceiptID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = apiCfg.DB.Delete(ctx, testReceiptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/purge", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	apiCfg.requireAdmin(apiCfg.handlerPurgeReceipts)(w, req)
+
+	var responseBody map[string][]string
+	err = json.NewDecoder(w.Body).Decode(&responseBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responseBody["purged"]) != 0 {
+		t.Errorf("handler purged receipts within the grace period: %v", responseBody["purged"])
+	}
+
+	err = apiCfg.DB.Undelete(ctx, testReceiptID)
+	if err != nil {
+		t.Errorf("tombstone within grace period could not be undeleted: %v", err)
+	}
+}
+
+// Expecting the background purger to remove tombstones older than the grace period
+func TestRunPurger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newMemoryStore()
+	testReceiptID := "00000000-0000-0000-0000-000000000000"
+	err := store.Put(ctx, newTestReceipt(testReceiptID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete(ctx, testReceiptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go runPurger(ctx, store, 0, time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := store.Get(ctx, testReceiptID)
+		if errors.Is(err, ErrReceiptNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("purger did not remove tombstone, error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
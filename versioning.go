@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Prefix the current API version's routes are mounted under. The same routes
+// are also served unprefixed, as aliases keeping the contract from before
+// versioning
+const apiVersionPrefix = "/v1"
+
+type apiPrefixKey struct{}
+
+// Mounts api under prefix, marking its requests with the prefix
+func mountAPIVersion(mux *http.ServeMux, prefix string, api http.Handler) {
+	versioned := http.StripPrefix(prefix, api)
+	mux.Handle(prefix+"/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), apiPrefixKey{}, prefix)
+		versioned.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+// Prefix of the API version the request was made to, "" for the unversioned aliases
+func apiPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(apiPrefixKey{}).(string)
+	return prefix
+}
+
+// Deprecation schedule of an API version, announced on every response with
+// the Deprecation (RFC 9745) and Sunset (RFC 8594) headers
+type apiDeprecation struct {
+	// When the version was deprecated, not deprecated when zero
+	At time.Time
+
+	// When the version stops being served, unannounced when zero
+	Sunset time.Time
+
+	// Prefix of the version replacing it, linked as the successor of each path
+	Successor string
+}
+
+// Announces the deprecation on responses from next, if it is deprecated
+func (d apiDeprecation) announce(next http.Handler) http.Handler {
+	if d.At.IsZero() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Deprecation", fmt.Sprintf("@%v", d.At.Unix()))
+		if !d.Sunset.IsZero() {
+			header.Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+		}
+		if d.Successor != "" {
+			header.Add("Link", fmt.Sprintf(`<%v%v>; rel="successor-version"`, d.Successor, r.URL.Path))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parses a flag holding a date such as 2025-01-01 into t
+func dateFlag(t *time.Time) func(string) error {
+	return func(value string) error {
+		date, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			return err
+		}
+		*t = date
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves apiCfg's receipt routes under the current version and unprefixed, as main does
+func newVersionedTestServer(apiCfg *apiConfig, legacy apiDeprecation) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("POST /receipts/score", apiCfg.handlerScoreReceipt)
+	mux.HandleFunc("GET /receipts", apiCfg.handlerListReceipts)
+	mux.HandleFunc("GET /receipts/{id}", apiCfg.handlerGetReceipt)
+	mux.HandleFunc("PUT /receipts/{id}", apiCfg.handlerAmendReceipt)
+
+	legacy.Successor = apiVersionPrefix
+	root := http.NewServeMux()
+	mountAPIVersion(root, apiVersionPrefix, mux)
+	root.Handle("/", legacy.announce(mux))
+	return root
+}
+
+// Expecting versioned creation to answer 201 with a Location, and the unversioned alias to keep answering 200
+func TestProcessReceipts_Versioned(t *testing.T) {
+	apiCfg := apiConfig{
+		DB:          newMemoryStore(),
+		Idempotency: newIdempotencyCache(time.Hour, false),
+	}
+	handler := newVersionedTestServer(&apiCfg, apiDeprecation{})
+
+	dat, err := json.Marshal(newTestReceipt(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path string, idempotencyKey string) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(dat))
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		var body struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body.ID
+	}
+
+	w, id := post("/v1/receipts/process", "key")
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/v1/receipts/"+id {
+		t.Fatalf("handler returned %v with Location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	get := httptest.NewRecorder()
+	handler.ServeHTTP(get, httptest.NewRequest(http.MethodGet, w.Header().Get("Location"), nil))
+	if get.Code != http.StatusOK || !strings.Contains(get.Body.String(), id) {
+		t.Errorf("Location did not lead to the receipt: %v %s", get.Code, get.Body.String())
+	}
+
+	// Expecting a replayed submission to point at the existing receipt without claiming to create it
+	w, replayedID := post("/v1/receipts/process", "key")
+	if w.Code != http.StatusOK || replayedID != id || w.Header().Get("Location") != "/v1/receipts/"+id {
+		t.Errorf("handler returned %v with Location %q for a replay", w.Code, w.Header().Get("Location"))
+	}
+
+	w, _ = post("/receipts/process", "")
+	if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+		t.Errorf("unversioned alias returned %v with Location %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// Expecting a deprecated version to announce its deprecation, sunset and successor on every response
+func TestAPIDeprecation(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	get := func(handler http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	handler := newVersionedTestServer(&apiCfg, apiDeprecation{})
+	if w := get(handler, "/receipts"); w.Header().Get("Deprecation") != "" {
+		t.Errorf("unversioned alias announced a deprecation that was not configured: %v", w.Header())
+	}
+
+	legacy := apiDeprecation{
+		At:     time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		Sunset: time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC),
+	}
+	handler = newVersionedTestServer(&apiCfg, legacy)
+
+	w := get(handler, "/receipts/00000000-0000-0000-0000-000000000000")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unversioned alias returned %v, expected %v", w.Code, http.StatusNotFound)
+	}
+	expected := map[string]string{
+		"Deprecation": "@1735689600",
+		"Sunset":      "Wed, 31 Dec 2025 00:00:00 GMT",
+		"Link":        `</v1/receipts/00000000-0000-0000-0000-000000000000>; rel="successor-version"`,
+	}
+	for key, value := range expected {
+		if actual := w.Header().Get(key); actual != value {
+			t.Errorf("%v header\nexpected: %v\nactual: %v", key, value, actual)
+		}
+	}
+
+	w = get(handler, "/v1/receipts")
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "" || w.Header().Get("Sunset") != "" {
+		t.Errorf("current version returned %v with deprecation headers: %v", w.Code, w.Header())
+	}
+}
+
+// Expecting next links to stay within the version they were requested under
+func TestListReceipts_VersionedNextLink(t *testing.T) {
+	apiCfg := apiConfig{
+		DB: newMemoryStore(),
+	}
+	handler := newVersionedTestServer(&apiCfg, apiDeprecation{})
+
+	ctx := context.Background()
+	for _, id := range []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"} {
+		err := apiCfg.DB.Put(ctx, newTestReceipt(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, prefix := range []string{"", "/v1"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, prefix+"/receipts?limit=1", nil))
+
+		var body struct {
+			Next string `json:"next"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if !strings.HasPrefix(body.Next, prefix+"/receipts?") {
+			t.Errorf("next link %q left version %q", body.Next, prefix)
+		}
+	}
+}
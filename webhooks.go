@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types webhooks can subscribe to
+const (
+	webhookReceiptProcessed = "receipt.processed"
+	webhookReceiptAmended   = "receipt.amended"
+	webhookReceiptDeleted   = "receipt.deleted"
+)
+
+var webhookEventTypes = []string{webhookReceiptProcessed, webhookReceiptAmended, webhookReceiptDeleted}
+
+const (
+	// Deliveries attempted at once
+	webhookWorkers = 4
+
+	// Deliveries waiting for a worker before new ones fail without an attempt
+	webhookQueueSize = 10_000
+
+	// Longest an endpoint may take to answer one attempt
+	webhookTimeout = 10 * time.Second
+
+	// Deliveries listed per subscription, the most recent kept
+	webhookDeliveriesKept = 100
+)
+
+// States of a webhook delivery
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	// The subscription was disabled or removed before it was delivered
+	deliveryCancelled = "cancelled"
+)
+
+// An endpoint events are POSTed to
+type webhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Set when the endpoint was disabled for failing too many deliveries
+	DisabledAt *time.Time `json:"disabledAt,omitempty"`
+
+	// Deliveries in a row that failed every attempt
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+
+	// Key deliveries are signed with
+	secret string
+
+	// Most recent deliveries, oldest first
+	deliveries []*webhookDelivery
+}
+
+// One event sent to one subscription, over one or more attempts
+type webhookDelivery struct {
+	ID        string           `json:"id"`
+	EventID   string           `json:"eventId"`
+	EventType string           `json:"eventType"`
+	Status    string           `json:"status"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Attempts  []webhookAttempt `json:"attempts"`
+
+	body []byte
+}
+
+type webhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Body of every delivery
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data      any       `json:"data"`
+}
+
+type webhookJob struct {
+	subscription *webhookSubscription
+	delivery     *webhookDelivery
+}
+
+// Holds webhook subscriptions in memory and delivers events to them,
+// retrying failed attempts with exponential backoff and jitter, and
+// disabling endpoints that fail disableAfter deliveries in a row
+type webhookDispatcher struct {
+	client       *http.Client
+	maxAttempts  int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	disableAfter int
+	now          func() time.Time
+
+	queue chan webhookJob
+
+	mu            sync.Mutex
+	subscriptions map[string]*webhookSubscription
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// A redirect is a failed attempt, rather than a POST turned into a GET
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		maxAttempts:   6,
+		backoff:       time.Second,
+		maxBackoff:    5 * time.Minute,
+		disableAfter:  5,
+		now:           time.Now,
+		queue:         make(chan webhookJob, webhookQueueSize),
+		subscriptions: map[string]*webhookSubscription{},
+	}
+}
+
+// Delivers queued events with the given number of workers until ctx is done
+func (d *webhookDispatcher) run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-d.queue:
+					d.attempt(ctx, job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Queues an event for every active subscription to its type. Never blocks
+// on delivery. Does nothing on a nil webhookDispatcher
+func (d *webhookDispatcher) notify(eventType string, data any) {
+	if d == nil {
+		return
+	}
+
+	event := webhookEvent{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: d.now(),
+		Data:      data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshalling webhook event: %s", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, subscription := range d.subscriptions {
+		if !subscription.Active || !slices.Contains(subscription.Events, eventType) {
+			continue
+		}
+
+		delivery := &webhookDelivery{
+			ID:        uuid.New().String(),
+			EventID:   event.ID,
+			EventType: eventType,
+			Status:    deliveryPending,
+			CreatedAt: event.CreatedAt,
+			body:      body,
+		}
+		subscription.deliveries = append(subscription.deliveries, delivery)
+		if len(subscription.deliveries) > webhookDeliveriesKept {
+			subscription.deliveries = slices.Delete(subscription.deliveries, 0, len(subscription.deliveries)-webhookDeliveriesKept)
+		}
+		d.enqueue(webhookJob{subscription: subscription, delivery: delivery})
+	}
+}
+
+// Called with the lock held
+func (d *webhookDispatcher) enqueue(job webhookJob) {
+	select {
+	case d.queue <- job:
+	default:
+		// Not the endpoint's fault, so not counted against it
+		log.Printf("Webhook queue is full, dropping delivery %v", job.delivery.ID)
+		job.delivery.Status = deliveryFailed
+	}
+}
+
+// Makes one attempt at a delivery, scheduling a retry if it fails
+func (d *webhookDispatcher) attempt(ctx context.Context, job webhookJob) {
+	subscription, delivery := job.subscription, job.delivery
+
+	d.mu.Lock()
+	if !subscription.Active {
+		delivery.Status = deliveryCancelled
+		d.mu.Unlock()
+		return
+	}
+	endpoint, secret := subscription.URL, subscription.secret
+	d.mu.Unlock()
+
+	at := d.now()
+	statusCode, err := d.post(ctx, endpoint, secret, delivery, at)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	attempt := webhookAttempt{
+		At:         at,
+		StatusCode: statusCode,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	if err == nil {
+		delivery.Status = deliveryDelivered
+		subscription.ConsecutiveFailures = 0
+		return
+	}
+	if len(delivery.Attempts) < d.maxAttempts && subscription.Active {
+		time.AfterFunc(d.retryDelay(len(delivery.Attempts)), func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.enqueue(job)
+		})
+		return
+	}
+
+	delivery.Status = deliveryFailed
+	subscription.ConsecutiveFailures++
+	if subscription.Active && subscription.ConsecutiveFailures >= d.disableAfter {
+		disabledAt := d.now()
+		subscription.Active = false
+		subscription.DisabledAt = &disabledAt
+		log.Printf("Disabled webhook %v after %v failed deliveries in a row", subscription.ID, subscription.ConsecutiveFailures)
+	}
+}
+
+// POSTs a delivery, returning the endpoint's status code. Answers other than 2xx are errors
+func (d *webhookDispatcher) post(ctx context.Context, endpoint string, secret string, delivery *webhookDelivery, at time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-ID", delivery.EventID)
+	req.Header.Set("Webhook-Event", delivery.EventType)
+	req.Header.Set("Webhook-Signature", webhookSignature(secret, at, delivery.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// Drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("endpoint answered %v", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// How long to wait before the attempt after the given number of failed
+// ones: the backoff doubled for each, capped at maxBackoff, of which a
+// random half is waited so retries from many deliveries spread out
+func (d *webhookDispatcher) retryDelay(failed int) time.Duration {
+	delay := d.maxBackoff
+	if failed <= 30 {
+		delay = min(d.backoff<<(failed-1), d.maxBackoff)
+	}
+	return delay/2 + mathrand.N(delay/2+1)
+}
+
+// Signs a delivery as "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+// Covering the time lets receivers reject replayed deliveries
+func webhookSignature(secret string, at time.Time, body []byte) string {
+	timestamp := fmt.Sprint(at.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%v,v1=%v", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Copies a subscription for a response, without its deliveries
+func (d *webhookDispatcher) snapshot(subscription *webhookSubscription) webhookSubscription {
+	copied := *subscription
+	copied.deliveries = nil
+	return copied
+}
+
+func (d *webhookDispatcher) add(endpoint string, events []string, secret string) webhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscription := &webhookSubscription{
+		ID:        uuid.New().String(),
+		URL:       endpoint,
+		Events:    events,
+		Active:    true,
+		CreatedAt: d.now(),
+		secret:    secret,
+	}
+	d.subscriptions[subscription.ID] = subscription
+	return d.snapshot(subscription)
+}
+
+// Every subscription, oldest first
+func (d *webhookDispatcher) list() []webhookSubscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscriptions := make([]webhookSubscription, 0, len(d.subscriptions))
+	for _, subscription := range d.subscriptions {
+		subscriptions = append(subscriptions, d.snapshot(subscription))
+	}
+	slices.SortFunc(subscriptions, func(a, b webhookSubscription) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return subscriptions
+}
+
+// A subscription and its most recent deliveries, newest first
+func (d *webhookDispatcher) get(id string) (webhookSubscription, []webhookDelivery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscription, ok := d.subscriptions[id]
+	if !ok {
+		return webhookSubscription{}, nil, false
+	}
+
+	deliveries := make([]webhookDelivery, 0, len(subscription.deliveries))
+	for _, delivery := range slices.Backward(subscription.deliveries) {
+		copied := *delivery
+		copied.Attempts = slices.Clone(delivery.Attempts)
+		deliveries = append(deliveries, copied)
+	}
+	return d.snapshot(subscription), deliveries, true
+}
+
+// Removes a subscription, cancelling its pending deliveries
+func (d *webhookDispatcher) remove(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscription, ok := d.subscriptions[id]
+	if ok {
+		subscription.Active = false
+		delete(d.subscriptions, id)
+	}
+	return ok
+}
+
+// Reactivates a subscription, forgetting its failures
+func (d *webhookDispatcher) enable(id string) (webhookSubscription, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subscription, ok := d.subscriptions[id]
+	if !ok {
+		return webhookSubscription{}, false
+	}
+	subscription.Active = true
+	subscription.DisabledAt = nil
+	subscription.ConsecutiveFailures = 0
+	return d.snapshot(subscription), true
+}
+
+// Registers an endpoint for the given event types. The secret deliveries
+// are signed with is generated unless given, and only ever returned here
+func (cfg *apiConfig) handlerCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if cfg.Webhooks == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Webhooks are not enabled.", nil)
+		return
+	}
+
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "The subscription is invalid.", err)
+		return
+	}
+
+	endpoint, err := url.Parse(params.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		respondWithError(w, r, http.StatusBadRequest, "The url must be an absolute http or https URL.", err)
+		return
+	}
+	if len(params.Events) == 0 {
+		respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("The events must list at least one of %v.", strings.Join(webhookEventTypes, ", ")), nil)
+		return
+	}
+	for _, event := range params.Events {
+		if !slices.Contains(webhookEventTypes, event) {
+			respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown event type %q, expected one of %v.", event, strings.Join(webhookEventTypes, ", ")), nil)
+			return
+		}
+	}
+
+	if params.Secret == "" {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Unable to generate a secret.", err)
+			return
+		}
+		params.Secret = "whsec_" + hex.EncodeToString(key)
+	}
+
+	type ResponseBody struct {
+		webhookSubscription
+		Secret string `json:"secret"`
+	}
+
+	subscription := cfg.Webhooks.add(endpoint.String(), slices.Compact(slices.Sorted(slices.Values(params.Events))), params.Secret)
+	w.Header().Set("Location", apiPrefix(r)+"/admin/webhooks/"+subscription.ID)
+	respond(w, r, http.StatusCreated, ResponseBody{
+		webhookSubscription: subscription,
+		Secret:              params.Secret,
+	})
+}
+
+func (cfg *apiConfig) handlerListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if cfg.Webhooks == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Webhooks are not enabled.", nil)
+		return
+	}
+
+	type ResponseBody struct {
+		Webhooks []webhookSubscription `json:"webhooks"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		Webhooks: cfg.Webhooks.list(),
+	})
+}
+
+// Returns a subscription with its most recent deliveries and their attempts
+func (cfg *apiConfig) handlerGetWebhook(w http.ResponseWriter, r *http.Request) {
+	if cfg.Webhooks == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Webhooks are not enabled.", nil)
+		return
+	}
+
+	subscription, deliveries, ok := cfg.Webhooks.get(r.PathValue("id"))
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "No webhook found for that ID.", nil)
+		return
+	}
+
+	type ResponseBody struct {
+		webhookSubscription
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}
+
+	respond(w, r, http.StatusOK, ResponseBody{
+		webhookSubscription: subscription,
+		Deliveries:          deliveries,
+	})
+}
+
+func (cfg *apiConfig) handlerDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if cfg.Webhooks == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Webhooks are not enabled.", nil)
+		return
+	}
+
+	if !cfg.Webhooks.remove(r.PathValue("id")) {
+		respondWithError(w, r, http.StatusNotFound, "No webhook found for that ID.", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reactivates an endpoint disabled after failing too many deliveries
+func (cfg *apiConfig) handlerEnableWebhook(w http.ResponseWriter, r *http.Request) {
+	if cfg.Webhooks == nil {
+		respondWithError(w, r, http.StatusNotImplemented, "Webhooks are not enabled.", nil)
+		return
+	}
+
+	subscription, ok := cfg.Webhooks.enable(r.PathValue("id"))
+	if !ok {
+		respondWithError(w, r, http.StatusNotFound, "No webhook found for that ID.", nil)
+		return
+	}
+	respond(w, r, http.StatusOK, subscription)
+}
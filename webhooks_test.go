@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Receives deliveries, answering each with the next of codes and then 200
+type testReceiver struct {
+	mu       sync.Mutex
+	codes    []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (tr *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.requests = append(tr.requests, r)
+	tr.bodies = append(tr.bodies, body)
+
+	code := http.StatusOK
+	if len(tr.codes) > 0 {
+		code, tr.codes = tr.codes[0], tr.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func (tr *testReceiver) received() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.requests)
+}
+
+// Serves the webhook admin routes and receipt processing, with deliveries retried without delay
+func newWebhookTestServer(t *testing.T) (*apiConfig, http.Handler) {
+	apiCfg := &apiConfig{
+		DB:       newMemoryStore(),
+		Webhooks: newWebhookDispatcher(),
+	}
+	apiCfg.Webhooks.backoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go apiCfg.Webhooks.run(ctx, 2)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /receipts/process", apiCfg.handlerProcessReceipts)
+	mux.HandleFunc("DELETE /receipts/{id}", apiCfg.handlerDeleteReceipt)
+	mux.HandleFunc("POST /admin/webhooks", apiCfg.handlerCreateWebhook)
+	mux.HandleFunc("GET /admin/webhooks", apiCfg.handlerListWebhooks)
+	mux.HandleFunc("GET /admin/webhooks/{id}", apiCfg.handlerGetWebhook)
+	mux.HandleFunc("DELETE /admin/webhooks/{id}", apiCfg.handlerDeleteWebhook)
+	mux.HandleFunc("POST /admin/webhooks/{id}/enable", apiCfg.handlerEnableWebhook)
+	return apiCfg, mux
+}
+
+// Sends a request to handler, decoding the JSON response into v if it is not nil
+func serveJSON(t *testing.T, handler http.Handler, method string, path string, body any, v any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		dat, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(dat)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, reader))
+	if v != nil {
+		err := json.Unmarshal(w.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%v %v returned %v %s", method, path, w.Code, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+type testWebhook struct {
+	webhookSubscription
+	Secret     string            `json:"secret"`
+	Deliveries []webhookDelivery `json:"deliveries"`
+}
+
+// Expecting processed receipts to be POSTed to subscribed endpoints, signed with their secret
+func TestWebhooks_Delivery(t *testing.T) {
+	_, handler := newWebhookTestServer(t)
+	receiver := &testReceiver{}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	var webhook testWebhook
+	code := serveJSON(t, handler, http.MethodPost, "/admin/webhooks", map[string]any{
+		"url":    srv.URL,
+		"events": []string{webhookReceiptProcessed},
+	}, &webhook)
+	if code != http.StatusCreated || !strings.HasPrefix(webhook.Secret, "whsec_") || !webhook.Active {
+		t.Fatalf("handler returned %v %+v", code, webhook)
+	}
+
+	var processed struct {
+		ID string `json:"id"`
+	}
+	serveJSON(t, handler, http.MethodPost, "/receipts/process", newTestReceipt(""), &processed)
+
+	// Expecting only subscribed event types to be delivered
+	serveJSON(t, handler, http.MethodDelete, "/receipts/"+processed.ID, nil, nil)
+
+	waitFor(t, "delivery", func() bool { return receiver.received() == 1 })
+	receiver.mu.Lock()
+	req, body := receiver.requests[0], receiver.bodies[0]
+	receiver.mu.Unlock()
+
+	var event struct {
+		ID   string       `json:"id"`
+		Type string       `json:"type"`
+		Data receiptEvent `json:"data"`
+	}
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != webhookReceiptProcessed || event.Data.ID != processed.ID || event.Data.Points != 89 || req.Header.Get("Webhook-ID") != event.ID {
+		t.Errorf("receiver got the wrong event: %v %s", req.Header, body)
+	}
+
+	// Expecting the signature to be verifiable with the secret
+	signature := req.Header.Get("Webhook-Signature")
+	timestamp, _, _ := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	var sentAt int64
+	json.Unmarshal([]byte(timestamp), &sentAt)
+	if expected := webhookSignature(webhook.Secret, time.Unix(sentAt, 0), body); signature != expected {
+		t.Errorf("signature does not match\nexpected: %v\nactual: %v", expected, signature)
+	}
+	if webhookSignature("other secret", time.Unix(sentAt, 0), body) == signature {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var fetched testWebhook
+	waitFor(t, "delivery status", func() bool {
+		serveJSON(t, handler, http.MethodGet, "/admin/webhooks/"+webhook.ID, nil, &fetched)
+		return len(fetched.Deliveries) == 1 && fetched.Deliveries[0].Status == deliveryDelivered
+	})
+	if attempts := fetched.Deliveries[0].Attempts; len(attempts) != 1 || attempts[0].StatusCode != http.StatusOK {
+		t.Errorf("delivery recorded the wrong attempts: %+v", attempts)
+	}
+	if fetched.Secret != "" {
+		t.Error("secret was returned after registration")
+	}
+}
+
+// Expecting failed attempts to be retried until one succeeds
+func TestWebhooks_Retry(t *testing.T) {
+	apiCfg, handler := newWebhookTestServer(t)
+	receiver := &testReceiver{codes: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+
+	var webhook testWebhook
+	serveJSON(t, handler, http.MethodPost, "/admin/webhooks", map[string]any{
+		"url":    srv.URL,
+		"events": []string{webhookReceiptProcessed},
+		"secret": "secret",
+	}, &webhook)
+	apiCfg.Webhooks.notify(webhookReceiptProcessed, receiptEvent{ID: "00000000-0000-0000-0000-000000000000"})
+
+	waitFor(t, "delivery", func() bool {
+		serveJSON(t, handler, http.MethodGet, "/admin/webhooks/"+webhook.ID, nil, &webhook)
+		return len(webhook.Deliveries) == 1 && webhook.Deliveries[0].Status == deliveryDelivered
+	})
+
+	attempts := webhook.Deliveries[0].Attempts
+	if len(attempts) != 3 || attempts[0].StatusCode != http.StatusInternalServerError || attempts[0].Error == "" || attempts[2].StatusCode != http.StatusOK {
+		t.Errorf("delivery recorded the wrong attempts: %+v", attempts)
+	}
+
+	// Expecting every attempt to carry the same event ID, so receivers can deduplicate
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.requests[0].Header.Get("Webhook-ID") != receiver.requests[2].Header.Get("Webhook-ID") {
+		t.Error("retries carried a different event ID")
+	}
+}
+
+// Expecting an endpoint failing delivery after delivery to be disabled until re-enabled
+func TestWebhooks_Disable(t *testing.T) {
+	apiCfg, handler := newWebhookTestServer(t)
+	apiCfg.Webhooks.maxAttempts = 2
+	apiCfg.Webhooks.disableAfter = 2
+
+	var failing atomic.Bool
+	failing.Store(true)
+	var received atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	var webhook testWebhook
+	serveJSON(t, handler, http.MethodPost, "/admin/webhooks", map[string]any{
+		"url":    srv.URL,
+		"events": []string{webhookReceiptProcessed},
+	}, &webhook)
+
+	for range 2 {
+		apiCfg.Webhooks.notify(webhookReceiptProcessed, receiptEvent{})
+	}
+	waitFor(t, "disabling", func() bool {
+		serveJSON(t, handler, http.MethodGet, "/admin/webhooks/"+webhook.ID, nil, &webhook)
+		return !webhook.Active
+	})
+	if webhook.DisabledAt == nil || webhook.ConsecutiveFailures != 2 || received.Load() != 4 {
+		t.Errorf("webhook disabled after %v attempts: %+v", received.Load(), webhook.webhookSubscription)
+	}
+
+	// Expecting no deliveries to a disabled endpoint
+	apiCfg.Webhooks.notify(webhookReceiptProcessed, receiptEvent{})
+	serveJSON(t, handler, http.MethodGet, "/admin/webhooks/"+webhook.ID, nil, &webhook)
+	if len(webhook.Deliveries) != 2 {
+		t.Errorf("disabled webhook got %v deliveries, expected 2", len(webhook.Deliveries))
+	}
+
+	failing.Store(false)
+	code := serveJSON(t, handler, http.MethodPost, "/admin/webhooks/"+webhook.ID+"/enable", nil, &webhook)
+	if code != http.StatusOK || !webhook.Active || webhook.ConsecutiveFailures != 0 {
+		t.Fatalf("handler returned %v %+v", code, webhook.webhookSubscription)
+	}
+	apiCfg.Webhooks.notify(webhookReceiptProcessed, receiptEvent{})
+	waitFor(t, "delivery", func() bool { return received.Load() == 5 })
+
+	// Expecting a removed subscription to be gone
+	if code := serveJSON(t, handler, http.MethodDelete, "/admin/webhooks/"+webhook.ID, nil, nil); code != http.StatusNoContent {
+		t.Errorf("handler returned %v, expected %v", code, http.StatusNoContent)
+	}
+	var list struct {
+		Webhooks []webhookSubscription `json:"webhooks"`
+	}
+	serveJSON(t, handler, http.MethodGet, "/admin/webhooks", nil, &list)
+	if len(list.Webhooks) != 0 {
+		t.Errorf("removed webhook is still listed: %+v", list.Webhooks)
+	}
+}
+
+// Expecting subscriptions to invalid URLs or unknown event types to be refused
+func TestHandlerCreateWebhook_Invalid(t *testing.T) {
+	_, handler := newWebhookTestServer(t)
+
+	for _, body := range []map[string]any{
+		{"url": "ftp://example.com", "events": []string{webhookReceiptProcessed}},
+		{"url": "/relative", "events": []string{webhookReceiptProcessed}},
+		{"url": "https://example.com"},
+		{"url": "https://example.com", "events": []string{"receipt.unknown"}},
+	} {
+		if code := serveJSON(t, handler, http.MethodPost, "/admin/webhooks", body, nil); code != http.StatusBadRequest {
+			t.Errorf("%v: handler returned %v, expected %v", body, code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Expecting retry delays to double, with jitter, up to the cap
+func TestWebhookRetryDelay(t *testing.T) {
+	d := newWebhookDispatcher()
+	tests := []struct {
+		failed   int
+		expected time.Duration
+	}{
+		{failed: 1, expected: time.Second},
+		{failed: 2, expected: 2 * time.Second},
+		{failed: 5, expected: 16 * time.Second},
+		{failed: 20, expected: 5 * time.Minute},
+		{failed: 100, expected: 5 * time.Minute},
+	}
+	for _, tc := range tests {
+		for range 20 {
+			if delay := d.retryDelay(tc.failed); delay < tc.expected/2 || delay > tc.expected {
+				t.Errorf("retry after %v failures in %v, expected between %v and %v", tc.failed, delay, tc.expected/2, tc.expected)
+			}
+		}
+	}
+}